@@ -19,37 +19,116 @@ package aescbc
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
+	"fmt"
+	"io"
 )
 
+// Encrypter and Decrypter are the public contract, which may be implemented
+// outside this package (mocks, wrappers, other backends).
+// Encrypt panics where TryEncrypt would fail, i.e. if the source of
+// randomness fails or src is not accepted by the mode, as CTS input shorter
+// than one block.
 type Encrypter interface {
 	Encrypt(src []byte) []byte
-	doEncrypt(dst, src []byte)
-	calcDstSizeToEnc(src []byte) int
 }
 
 type Decrypter interface {
 	Decrypt(src []byte) ([]byte, error)
+}
+
+// TryEncrypter is implemented by the encrypters of this package, whose
+// TryEncrypt returns the error instead of panicking.
+type TryEncrypter interface {
+	Encrypter
+	TryEncrypt(src []byte) ([]byte, error)
+}
+
+// TryEncrypt encrypts src with x.TryEncrypt if x is a TryEncrypter, and
+// otherwise with x.Encrypt, returning its panic as an error.
+func TryEncrypt(x Encrypter, src []byte) (dst []byte, err error) {
+	if t, ok := x.(TryEncrypter); ok {
+		return t.TryEncrypt(src)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = fmt.Errorf("failed to encrypt: %w", e)
+			} else {
+				err = fmt.Errorf("failed to encrypt: %v", r)
+			}
+		}
+	}()
+	return x.Encrypt(src), nil
+}
+
+// AEADEncrypter and AEADDecrypter are implemented by the authenticated
+// encrypters, which bind a ciphertext to associated data (aad), e.g. the row
+// ID and the column name of a stored value. The associated data is not part
+// of the ciphertext, and DecryptWithAAD fails with ErrAuthenticationFailed
+// unless it is given the same. Encrypt and Decrypt use empty associated data.
+type AEADEncrypter interface {
+	Encrypter
+	EncryptWithAAD(src, aad []byte) ([]byte, error)
+}
+
+type AEADDecrypter interface {
+	Decrypter
+	DecryptWithAAD(src, aad []byte) ([]byte, error)
+}
+
+// encrypter and decrypter are implemented by the types of this package so
+// that they share encryptMain and decryptMain.
+type encrypter interface {
+	Encrypter
+	doEncrypt(dst, src []byte) error
+	calcDstSizeToEnc(src []byte) int
+}
+
+type decrypter interface {
+	Decrypter
 	doDecrypt(dst, src []byte) (int, error)
-	calcDstSizeToDec(src []byte) int
+	calcDstSizeToDec(src []byte) (int, error)
 }
 
-type cbcpkcs7 struct {
-	bm cipher.BlockMode
+// cbc keeps the block cipher and the IV rather than a cipher.BlockMode, whose
+// chaining state would carry over between calls. A new block mode is made per
+// call, so that every message starts from the IV and the value is safe for
+// concurrent use.
+type cbc struct {
+	b  cipher.Block
+	iv []byte
+	p  Padding
 }
 
-type cbcpkcs7iv struct {
-	b cipher.Block
+type cbciv struct {
+	b   cipher.Block
+	p   Padding
+	rng io.Reader
 }
 
-func encryptMain(x Encrypter, src []byte) []byte {
+func encryptMain(x encrypter, src []byte) ([]byte, error) {
 	dst := make([]byte, x.calcDstSizeToEnc(src))
-	x.doEncrypt(dst, src)
+	if err := x.doEncrypt(dst, src); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// MustEncrypt returns dst, and panics with err if it is not nil. It makes
+// Encrypt from TryEncrypt.
+func MustEncrypt(dst []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
 	return dst
 }
 
-func decryptMain(x Decrypter, src []byte) ([]byte, error) {
-	dst := make([]byte, x.calcDstSizeToDec(src))
+func decryptMain(x decrypter, src []byte) ([]byte, error) {
+	size, err := x.calcDstSizeToDec(src)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, size)
 	if dstSize, err := x.doDecrypt(dst, src); err != nil {
 		return nil, err
 	} else {
@@ -57,76 +136,120 @@ func decryptMain(x Decrypter, src []byte) ([]byte, error) {
 	}
 }
 
-func (x *cbcpkcs7) Encrypt(src []byte) []byte {
+func verifyCiphertextSize(blockSize, minSize int, src []byte) error {
+	if len(src) < minSize {
+		return fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(src))
+	}
+	if len(src)%blockSize != 0 {
+		return fmt.Errorf("%w: %d bytes for blockSize %d", ErrNotBlockAligned, len(src), blockSize)
+	}
+	return nil
+}
+
+func (x *cbc) Encrypt(src []byte) []byte {
+	return MustEncrypt(encryptMain(x, src))
+}
+
+func (x *cbc) TryEncrypt(src []byte) ([]byte, error) {
 	return encryptMain(x, src)
 }
 
-func (x *cbcpkcs7) doEncrypt(dst, src []byte) {
-	fillPaddingByPKCS7(x.bm.BlockSize(), dst, src)
-	x.bm.CryptBlocks(dst, dst)
+func (x *cbc) doEncrypt(dst, src []byte) error {
+	if err := x.p.Fill(x.b.BlockSize(), dst, src); err != nil {
+		return fmt.Errorf("failed to fill padding: %w", err)
+	}
+	cipher.NewCBCEncrypter(x.b, x.iv).CryptBlocks(dst, dst)
+	return nil
 }
 
-func (x *cbcpkcs7) calcDstSizeToEnc(src []byte) int {
-	return calcDstSizeForPaddingByPKCS7(x.bm.BlockSize(), src)
+func (x *cbc) calcDstSizeToEnc(src []byte) int {
+	return x.p.CalcDstSize(x.b.BlockSize(), src)
 }
 
-func (x *cbcpkcs7) Decrypt(src []byte) ([]byte, error) {
+func (x *cbc) Decrypt(src []byte) ([]byte, error) {
 	return decryptMain(x, src)
 }
 
-func (x *cbcpkcs7) doDecrypt(dst, src []byte) (int, error) {
-	x.bm.CryptBlocks(dst, src)
-	return verifyPaddingByPKCS7(x.bm.BlockSize(), dst)
+func (x *cbc) doDecrypt(dst, src []byte) (int, error) {
+	cipher.NewCBCDecrypter(x.b, x.iv).CryptBlocks(dst, src)
+	return x.p.Verify(x.b.BlockSize(), dst)
+}
+
+func (x *cbc) calcDstSizeToDec(src []byte) (int, error) {
+	if err := verifyCiphertextSize(x.b.BlockSize(), x.b.BlockSize(), src); err != nil {
+		return -1, err
+	}
+	return len(src), nil
+}
+
+func newCBC(b cipher.Block, iv []byte, p Padding) (*cbc, error) {
+	if len(iv) != b.BlockSize() {
+		return nil, fmt.Errorf("Invalid IV length %d", len(iv))
+	}
+	return &cbc{b, append([]byte(nil), iv...), p}, nil
 }
 
-func (x *cbcpkcs7) calcDstSizeToDec(src []byte) int {
-	return len(src)
+func (x *cbciv) Encrypt(src []byte) []byte {
+	return MustEncrypt(encryptMain(x, src))
 }
 
-func (x *cbcpkcs7iv) Encrypt(src []byte) []byte {
+func (x *cbciv) TryEncrypt(src []byte) ([]byte, error) {
 	return encryptMain(x, src)
 }
 
-func (x *cbcpkcs7iv) doEncrypt(dst, src []byte) {
-	if n, err := rand.Read(dst[:x.b.BlockSize()]); n != x.b.BlockSize() || err != nil {
-		panic("failed to generate IV")
+func (x *cbciv) WithRand(rng io.Reader) Encrypter {
+	return &cbciv{x.b, x.p, rng}
+}
+
+func (x *cbciv) doEncrypt(dst, src []byte) error {
+	if err := readIV(x.rng, dst[:x.b.BlockSize()]); err != nil {
+		return err
+	}
+	if err := x.p.Fill(x.b.BlockSize(), dst[x.b.BlockSize():], src); err != nil {
+		return fmt.Errorf("failed to fill padding: %w", err)
 	}
-	fillPaddingByPKCS7(x.b.BlockSize(), dst[x.b.BlockSize():], src)
 	bm := cipher.NewCBCEncrypter(x.b, dst[:x.b.BlockSize()])
 	bm.CryptBlocks(dst[x.b.BlockSize():], dst[x.b.BlockSize():])
+	return nil
 }
 
-func (x *cbcpkcs7iv) calcDstSizeToEnc(src []byte) int {
-	return calcDstSizeForPaddingByPKCS7(x.b.BlockSize(), src) + x.b.BlockSize()
+func (x *cbciv) calcDstSizeToEnc(src []byte) int {
+	return x.p.CalcDstSize(x.b.BlockSize(), src) + x.b.BlockSize()
 }
 
-func (x *cbcpkcs7iv) Decrypt(src []byte) ([]byte, error) {
+func (x *cbciv) Decrypt(src []byte) ([]byte, error) {
 	return decryptMain(x, src)
 }
 
-func (x *cbcpkcs7iv) doDecrypt(dst, src []byte) (int, error) {
+func (x *cbciv) doDecrypt(dst, src []byte) (int, error) {
 	bm := cipher.NewCBCDecrypter(x.b, src[:x.b.BlockSize()])
 	bm.CryptBlocks(dst, src[x.b.BlockSize():])
-	return verifyPaddingByPKCS7(x.b.BlockSize(), dst)
+	return x.p.Verify(x.b.BlockSize(), dst)
 }
 
-func (x *cbcpkcs7iv) calcDstSizeToDec(src []byte) int {
-	return len(src) - x.b.BlockSize()
+func (x *cbciv) calcDstSizeToDec(src []byte) (int, error) {
+	if err := verifyCiphertextSize(x.b.BlockSize(), 2*x.b.BlockSize(), src); err != nil {
+		return -1, err
+	}
+	return len(src) - x.b.BlockSize(), nil
 }
 
-func NewCBCPKCS7Encrypter(b cipher.Block, iv []byte) Encrypter {
-	return &cbcpkcs7{cipher.NewCBCEncrypter(b, iv)}
+// NewCBCPKCS7Encrypter encrypts every message from iv. Like all the encrypters
+// and decrypters of this package, the result is safe for concurrent use.
+// It fails unless len(iv) equals the block size.
+func NewCBCPKCS7Encrypter(b cipher.Block, iv []byte) (Encrypter, error) {
+	return NewCBCEncrypterWithPadding(b, iv, PKCS7Padding)
 }
 
-func NewCBCPKCS7Decrypter(b cipher.Block, iv []byte) Decrypter {
-	return &cbcpkcs7{cipher.NewCBCDecrypter(b, iv)}
+func NewCBCPKCS7Decrypter(b cipher.Block, iv []byte) (Decrypter, error) {
+	return NewCBCDecrypterWithPadding(b, iv, PKCS7Padding)
 }
 
 func NewAESCBCPKCS7Encrypter(key, iv []byte) (Encrypter, error) {
 	if b, err := aes.NewCipher(key); err != nil {
 		return nil, err
 	} else {
-		return &cbcpkcs7{cipher.NewCBCEncrypter(b, iv)}, nil
+		return NewCBCPKCS7Encrypter(b, iv)
 	}
 }
 
@@ -134,31 +257,33 @@ func NewAESCBCPKCS7Decrypter(key, iv []byte) (Decrypter, error) {
 	if b, err := aes.NewCipher(key); err != nil {
 		return nil, err
 	} else {
-		return &cbcpkcs7{cipher.NewCBCDecrypter(b, iv)}, nil
+		return NewCBCPKCS7Decrypter(b, iv)
 	}
 }
 
 func NewAESCBCPKCS7EncDec(key, iv []byte) (Encrypter, Decrypter, error) {
 	if b, err := aes.NewCipher(key); err != nil {
 		return nil, nil, err
+	} else if x, err := newCBC(b, iv, PKCS7Padding); err != nil {
+		return nil, nil, err
 	} else {
-		return &cbcpkcs7{cipher.NewCBCEncrypter(b, iv)}, &cbcpkcs7{cipher.NewCBCDecrypter(b, iv)}, nil
+		return x, x, nil
 	}
 }
 
 func NewCBCPKCS7ivEncrypter(b cipher.Block) Encrypter {
-	return &cbcpkcs7iv{b}
+	return &cbciv{b: b, p: PKCS7Padding}
 }
 
 func NewCBCPKCS7ivDecrypter(b cipher.Block) Decrypter {
-	return &cbcpkcs7iv{b}
+	return &cbciv{b: b, p: PKCS7Padding}
 }
 
 func NewAESCBCPKCS7ivEncrypter(key []byte) (Encrypter, error) {
 	if b, err := aes.NewCipher(key); err != nil {
 		return nil, err
 	} else {
-		return &cbcpkcs7iv{b}, nil
+		return &cbciv{b: b, p: PKCS7Padding}, nil
 	}
 }
 
@@ -166,7 +291,7 @@ func NewAESCBCPKCS7ivDecrypter(key []byte) (Decrypter, error) {
 	if b, err := aes.NewCipher(key); err != nil {
 		return nil, err
 	} else {
-		return &cbcpkcs7iv{b}, nil
+		return &cbciv{b: b, p: PKCS7Padding}, nil
 	}
 }
 
@@ -174,6 +299,30 @@ func NewAESCBCPKCS7ivEncDec(key []byte) (Encrypter, Decrypter, error) {
 	if b, err := aes.NewCipher(key); err != nil {
 		return nil, nil, err
 	} else {
-		return &cbcpkcs7iv{b}, &cbcpkcs7iv{b}, nil
+		return &cbciv{b: b, p: PKCS7Padding}, &cbciv{b: b, p: PKCS7Padding}, nil
 	}
 }
+
+func NewCBCEncrypterWithPadding(b cipher.Block, iv []byte, p Padding) (Encrypter, error) {
+	if x, err := newCBC(b, iv, p); err != nil {
+		return nil, err
+	} else {
+		return x, nil
+	}
+}
+
+func NewCBCDecrypterWithPadding(b cipher.Block, iv []byte, p Padding) (Decrypter, error) {
+	if x, err := newCBC(b, iv, p); err != nil {
+		return nil, err
+	} else {
+		return x, nil
+	}
+}
+
+func NewCBCivEncrypterWithPadding(b cipher.Block, p Padding) Encrypter {
+	return &cbciv{b: b, p: p}
+}
+
+func NewCBCivDecrypterWithPadding(b cipher.Block, p Padding) Decrypter {
+	return &cbciv{b: b, p: p}
+}
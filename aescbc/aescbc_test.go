@@ -17,8 +17,10 @@
 package aescbc
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/rand"
+	"errors"
 	"testing"
 )
 
@@ -48,8 +50,16 @@ func TestAESCBCPKCS7_1(t *testing.T) {
 				return
 			}
 
-			enc := NewCBCPKCS7Encrypter(cipher, iv)
-			dec := NewCBCPKCS7Decrypter(cipher, iv)
+			enc, err := NewCBCPKCS7Encrypter(cipher, iv)
+			if err != nil {
+				t.Error("failed to create encrypter")
+				return
+			}
+			dec, err := NewCBCPKCS7Decrypter(cipher, iv)
+			if err != nil {
+				t.Error("failed to create decrypter")
+				return
+			}
 
 			encdeccompare(t, size, enc, dec)
 		}
@@ -169,6 +179,20 @@ func TestAESCBCPKCS7_ErrorCase(t *testing.T) {
 			t.Error("Should fail")
 			return
 		}
+
+		key := make([]byte, 16)
+		if _, err := NewAESCBCPKCS7Encrypter(key, iv[:15]); err == nil {
+			t.Error("Should fail")
+			return
+		}
+		if _, err := NewAESCBCPKCS7Decrypter(key, iv[:15]); err == nil {
+			t.Error("Should fail")
+			return
+		}
+		if _, _, err := NewAESCBCPKCS7EncDec(key, iv[:15]); err == nil {
+			t.Error("Should fail")
+			return
+		}
 	}
 }
 
@@ -323,10 +347,151 @@ func encdeccompare(t *testing.T, size int, enc Encrypter, dec Decrypter) bool {
 
 	for i, b := range src {
 		if b != dst[i] {
-			t.Error("data mismatch at %d", i)
+			t.Errorf("data mismatch at %d", i)
 			return false
 		}
 	}
 
 	return true
 }
+
+func TestAESCBCPKCS7_DecryptErrorCase(t *testing.T) {
+
+	key := make([]byte, 16)
+	if n, err := rand.Read(key); n != 16 || err != nil {
+		t.Error("failed to create key")
+		return
+	}
+	iv := make([]byte, 16)
+	if n, err := rand.Read(iv); n != 16 || err != nil {
+		t.Error("failed to create iv")
+		return
+	}
+
+	_, dec, err := NewAESCBCPKCS7EncDec(key, iv)
+	if err != nil {
+		t.Error("failed to create decrypter")
+		return
+	}
+	_, deciv, err := NewAESCBCPKCS7ivEncDec(key)
+	if err != nil {
+		t.Error("failed to create decrypter")
+		return
+	}
+
+	for size := 0; size < 64; size++ {
+		src := make([]byte, size)
+		rand.Read(src)
+
+		_, err := dec.Decrypt(src)
+		switch {
+		case size < 16:
+			if !errors.Is(err, ErrCiphertextTooShort) {
+				t.Errorf("Should fail with ErrCiphertextTooShort %d", size)
+				return
+			}
+		case size%16 != 0:
+			if !errors.Is(err, ErrNotBlockAligned) {
+				t.Errorf("Should fail with ErrNotBlockAligned %d", size)
+				return
+			}
+		}
+
+		_, err = deciv.Decrypt(src)
+		switch {
+		case size < 32:
+			if !errors.Is(err, ErrCiphertextTooShort) {
+				t.Errorf("Should fail with ErrCiphertextTooShort %d", size)
+				return
+			}
+		case size%16 != 0:
+			if !errors.Is(err, ErrNotBlockAligned) {
+				t.Errorf("Should fail with ErrNotBlockAligned %d", size)
+				return
+			}
+		}
+	}
+}
+
+func TestCBCWithPadding_1(t *testing.T) {
+	numOfTrial := 5
+	maxSize := 512
+	paddings := []Padding{PKCS7Padding, ANSIX923Padding, ISO10126Padding, ISO7816Padding}
+
+	for i := 0; i < numOfTrial; i++ {
+
+		key := make([]byte, 16)
+		if n, err := rand.Read(key); n != 16 || err != nil {
+			t.Error("failed to create key")
+			return
+		}
+
+		cipher, err := aes.NewCipher(key)
+		if err != nil {
+			t.Error("failed to create cipher")
+			return
+		}
+
+		for _, p := range paddings {
+			for size := 0; size <= maxSize; size++ {
+
+				iv := make([]byte, 16)
+				if n, err := rand.Read(iv); n != 16 || err != nil {
+					t.Error("failed to create iv")
+					return
+				}
+
+				enc, err := NewCBCEncrypterWithPadding(cipher, iv, p)
+				if err != nil {
+					t.Error("failed to create encrypter")
+					return
+				}
+				dec, err := NewCBCDecrypterWithPadding(cipher, iv, p)
+				if err != nil {
+					t.Error("failed to create decrypter")
+					return
+				}
+				encdeccompare(t, size, enc, dec)
+
+				enciv := NewCBCivEncrypterWithPadding(cipher, p)
+				deciv := NewCBCivDecrypterWithPadding(cipher, p)
+				encdeccompare(t, size, enciv, deciv)
+			}
+		}
+	}
+}
+
+func TestCBCWithPadding_2(t *testing.T) {
+	maxSize := 512
+
+	key := make([]byte, 16)
+	if n, err := rand.Read(key); n != 16 || err != nil {
+		t.Error("failed to create key")
+		return
+	}
+
+	cipher, err := aes.NewCipher(key)
+	if err != nil {
+		t.Error("failed to create cipher")
+		return
+	}
+
+	enc := NewCBCivEncrypterWithPadding(cipher, ZeroPadding)
+	dec := NewCBCivDecrypterWithPadding(cipher, ZeroPadding)
+
+	for size := 0; size <= maxSize; size++ {
+		src := bytes.Repeat([]byte{0x5a}, size)
+		c := enc.Encrypt(src)
+		if size > 0 && size%16 == 0 && len(c) != size+16 {
+			t.Errorf("ciphertext size %d for %d", len(c), size)
+			return
+		}
+		if dst, err := dec.Decrypt(c); err != nil {
+			t.Errorf("failed to decrypt %s", err.Error())
+			return
+		} else if !bytes.Equal(src, dst) {
+			t.Errorf("data mismatch %d", size)
+			return
+		}
+	}
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"sync"
+	"testing"
+)
+
+// Run with -race. Every constructor is used from several goroutines at once,
+// and each message must come out as if it were the only one.
+
+func TestConcurrency_1(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("fedcba9876543210")
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		t.Error("failed to create cipher")
+		return
+	}
+
+	type encdec struct {
+		enc Encrypter
+		dec Decrypter
+	}
+	pairs := map[string]encdec{}
+	if enc, err := NewCBCPKCS7Encrypter(b, iv); err != nil {
+		t.Error("failed to create encrypter")
+		return
+	} else if dec, err := NewCBCPKCS7Decrypter(b, iv); err != nil {
+		t.Error("failed to create decrypter")
+		return
+	} else {
+		pairs["CBCPKCS7"] = encdec{enc, dec}
+	}
+	if enc, err := NewAESCBCPKCS7Encrypter(key, iv); err != nil {
+		t.Error("failed to create encrypter")
+		return
+	} else if dec, err := NewAESCBCPKCS7Decrypter(key, iv); err != nil {
+		t.Error("failed to create decrypter")
+		return
+	} else {
+		pairs["AESCBCPKCS7"] = encdec{enc, dec}
+	}
+	if enc, dec, err := NewAESCBCPKCS7EncDec(key, iv); err != nil {
+		t.Error("failed to create encrypter")
+		return
+	} else {
+		pairs["AESCBCPKCS7EncDec"] = encdec{enc, dec}
+	}
+	if enc, err := NewCBCEncrypterWithPadding(b, iv, ANSIX923Padding); err != nil {
+		t.Error("failed to create encrypter")
+		return
+	} else if dec, err := NewCBCDecrypterWithPadding(b, iv, ANSIX923Padding); err != nil {
+		t.Error("failed to create decrypter")
+		return
+	} else {
+		pairs["CBCWithPadding"] = encdec{enc, dec}
+	}
+	if enc, err := NewCBCCTSEncrypter(b, iv, CS1); err != nil {
+		t.Error("failed to create encrypter")
+		return
+	} else if dec, err := NewCBCCTSDecrypter(b, iv, CS1); err != nil {
+		t.Error("failed to create decrypter")
+		return
+	} else {
+		pairs["CBCCTS"] = encdec{enc, dec}
+	}
+	if enc, dec, err := NewAESCBCCTSEncDec(key, iv, CS3); err != nil {
+		t.Error("failed to create encrypter")
+		return
+	} else {
+		pairs["AESCBCCTSEncDec"] = encdec{enc, dec}
+	}
+	if enc, err := NewAESCBCCTSEncrypter(key, iv, CS2); err != nil {
+		t.Error("failed to create encrypter")
+		return
+	} else if dec, err := NewAESCBCCTSDecrypter(key, iv, CS2); err != nil {
+		t.Error("failed to create decrypter")
+		return
+	} else {
+		pairs["AESCBCCTS"] = encdec{enc, dec}
+	}
+
+	src := bytes.Repeat([]byte("0123456789"), 10)
+	for name, x := range pairs {
+		expected := x.enc.Encrypt(src)
+		if c := x.enc.Encrypt(src); !bytes.Equal(expected, c) {
+			t.Errorf("%s: second message not encrypted from the IV", name)
+			return
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan string, 8)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if c := x.enc.Encrypt(src); !bytes.Equal(expected, c) {
+						errs <- "ciphertext mismatch"
+						return
+					}
+					if dst, err := x.dec.Decrypt(expected); err != nil || !bytes.Equal(src, dst) {
+						errs <- "plaintext mismatch"
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for msg := range errs {
+			t.Errorf("%s: %s", name, msg)
+			return
+		}
+	}
+}
+
+func TestConcurrency_2(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		t.Error("failed to create cipher")
+		return
+	}
+
+	type encdec struct {
+		enc Encrypter
+		dec Decrypter
+	}
+	pairs := map[string]encdec{}
+	pairs["CBCPKCS7iv"] = encdec{NewCBCPKCS7ivEncrypter(b), NewCBCPKCS7ivDecrypter(b)}
+	pairs["CBCivWithPadding"] = encdec{NewCBCivEncrypterWithPadding(b, ISO10126Padding), NewCBCivDecrypterWithPadding(b, ISO10126Padding)}
+	if enc, err := NewCBCCTSivEncrypter(b, CS3); err != nil {
+		t.Error("failed to create encrypter")
+		return
+	} else if dec, err := NewCBCCTSivDecrypter(b, CS3); err != nil {
+		t.Error("failed to create decrypter")
+		return
+	} else {
+		pairs["CBCCTSiv"] = encdec{enc, dec}
+	}
+	if enc, dec, err := NewAESCBCPKCS7ivEncDec(key); err != nil {
+		t.Error("failed to create encrypter")
+		return
+	} else {
+		pairs["AESCBCPKCS7iv"] = encdec{enc, dec}
+	}
+	if enc, dec, err := NewAESCBCPKCS7HMACEncDec(key); err != nil {
+		t.Error("failed to create encrypter")
+		return
+	} else {
+		pairs["AESCBCPKCS7HMAC"] = encdec{enc, dec}
+	}
+
+	src := bytes.Repeat([]byte("0123456789"), 10)
+	for name, x := range pairs {
+		var wg sync.WaitGroup
+		errs := make(chan string, 8)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if dst, err := x.dec.Decrypt(x.enc.Encrypt(src)); err != nil || !bytes.Equal(src, dst) {
+						errs <- "plaintext mismatch"
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for msg := range errs {
+			t.Errorf("%s: %s", name, msg)
+			return
+		}
+	}
+}
@@ -0,0 +1,304 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+)
+
+// CTSVariant selects the order of the last two blocks in CBC ciphertext
+// stealing, as defined in the addendum to NIST SP 800-38A.
+type CTSVariant int
+
+const (
+	// CS1 keeps the partial block before the last full block.
+	CS1 CTSVariant = iota + 1
+	// CS2 swaps the last two blocks only when the last one is partial.
+	CS2
+	// CS3 always swaps the last two blocks. (Kerberos, RFC 3962)
+	CS3
+)
+
+// cbccts is CBC with ciphertext stealing, whose ciphertext has the same
+// length as the plaintext. The plaintext must be at least one block long.
+type cbccts struct {
+	b  cipher.Block
+	iv []byte
+	v  CTSVariant
+}
+
+// cbcctsiv is cbccts with a random IV prepended, as cbciv.
+type cbcctsiv struct {
+	b   cipher.Block
+	v   CTSVariant
+	rng io.Reader
+}
+
+func (x *cbccts) Encrypt(src []byte) []byte {
+	return MustEncrypt(encryptMain(x, src))
+}
+
+func (x *cbccts) TryEncrypt(src []byte) ([]byte, error) {
+	return encryptMain(x, src)
+}
+
+func (x *cbccts) doEncrypt(dst, src []byte) error {
+	return encryptCTS(x.b, x.iv, x.v, dst, src)
+}
+
+func (x *cbccts) calcDstSizeToEnc(src []byte) int {
+	return len(src)
+}
+
+func (x *cbccts) Decrypt(src []byte) ([]byte, error) {
+	return decryptMain(x, src)
+}
+
+func (x *cbccts) doDecrypt(dst, src []byte) (int, error) {
+	decryptCTS(x.b, x.iv, x.v, dst, src)
+	return len(dst), nil
+}
+
+func (x *cbccts) calcDstSizeToDec(src []byte) (int, error) {
+	if len(src) < x.b.BlockSize() {
+		return -1, fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(src))
+	}
+	return len(src), nil
+}
+
+func (x *cbcctsiv) Encrypt(src []byte) []byte {
+	return MustEncrypt(encryptMain(x, src))
+}
+
+func (x *cbcctsiv) TryEncrypt(src []byte) ([]byte, error) {
+	return encryptMain(x, src)
+}
+
+func (x *cbcctsiv) WithRand(rng io.Reader) Encrypter {
+	return &cbcctsiv{x.b, x.v, rng}
+}
+
+func (x *cbcctsiv) doEncrypt(dst, src []byte) error {
+	bs := x.b.BlockSize()
+	if len(src) < bs {
+		return fmt.Errorf("Input shorter than the block size %d", bs)
+	}
+	if err := readIV(x.rng, dst[:bs]); err != nil {
+		return err
+	}
+	return encryptCTS(x.b, dst[:bs], x.v, dst[bs:], src)
+}
+
+func (x *cbcctsiv) calcDstSizeToEnc(src []byte) int {
+	return len(src) + x.b.BlockSize()
+}
+
+func (x *cbcctsiv) Decrypt(src []byte) ([]byte, error) {
+	return decryptMain(x, src)
+}
+
+func (x *cbcctsiv) doDecrypt(dst, src []byte) (int, error) {
+	bs := x.b.BlockSize()
+	decryptCTS(x.b, src[:bs], x.v, dst, src[bs:])
+	return len(dst), nil
+}
+
+func (x *cbcctsiv) calcDstSizeToDec(src []byte) (int, error) {
+	if len(src) < 2*x.b.BlockSize() {
+		return -1, fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(src))
+	}
+	return len(src) - x.b.BlockSize(), nil
+}
+
+// encryptCTS encrypts src with zero padding in CBC mode, then drops the
+// padding from the second last block and arranges the last two blocks
+// according to v. len(dst) must equal len(src).
+func encryptCTS(b cipher.Block, iv []byte, v CTSVariant, dst, src []byte) error {
+	bs := b.BlockSize()
+	if len(src) < bs {
+		return fmt.Errorf("Input shorter than the block size %d", bs)
+	}
+	n := (len(src) + bs - 1) / bs
+	d := n*bs - len(src)
+
+	buf := make([]byte, n*bs)
+	copy(buf, src)
+	cipher.NewCBCEncrypter(b, iv).CryptBlocks(buf, buf)
+	if n == 1 {
+		copy(dst, buf)
+		return nil
+	}
+
+	head := (n - 2) * bs
+	partial := buf[head : head+bs-d]
+	last := buf[head+bs:]
+	copy(dst, buf[:head])
+	if v == CS1 || (v == CS2 && d == 0) {
+		copy(dst[head:], partial)
+		copy(dst[head+bs-d:], last)
+	} else {
+		copy(dst[head:], last)
+		copy(dst[head+bs:], partial)
+	}
+	return nil
+}
+
+// decryptCTS reverses encryptCTS. The bytes stolen from the second last
+// block are recovered from the decryption of the last block.
+func decryptCTS(b cipher.Block, iv []byte, v CTSVariant, dst, src []byte) {
+	bs := b.BlockSize()
+	n := (len(src) + bs - 1) / bs
+	d := n*bs - len(src)
+	if n == 1 {
+		cipher.NewCBCDecrypter(b, iv).CryptBlocks(dst, src)
+		return
+	}
+
+	head := (n - 2) * bs
+	var partial, last []byte
+	if v == CS1 || (v == CS2 && d == 0) {
+		partial, last = src[head:head+bs-d], src[head+bs-d:]
+	} else {
+		last, partial = src[head:head+bs], src[head+bs:]
+	}
+
+	z := make([]byte, bs)
+	b.Decrypt(z, last)
+	buf := make([]byte, head+bs)
+	copy(buf, src[:head])
+	copy(buf[head:], partial)
+	copy(buf[head+bs-d:], z[bs-d:])
+	for i := 0; i < bs-d; i++ {
+		dst[head+bs+i] = z[i] ^ buf[head+i]
+	}
+	cipher.NewCBCDecrypter(b, iv).CryptBlocks(dst[:head+bs], buf)
+}
+
+func verifyCTSVariant(v CTSVariant) error {
+	if v != CS1 && v != CS2 && v != CS3 {
+		return fmt.Errorf("Invalid CTS variant %d", v)
+	}
+	return nil
+}
+
+// NewCBCCTSEncrypter encrypts every message from iv. The ciphertext has the
+// length of the plaintext, which must be at least one block long; TryEncrypt
+// fails and Encrypt panics on shorter input. It fails unless len(iv) equals
+// the block size.
+func NewCBCCTSEncrypter(b cipher.Block, iv []byte, v CTSVariant) (Encrypter, error) {
+	if x, err := newCBCCTS(b, iv, v); err != nil {
+		return nil, err
+	} else {
+		return x, nil
+	}
+}
+
+func NewCBCCTSDecrypter(b cipher.Block, iv []byte, v CTSVariant) (Decrypter, error) {
+	if x, err := newCBCCTS(b, iv, v); err != nil {
+		return nil, err
+	} else {
+		return x, nil
+	}
+}
+
+func newCBCCTS(b cipher.Block, iv []byte, v CTSVariant) (*cbccts, error) {
+	if err := verifyCTSVariant(v); err != nil {
+		return nil, err
+	} else if len(iv) != b.BlockSize() {
+		return nil, fmt.Errorf("Invalid IV length %d", len(iv))
+	}
+	return &cbccts{b, append([]byte(nil), iv...), v}, nil
+}
+
+func NewAESCBCCTSEncrypter(key, iv []byte, v CTSVariant) (Encrypter, error) {
+	if err := verifyCTSVariant(v); err != nil {
+		return nil, err
+	} else if b, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	} else {
+		return NewCBCCTSEncrypter(b, iv, v)
+	}
+}
+
+func NewAESCBCCTSDecrypter(key, iv []byte, v CTSVariant) (Decrypter, error) {
+	if err := verifyCTSVariant(v); err != nil {
+		return nil, err
+	} else if b, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	} else {
+		return NewCBCCTSDecrypter(b, iv, v)
+	}
+}
+
+func NewAESCBCCTSEncDec(key, iv []byte, v CTSVariant) (Encrypter, Decrypter, error) {
+	if err := verifyCTSVariant(v); err != nil {
+		return nil, nil, err
+	} else if b, err := aes.NewCipher(key); err != nil {
+		return nil, nil, err
+	} else if x, err := newCBCCTS(b, iv, v); err != nil {
+		return nil, nil, err
+	} else {
+		return x, x, nil
+	}
+}
+
+// NewCBCCTSivEncrypter prepends a random IV as NewCBCPKCS7ivEncrypter. The
+// plaintext must be at least one block long; TryEncrypt fails and Encrypt
+// panics on shorter input.
+func NewCBCCTSivEncrypter(b cipher.Block, v CTSVariant) (Encrypter, error) {
+	if err := verifyCTSVariant(v); err != nil {
+		return nil, err
+	}
+	return &cbcctsiv{b: b, v: v}, nil
+}
+
+func NewCBCCTSivDecrypter(b cipher.Block, v CTSVariant) (Decrypter, error) {
+	if err := verifyCTSVariant(v); err != nil {
+		return nil, err
+	}
+	return &cbcctsiv{b: b, v: v}, nil
+}
+
+func NewAESCBCCTSivEncrypter(key []byte, v CTSVariant) (Encrypter, error) {
+	if b, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	} else {
+		return NewCBCCTSivEncrypter(b, v)
+	}
+}
+
+func NewAESCBCCTSivDecrypter(key []byte, v CTSVariant) (Decrypter, error) {
+	if b, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	} else {
+		return NewCBCCTSivDecrypter(b, v)
+	}
+}
+
+func NewAESCBCCTSivEncDec(key []byte, v CTSVariant) (Encrypter, Decrypter, error) {
+	if err := verifyCTSVariant(v); err != nil {
+		return nil, nil, err
+	} else if b, err := aes.NewCipher(key); err != nil {
+		return nil, nil, err
+	} else {
+		x := &cbcctsiv{b: b, v: v}
+		return x, x, nil
+	}
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+// Known answers from RFC 3962 Appendix B, which is CS3 with a zero IV.
+// CS1 and CS2 are the same ciphertext with the last two blocks reordered.
+var ctsTestKey = "636869636b656e207465726979616b69"
+
+var ctsTestVectors = []struct {
+	input  string
+	output string
+}{
+	{
+		"I would like the ",
+		"c6353568f2bf8cb4d8a580362da7ff7f97",
+	},
+	{
+		"I would like the General Gau's ",
+		"fc00783e0efdb2c1d445d4c8eff7ed2297687268d6ecccc0c07b25e25ecfe5",
+	},
+	{
+		"I would like the General Gau's C",
+		"39312523a78662d5be7fcbcc98ebf5a897687268d6ecccc0c07b25e25ecfe584",
+	},
+	{
+		"I would like the General Gau's Chicken, please,",
+		"97687268d6ecccc0c07b25e25ecfe584b3fffd940c16a18c1b5549d2f838029e39312523a78662d5be7fcbcc98ebf5",
+	},
+	{
+		"I would like the General Gau's Chicken, please, ",
+		"97687268d6ecccc0c07b25e25ecfe5849dad8bbb96c4cdc03bc103e1a194bbd839312523a78662d5be7fcbcc98ebf5a8",
+	},
+	{
+		"I would like the General Gau's Chicken, please, and wonton soup.",
+		"97687268d6ecccc0c07b25e25ecfe58439312523a78662d5be7fcbcc98ebf5a84807efe836ee89a526730dbc2f7bc8409dad8bbb96c4cdc03bc103e1a194bbd8",
+	},
+}
+
+func ctsExpected(v CTSVariant, cs3 []byte) []byte {
+	n := (len(cs3) + 15) / 16
+	d := n*16 - len(cs3)
+	if v == CS3 || (v == CS2 && d != 0) {
+		return cs3
+	}
+	head := (n - 2) * 16
+	expected := append([]byte{}, cs3[:head]...)
+	expected = append(expected, cs3[head+16:]...)
+	return append(expected, cs3[head:head+16]...)
+}
+
+func TestCBCCTS_KnownAnswer(t *testing.T) {
+	key, _ := hex.DecodeString(ctsTestKey)
+	iv := make([]byte, 16)
+
+	for _, v := range []CTSVariant{CS1, CS2, CS3} {
+		enc, dec, err := NewAESCBCCTSEncDec(key, iv, v)
+		if err != nil {
+			t.Error("failed to create encrypter")
+			return
+		}
+		for i, tv := range ctsTestVectors {
+			cs3, _ := hex.DecodeString(tv.output)
+			expected := ctsExpected(v, cs3)
+			if c := enc.Encrypt([]byte(tv.input)); !bytes.Equal(expected, c) {
+				t.Errorf("CS%d vector %d: %x", v, i, c)
+				return
+			}
+			if dst, err := dec.Decrypt(expected); err != nil {
+				t.Errorf("CS%d vector %d: %s", v, i, err.Error())
+				return
+			} else if string(dst) != tv.input {
+				t.Errorf("CS%d vector %d: %q", v, i, dst)
+				return
+			}
+		}
+	}
+}
+
+func TestCBCCTS_1(t *testing.T) {
+	numOfTrial := 5
+	maxSize := 512
+
+	for i := 0; i < numOfTrial; i++ {
+
+		key := make([]byte, 16)
+		if n, err := rand.Read(key); n != 16 || err != nil {
+			t.Error("failed to create key")
+			return
+		}
+
+		cipher, err := aes.NewCipher(key)
+		if err != nil {
+			t.Error("failed to create cipher")
+			return
+		}
+
+		for _, v := range []CTSVariant{CS1, CS2, CS3} {
+			for size := 16; size <= maxSize; size++ {
+
+				iv := make([]byte, 16)
+				if n, err := rand.Read(iv); n != 16 || err != nil {
+					t.Error("failed to create iv")
+					return
+				}
+
+				enc, err := NewCBCCTSEncrypter(cipher, iv, v)
+				if err != nil {
+					t.Error("failed to create encrypter")
+					return
+				}
+				dec, err := NewCBCCTSDecrypter(cipher, iv, v)
+				if err != nil {
+					t.Error("failed to create decrypter")
+					return
+				}
+				if len(enc.Encrypt(make([]byte, size))) != size {
+					t.Errorf("ciphertext size for %d", size)
+					return
+				}
+				encdeccompare(t, size, enc, dec)
+
+				enciv, err := NewCBCCTSivEncrypter(cipher, v)
+				if err != nil {
+					t.Error("failed to create encrypter")
+					return
+				}
+				deciv, err := NewCBCCTSivDecrypter(cipher, v)
+				if err != nil {
+					t.Error("failed to create decrypter")
+					return
+				}
+				if len(enciv.Encrypt(make([]byte, size))) != size+16 {
+					t.Errorf("ciphertext size for %d", size)
+					return
+				}
+				encdeccompare(t, size, enciv, deciv)
+			}
+		}
+	}
+}
+
+func TestCBCCTS_2(t *testing.T) {
+	maxSize := 512
+
+	key := make([]byte, 32)
+	if n, err := rand.Read(key); n != 32 || err != nil {
+		t.Error("failed to create key")
+		return
+	}
+
+	for _, v := range []CTSVariant{CS1, CS2, CS3} {
+
+		enc, err := NewAESCBCCTSivEncrypter(key, v)
+		if err != nil {
+			t.Error("failed to create encrypter")
+			return
+		}
+		dec, err := NewAESCBCCTSivDecrypter(key, v)
+		if err != nil {
+			t.Error("failed to create decrypter")
+			return
+		}
+		for size := 16; size <= maxSize; size++ {
+			encdeccompare(t, size, enc, dec)
+		}
+
+		enc, dec, err = NewAESCBCCTSivEncDec(key, v)
+		if err != nil {
+			t.Error("failed to create encrypter")
+			return
+		}
+		for size := 16; size <= maxSize; size++ {
+			encdeccompare(t, size, enc, dec)
+		}
+	}
+}
+
+func TestCBCCTS_ErrorCase(t *testing.T) {
+
+	key := make([]byte, 16)
+	iv := make([]byte, 16)
+
+	for _, v := range []CTSVariant{0, 4} {
+		if _, err := NewAESCBCCTSEncrypter(key, iv, v); err == nil {
+			t.Error("Should fail")
+			return
+		}
+		if _, err := NewAESCBCCTSivDecrypter(key, v); err == nil {
+			t.Error("Should fail")
+			return
+		}
+	}
+	if _, err := NewAESCBCCTSEncrypter(key[:15], iv, CS3); err == nil {
+		t.Error("Should fail")
+		return
+	}
+	for _, v := range []CTSVariant{0, 4} {
+		if _, err := NewAESCBCCTSDecrypter(key, iv, v); err == nil {
+			t.Error("Should fail")
+			return
+		}
+		if _, _, err := NewAESCBCCTSEncDec(key, iv, v); err == nil {
+			t.Error("Should fail")
+			return
+		}
+	}
+	for _, n := range []int{0, 15, 17, 32} {
+		if _, err := NewAESCBCCTSEncrypter(key, make([]byte, n), CS3); err == nil {
+			t.Errorf("Should fail with IV of %d bytes", n)
+			return
+		}
+		if _, err := NewAESCBCCTSDecrypter(key, make([]byte, n), CS3); err == nil {
+			t.Errorf("Should fail with IV of %d bytes", n)
+			return
+		}
+		if _, _, err := NewAESCBCCTSEncDec(key, make([]byte, n), CS3); err == nil {
+			t.Errorf("Should fail with IV of %d bytes", n)
+			return
+		}
+	}
+
+	_, dec, err := NewAESCBCCTSEncDec(key, iv, CS3)
+	if err != nil {
+		t.Error("failed to create encrypter")
+		return
+	}
+	_, deciv, err := NewAESCBCCTSivEncDec(key, CS3)
+	if err != nil {
+		t.Error("failed to create encrypter")
+		return
+	}
+	for size := 0; size < 32; size++ {
+		if _, err := dec.Decrypt(make([]byte, size)); (size < 16) != (err != nil) {
+			t.Errorf("Unexpected result %d", size)
+			return
+		}
+		if _, err := deciv.Decrypt(make([]byte, size)); err == nil {
+			t.Errorf("Should fail %d", size)
+			return
+		}
+	}
+
+	enc, err := NewAESCBCCTSEncrypter(key, iv, CS3)
+	if err != nil {
+		t.Error("failed to create encrypter")
+		return
+	}
+	if _, err := TryEncrypt(enc, make([]byte, 15)); err == nil {
+		t.Error("Should fail")
+		return
+	}
+	if _, err := TryEncrypt(enc, make([]byte, 16)); err != nil {
+		t.Errorf("Should succeed %s", err.Error())
+		return
+	}
+}
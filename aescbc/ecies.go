@@ -0,0 +1,93 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ECIES key wrapping (KeyWrapECIES) of key.bin:
+// "ephemeral public key + AES-256-GCM(key) + tag(16B)".
+// The ephemeral public key is encoded as crypto/ecdh does (uncompressed point
+// for P-256 and P-384, 32 bytes for X25519). The AES-256-GCM key is derived
+// with HKDF-SHA256 from the ECDH shared secret, with both public keys as
+// info. Every wrapping uses a new ephemeral key, so the nonce is zero.
+
+const eciesInfo = "aescbc ECIES key wrapping"
+
+// WrapKeyECIES wraps key for the owner of pubkey.
+func WrapKeyECIES(rng io.Reader, pubkey *ecdh.PublicKey, key []byte) ([]byte, error) {
+	ephemeral, err := pubkey.Curve().GenerateKey(randReader(rng))
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ephemeral.ECDH(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := eciesAEAD(secret, ephemeral.PublicKey().Bytes(), pubkey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	dst := append([]byte(nil), ephemeral.PublicKey().Bytes()...)
+	return aead.Seal(dst, make([]byte, aead.NonceSize()), key, nil), nil
+}
+
+// UnwrapKeyECIES returns the key wrapped by WrapKeyECIES for prvkey.
+func UnwrapKeyECIES(prvkey *ecdh.PrivateKey, data []byte) ([]byte, error) {
+	pubkey := prvkey.PublicKey().Bytes()
+	if len(data) < len(pubkey) {
+		return nil, fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(data))
+	}
+	ephemeral, err := prvkey.Curve().NewPublicKey(data[:len(pubkey)])
+	if err != nil {
+		return nil, err
+	}
+	secret, err := prvkey.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := eciesAEAD(secret, data[:len(pubkey)], pubkey)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := aead.Open(nil, make([]byte, aead.NonceSize()), data[len(pubkey):], nil); err != nil {
+		return nil, ErrAuthenticationFailed
+	} else {
+		return key, nil
+	}
+}
+
+func eciesAEAD(secret, ephemeral, pubkey []byte) (cipher.AEAD, error) {
+	info := append(append([]byte(eciesInfo), ephemeral...), pubkey...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), key); err != nil {
+		return nil, err
+	}
+	if b, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	} else {
+		return cipher.NewGCM(b)
+	}
+}
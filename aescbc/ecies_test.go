@@ -0,0 +1,187 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWrapKeyECIES_1(t *testing.T) {
+	numOfTrial := 5
+
+	for _, curve := range []ecdh.Curve{ecdh.P256(), ecdh.P384(), ecdh.X25519()} {
+		prvkey, err := curve.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Errorf("%s: failed to generate key %s", curve, err.Error())
+			return
+		}
+		for i := 0; i < numOfTrial; i++ {
+			for _, size := range []int{16, 24, 32} {
+				key := make([]byte, size)
+				rand.Read(key)
+				if data, err := WrapKeyECIES(nil, prvkey.PublicKey(), key); err != nil {
+					t.Errorf("%s: failed to wrap %s", curve, err.Error())
+					return
+				} else if dst, err := UnwrapKeyECIES(prvkey, data); err != nil {
+					t.Errorf("%s: failed to unwrap %s", curve, err.Error())
+					return
+				} else if !bytes.Equal(key, dst) {
+					t.Errorf("%s: key mismatch %x", curve, dst)
+					return
+				}
+			}
+		}
+	}
+}
+
+func TestWrapKeyECIES_ErrorCase(t *testing.T) {
+
+	prvkey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	other, _ := ecdh.P256().GenerateKey(rand.Reader)
+	data, err := WrapKeyECIES(nil, prvkey.PublicKey(), make([]byte, 32))
+	if err != nil {
+		t.Errorf("failed to wrap %s", err.Error())
+		return
+	}
+
+	if _, err := UnwrapKeyECIES(other, data); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("Should fail with ErrAuthenticationFailed")
+		return
+	}
+	for i := 65; i < len(data); i++ {
+		data[i] ^= 0x01
+		if _, err := UnwrapKeyECIES(prvkey, data); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Should fail with ErrAuthenticationFailed %d", i)
+			return
+		}
+		data[i] ^= 0x01
+	}
+	if _, err := UnwrapKeyECIES(prvkey, data[:64]); !errors.Is(err, ErrCiphertextTooShort) {
+		t.Error("Should fail with ErrCiphertextTooShort")
+		return
+	}
+	data[0] = 0x00
+	if _, err := UnwrapKeyECIES(prvkey, data); err == nil {
+		t.Error("Should fail with invalid public key")
+		return
+	}
+}
+
+func TestLoadAesKeyMap_ECIES(t *testing.T) {
+
+	// privkey.pem made by openssl, and by MarshalPrivateKeyPEM
+	prvkeys := []struct {
+		pemfile string
+		passwd  string
+	}{
+		{"ec_p256_scrypt.pem", "password"},
+		{"ec_p384_pbkdf2.pem", "password"},
+		{"ec_p256_sec1.pem", ""},
+		{"x25519.pem", ""},
+		{"", "password"},
+	}
+
+	keydir := t.TempDir()
+	pwd := ""
+	expected := make(map[uint32][]byte)
+	for i, p := range prvkeys {
+		var data []byte
+		if p.pemfile != "" {
+			var err error
+			if data, err = ioutil.ReadFile(filepath.Join("test", "pkcs8", p.pemfile)); err != nil {
+				t.Fatal(err)
+			}
+		} else if prvkey, err := ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+			t.Fatal(err)
+		} else if data, err = MarshalPrivateKeyPEM(nil, prvkey, p.passwd); err != nil {
+			t.Errorf("failed to marshal %s", err.Error())
+			return
+		}
+
+		basedir := filepath.Join(keydir, strconv.Itoa(i))
+		if err := os.Mkdir(basedir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(basedir, PrivkeyFilename), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		prvkey, err := loadPrivateKey(os.DirFS(basedir), PrivkeyFilename, p.passwd)
+		if err != nil {
+			t.Errorf("%d: failed to load %s", i, err.Error())
+			return
+		}
+		eckey, err := ecdhPrivateKey(prvkey)
+		if err != nil {
+			t.Errorf("%d: %s", i, err.Error())
+			return
+		}
+		expected[uint32(i)] = make([]byte, 16)
+		rand.Read(expected[uint32(i)])
+		if data, err := WrapKeyECIES(nil, eckey.PublicKey(), expected[uint32(i)]); err != nil {
+			t.Errorf("%d: failed to wrap %s", i, err.Error())
+			return
+		} else if err := ioutil.WriteFile(filepath.Join(basedir, AeskeyFilename), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		pwd += strconv.Itoa(i) + ": \"" + p.passwd + "\"\n"
+	}
+	if err := ioutil.WriteFile(filepath.Join(keydir, "0", MetaFilename), []byte("wrap: "+KeyWrapECIES+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pwdfile := filepath.Join(keydir, "pwd.yaml")
+	if err := ioutil.WriteFile(pwdfile, []byte(pwd), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keymap, err := LoadAesKeyMap(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to load keys %s", err.Error())
+		return
+	}
+	if len(keymap) != len(expected) {
+		t.Errorf("%d versions loaded", len(keymap))
+		return
+	}
+	for vr, key := range keymap {
+		if !bytes.Equal(expected[vr], key) {
+			t.Errorf("version %d: key %x", vr, key)
+			return
+		}
+	}
+
+	// RSA keys cannot unwrap with ECIES
+	if err := ioutil.WriteFile(filepath.Join(keydir, "pwd.yaml"), []byte("0: password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join("test", "versioned_oaep", "0", PrivkeyFilename)); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(filepath.Join(keydir, "0", PrivkeyFilename), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAesKeyMap(keydir, pwdfile); err == nil {
+		t.Error("Should fail with an RSA key")
+		return
+	}
+}
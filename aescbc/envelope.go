@@ -0,0 +1,219 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Envelope encryption: every message is encrypted with a new data key, which
+// is wrapped with the active key version of a Keyring.
+// The output is "key version (4B) + payload cipher ID (1B) + length of
+// wrapped key (2B) + wrapped key + payload". The wrapped key is
+// "nonce(12B) + AES-GCM(data key) + tag(16B)" with the key of the version,
+// authenticating the first 7 bytes as well. The payload is the output of the
+// payload encrypter, e.g. "IV + ciphertext + tag" of
+// NewAESCBCPKCS7HMACEncrypter.
+
+// DataKeySize is the size of the data keys of envelope encryption (AES-256).
+const DataKeySize = 32
+
+const envelopeHeaderSize = 7
+
+// PayloadCipher is the cipher of the payload of an envelope, whose New makes
+// the encrypter and the decrypter from the data key. Its ID is written in
+// every envelope, and a decrypter fails with ErrSuiteNotAllowed on another
+// one. The IDs are stored in ciphertexts, so they are never reused; those
+// from 0x80 are left to the applications.
+//
+// The encrypter must draw a random IV or nonce for every message: the data
+// key is new for every message only as long as the source of randomness is
+// sound, e.g. not a fixed reader given to WithRand.
+type PayloadCipher struct {
+	ID   uint8
+	Name string
+	New  func(key []byte) (Encrypter, Decrypter, error)
+}
+
+// Payload cipher IDs of the envelopes.
+const (
+	PayloadIDAESCBCPKCS7HMACSHA256 uint8 = 1
+	PayloadIDAESCBCPKCS7           uint8 = 2
+	// PayloadIDAESGCM is the ID of aesgcm.PayloadAESGCM.
+	PayloadIDAESGCM uint8 = 3
+)
+
+var (
+	// PayloadAESCBCPKCS7HMACSHA256 is the HMAC mode of
+	// NewAESCBCPKCS7HMACEncDec.
+	PayloadAESCBCPKCS7HMACSHA256 = PayloadCipher{ID: PayloadIDAESCBCPKCS7HMACSHA256, Name: "AES-CBC-PKCS7-HMAC-SHA256", New: NewAESCBCPKCS7HMACEncDec}
+	// PayloadAESCBCPKCS7 is "IV + ciphertext" of NewAESCBCPKCS7ivEncDec,
+	// which is not authenticated.
+	PayloadAESCBCPKCS7 = PayloadCipher{ID: PayloadIDAESCBCPKCS7, Name: "AES-CBC-PKCS7", New: NewAESCBCPKCS7ivEncDec}
+)
+
+type envelope struct {
+	ring    *Keyring
+	payload PayloadCipher
+	rng     io.Reader
+}
+
+func (x *envelope) ActiveVersion() uint32 {
+	return x.ring.ActiveVersion()
+}
+
+func (x *envelope) SetActiveVersion(version uint32) error {
+	return x.ring.SetActiveVersion(version)
+}
+
+func (x *envelope) Encrypt(src []byte) []byte {
+	return MustEncrypt(x.TryEncrypt(src))
+}
+
+func (x *envelope) TryEncrypt(src []byte) ([]byte, error) {
+
+	datakey := make([]byte, DataKeySize)
+	if _, err := io.ReadFull(randReader(x.rng), datakey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	enc, _, err := x.payload.New(datakey)
+	if err != nil {
+		return nil, err
+	}
+	if x.rng != nil {
+		enc = WithRand(enc, x.rng)
+	}
+
+	header, err := x.wrap(x.ActiveVersion(), datakey)
+	if err != nil {
+		return nil, err
+	}
+	if payload, err := TryEncrypt(enc, src); err != nil {
+		return nil, err
+	} else {
+		return append(header, payload...), nil
+	}
+}
+
+// Reencrypt wraps the data key of src with the active version again, and
+// leaves the payload as it is.
+func (x *envelope) Reencrypt(src []byte) ([]byte, bool, error) {
+	active := x.ActiveVersion()
+	if version, err := CiphertextVersion(src); err != nil {
+		return nil, false, err
+	} else if version == active {
+		return src, false, nil
+	} else if datakey, payload, err := x.unwrap(src); err != nil {
+		return nil, false, err
+	} else if header, err := x.wrap(active, datakey); err != nil {
+		return nil, false, err
+	} else {
+		return append(header, payload...), true, nil
+	}
+}
+
+func (x *envelope) Decrypt(src []byte) ([]byte, error) {
+	if datakey, payload, err := x.unwrap(src); err != nil {
+		return nil, err
+	} else if _, dec, err := x.payload.New(datakey); err != nil {
+		return nil, err
+	} else {
+		return dec.Decrypt(payload)
+	}
+}
+
+// WithRand shares the keyring, and so the active version, with x.
+func (x *envelope) WithRand(rng io.Reader) Encrypter {
+	return &envelope{x.ring, x.payload, rng}
+}
+
+// wrap returns the header of an envelope with datakey.
+func (x *envelope) wrap(version uint32, datakey []byte) ([]byte, error) {
+	aead, err := x.aead(version)
+	if err != nil {
+		return nil, err
+	}
+	const hs = envelopeHeaderSize
+	header := make([]byte, hs+aead.NonceSize(), hs+aead.NonceSize()+len(datakey)+aead.Overhead())
+	binary.BigEndian.PutUint32(header[:4], version)
+	header[4] = x.payload.ID
+	binary.BigEndian.PutUint16(header[5:hs], uint16(cap(header)-hs))
+	nonce := header[hs:]
+	if err := readIV(x.rng, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, nonce, datakey, append([]byte(nil), header[:hs]...)), nil
+}
+
+// unwrap returns the data key and the payload of src, whose payload cipher
+// must be that of x.
+func (x *envelope) unwrap(src []byte) ([]byte, []byte, error) {
+	const hs = envelopeHeaderSize
+	if len(src) < hs {
+		return nil, nil, fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(src))
+	}
+	if src[4] != x.payload.ID {
+		return nil, nil, fmt.Errorf("%w: payload cipher %d instead of %s", ErrSuiteNotAllowed, src[4], x.payload.Name)
+	}
+	version := binary.BigEndian.Uint32(src[:4])
+	size := hs + int(binary.BigEndian.Uint16(src[5:hs]))
+	if len(src) < size {
+		return nil, nil, fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(src))
+	}
+	aead, err := x.aead(version)
+	if err != nil {
+		return nil, nil, err
+	}
+	if size < hs+aead.NonceSize()+aead.Overhead() {
+		return nil, nil, fmt.Errorf("Invalid wrapped key length %d", size-hs)
+	}
+	nonce := src[hs : hs+aead.NonceSize()]
+	if datakey, err := aead.Open(nil, nonce, src[hs+aead.NonceSize():size], src[:hs]); err != nil {
+		return nil, nil, ErrAuthenticationFailed
+	} else {
+		return datakey, src[size:], nil
+	}
+}
+
+func (x *envelope) aead(version uint32) (cipher.AEAD, error) {
+	if b, err := x.ring.Block(version); err != nil {
+		return nil, err
+	} else {
+		return cipher.NewGCM(b)
+	}
+}
+
+// NewEnvelopeEncrypter encrypts every message with a new data key by the
+// encrypter of payload, and wraps the data key with the active version of
+// ring. Deleting the key of a version makes all the messages of the version
+// unreadable (crypto-shredding) on a restart, or on the next reload of a
+// Keyring made with WithDropRemovedVersions unless the version is active.
+func NewEnvelopeEncrypter(ring *Keyring, payload PayloadCipher) VersionedEncrypter {
+	return &envelope{ring: ring, payload: payload}
+}
+
+func NewEnvelopeDecrypter(ring *Keyring, payload PayloadCipher) Decrypter {
+	return &envelope{ring: ring, payload: payload}
+}
+
+func NewEnvelopeEncDec(ring *Keyring, payload PayloadCipher) (VersionedEncrypter, Decrypter) {
+	x := &envelope{ring: ring, payload: payload}
+	return x, x
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func newEnvelopeTestKeyring(t *testing.T, versions ...uint32) *Keyring {
+	keys := make(map[uint32][]byte)
+	for _, vr := range versions {
+		keys[vr] = make([]byte, 32)
+		rand.Read(keys[vr])
+	}
+	ring, err := NewKeyringWithKeyStore(NewMemKeyStore(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+func TestEnvelope_1(t *testing.T) {
+
+	ring := newEnvelopeTestKeyring(t, 0, 1)
+	payloads := map[string]PayloadCipher{
+		"iv":   PayloadAESCBCPKCS7,
+		"hmac": PayloadAESCBCPKCS7HMACSHA256,
+		"cts": {ID: 0x80, Name: "AES-CBC-CTS3", New: func(key []byte) (Encrypter, Decrypter, error) {
+			return NewAESCBCCTSivEncDec(key, CS3)
+		}},
+	}
+	for name, payload := range payloads {
+		enc, dec := NewEnvelopeEncDec(ring, payload)
+		for size := 16; size <= 64; size++ {
+			if !encdeccompare(t, size, enc, dec) {
+				t.Errorf("%s: size %d", name, size)
+				return
+			}
+		}
+
+		src := []byte("0123456789abcdef")
+		c1 := enc.Encrypt(src)
+		c2 := enc.Encrypt(src)
+		if version, err := CiphertextVersion(c1); err != nil || version != 1 {
+			t.Errorf("%s: version %d", name, version)
+			return
+		}
+		if bytes.Equal(c1, c2) {
+			t.Errorf("%s: same ciphertext for a new data key", name)
+			return
+		}
+		if dst, err := NewEnvelopeDecrypter(ring, payload).Decrypt(c2); err != nil || !bytes.Equal(dst, src) {
+			t.Errorf("%s: failed to decrypt", name)
+			return
+		}
+	}
+}
+
+func TestEnvelope_Reencrypt(t *testing.T) {
+
+	ring := newEnvelopeTestKeyring(t, 0, 1)
+	enc, dec := NewEnvelopeEncDec(ring, PayloadAESCBCPKCS7HMACSHA256)
+	if err := enc.SetActiveVersion(0); err != nil {
+		t.Fatal(err)
+	}
+	src := []byte("0123456789")
+	c0 := enc.Encrypt(src)
+	if err := enc.SetActiveVersion(1); err != nil {
+		t.Fatal(err)
+	}
+
+	c1, ok, err := enc.Reencrypt(c0)
+	if err != nil || !ok {
+		t.Errorf("failed to reencrypt %v", err)
+		return
+	}
+	if version, _ := CiphertextVersion(c1); version != 1 {
+		t.Errorf("version %d", version)
+		return
+	}
+	size := 7 + int(binary.BigEndian.Uint16(c0[5:7]))
+	if !bytes.Equal(c0[size:], c1[size:]) {
+		t.Error("payload should be kept")
+		return
+	}
+	if dst, err := dec.Decrypt(c1); err != nil || !bytes.Equal(dst, src) {
+		t.Error("failed to decrypt")
+		return
+	}
+	if c2, ok, err := enc.Reencrypt(c1); err != nil || ok || !bytes.Equal(c1, c2) {
+		t.Error("Should keep the active version")
+		return
+	}
+}
+
+func TestEnvelope_ErrorCase(t *testing.T) {
+
+	ring := newEnvelopeTestKeyring(t, 0, 1)
+	enc, dec := NewEnvelopeEncDec(ring, PayloadAESCBCPKCS7HMACSHA256)
+	c := enc.Encrypt([]byte("0123456789"))
+	size := 7 + int(binary.BigEndian.Uint16(c[5:7]))
+
+	for _, n := range []int{0, 6, 7, size - 1} {
+		if _, err := dec.Decrypt(c[:n]); !errors.Is(err, ErrCiphertextTooShort) {
+			t.Errorf("Should fail with ErrCiphertextTooShort %d", n)
+			return
+		}
+	}
+	for i := 0; i < len(c); i++ {
+		if i < 4 {
+			continue
+		}
+		c[i] ^= 0x01
+		if _, err := dec.Decrypt(c); err == nil {
+			t.Errorf("Should fail with a tampered byte %d", i)
+			return
+		} else if i == 4 && !errors.Is(err, ErrSuiteNotAllowed) {
+			t.Errorf("Should fail with ErrSuiteNotAllowed %d", i)
+			return
+		} else if i >= 7 && !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Should fail with ErrAuthenticationFailed %d", i)
+			return
+		}
+		c[i] ^= 0x01
+	}
+
+	// crypto-shredding: without the version the data key is lost
+	if _, err := NewEnvelopeDecrypter(newEnvelopeTestKeyring(t, 0), PayloadAESCBCPKCS7HMACSHA256).Decrypt(c); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Error("Should fail with ErrUnknownKeyVersion")
+		return
+	}
+	if _, err := NewEnvelopeDecrypter(newEnvelopeTestKeyring(t, 0, 1), PayloadAESCBCPKCS7HMACSHA256).Decrypt(c); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("Should fail with ErrAuthenticationFailed")
+		return
+	}
+
+	// the payload cipher is bound to the envelope, so that its ID cannot
+	// be changed either
+	if _, err := NewEnvelopeDecrypter(ring, PayloadAESCBCPKCS7).Decrypt(c); !errors.Is(err, ErrSuiteNotAllowed) {
+		t.Error("Should fail with ErrSuiteNotAllowed")
+		return
+	}
+	tampered := append([]byte(nil), c...)
+	tampered[4] = PayloadIDAESCBCPKCS7
+	if _, err := NewEnvelopeDecrypter(ring, PayloadAESCBCPKCS7).Decrypt(tampered); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("Should fail with ErrAuthenticationFailed")
+		return
+	}
+
+	failing := PayloadCipher{ID: PayloadIDAESCBCPKCS7HMACSHA256, Name: "failing", New: func(key []byte) (Encrypter, Decrypter, error) {
+		return NewAESCBCPKCS7ivEncDec(key[:20])
+	}}
+	if _, err := TryEncrypt(NewEnvelopeEncrypter(ring, failing), []byte("0123456789")); err == nil {
+		t.Error("Should fail with the payload cipher")
+		return
+	}
+	if _, err := NewEnvelopeDecrypter(ring, failing).Decrypt(c); err == nil {
+		t.Error("Should fail with the payload cipher")
+		return
+	}
+	if _, err := TryEncrypt(WithRand(enc, bytes.NewReader(make([]byte, 40))), []byte("0123456789")); err == nil {
+		t.Error("Should fail without randomness")
+		return
+	}
+}
@@ -0,0 +1,34 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"errors"
+)
+
+// Errors returned by Decrypt. They may be wrapped with details, so compare
+// them with errors.Is.
+var (
+	ErrCiphertextTooShort   = errors.New("Ciphertext too short")
+	ErrNotBlockAligned      = errors.New("Ciphertext not a multiple of the block size")
+	ErrUnknownKeyVersion    = errors.New("Unknown key version")
+	ErrInvalidPadding       = errors.New("Invalid padding")
+	ErrAuthenticationFailed = errors.New("Message authentication failed")
+	ErrUnknownSuite         = errors.New("Unknown algorithm suite")
+	ErrSuiteNotAllowed      = errors.New("Algorithm suite not allowed")
+	ErrKDFLimitExceeded     = errors.New("KDF parameters exceed the limits")
+)
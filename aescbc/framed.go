@@ -0,0 +1,542 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Framed format: "magic(4B) + format version(1B) + suite ID(2B) + flags(1B)
+// + key ID length(1B) + key ID + payload", all big-endian. The magic is
+// 0x89 'G' 'C' 'E', and the format version 1. The suite ID selects the
+// algorithms of the payload from the registered suites, and the key ID of
+// the versioned encrypters is the 4-byte key version.
+//
+// With FlagAuthenticatedHeader, set for the authenticated suites, the payload
+// is "nonce + AEAD(plaintext) + tag" and the whole header is authenticated as
+// the associated data, so that a modified header fails the authentication.
+//
+// The payload is encrypted with the key of the suite, derived from the key
+// of the version with HKDF-SHA256 and the info "gocrypto-framed\x00" + suite
+// ID, so that no two suites share a key.
+//
+// A ciphertext of the 4-byte version header of the versioned encrypters is
+// told apart by the magic, which is never a key version in practice.
+
+var framedMagic = []byte{0x89, 'G', 'C', 'E'}
+
+const (
+	framedFormatVersion = 1
+	framedHeaderSize    = 9
+)
+
+// Flags of the framed header.
+const (
+	FlagAuthenticatedHeader uint8 = 0x01
+)
+
+// Algorithm suites of the framed format. The IDs are stored in ciphertexts,
+// so they are never reused.
+const (
+	// SuiteAESCBCPKCS7 is AES-CBC with PKCS#7 padding: "IV + ciphertext",
+	// the payload of NewAESCBCPKCS7ivVerEncrypter.
+	SuiteAESCBCPKCS7 uint16 = 1
+	// SuiteAESGCM is AES-GCM: "nonce(12B) + ciphertext + tag(16B)", the
+	// payload of aesgcm.NewAESGCMVerEncrypter. It is registered by package
+	// aesgcm.
+	SuiteAESGCM uint16 = 2
+	// SuiteAESCBCCTS3 is AES-CBC with ciphertext stealing CS3:
+	// "IV + ciphertext".
+	SuiteAESCBCCTS3 uint16 = 3
+	// SuiteAESCBCPKCS7HMACSHA256 is the HMAC mode of
+	// NewAESCBCPKCS7HMACEncrypter: "IV + ciphertext + HMAC-SHA256 tag", with
+	// the header authenticated as the associated data.
+	SuiteAESCBCPKCS7HMACSHA256 uint16 = 4
+)
+
+// Suite is an algorithm suite of the framed format. New makes the encrypter
+// and the decrypter of the payload with the key of the suite, where the
+// encrypter reads IVs from rng (crypto/rand if nil). NewAEAD, if any, makes
+// the suite authenticated: the framed encrypters then seal the payload with
+// it and authenticate the header as well. NewAEADWithKey does the same for
+// the suites which need the key itself rather than its AES cipher, and New
+// may then be nil. The 4-byte version header of the versioned encrypters is
+// read with the key of the version itself.
+type Suite struct {
+	ID             uint16
+	Name           string
+	New            func(b cipher.Block, rng io.Reader) (Encrypter, Decrypter, error)
+	NewAEAD        func(b cipher.Block) (cipher.AEAD, error)
+	NewAEADWithKey func(key []byte) (cipher.AEAD, error)
+}
+
+func (s Suite) authenticated() bool {
+	return s.NewAEAD != nil || s.NewAEADWithKey != nil
+}
+
+// suiteKey derives the key of the suite from the key of version.
+func (s Suite) suiteKey(ring *Keyring, version uint32) ([]byte, error) {
+	key, err := ring.key(version)
+	if err != nil {
+		return nil, err
+	}
+	info := binary.BigEndian.AppendUint16([]byte("gocrypto-framed\x00"), s.ID)
+	dst := make([]byte, len(key))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, info), dst); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// aead makes the AEAD of an authenticated suite with key.
+func (s Suite) aead(key []byte) (cipher.AEAD, error) {
+	if s.NewAEADWithKey != nil {
+		return s.NewAEADWithKey(key)
+	}
+	if b, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	} else {
+		return s.NewAEAD(b)
+	}
+}
+
+// newCipher makes the encrypter and the decrypter of a suite which is not
+// authenticated with key.
+func (s Suite) newCipher(key []byte, rng io.Reader) (Encrypter, Decrypter, error) {
+	if b, err := aes.NewCipher(key); err != nil {
+		return nil, nil, err
+	} else {
+		return s.New(b, rng)
+	}
+}
+
+// allowsSuite tells whether id is one of allowed.
+func allowsSuite(allowed []uint16, id uint16) bool {
+	for _, a := range allowed {
+		if a == id {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySuites fails unless every suite of ids is registered, and with
+// authenticated set also authenticated.
+func verifySuites(ids []uint16, authenticated bool) error {
+	for _, id := range ids {
+		if s, err := LookupSuite(id); err != nil {
+			return err
+		} else if authenticated && !s.authenticated() {
+			return fmt.Errorf("%w: %s is not authenticated", ErrSuiteNotAllowed, s.Name)
+		}
+	}
+	return nil
+}
+
+var suites = struct {
+	sync.RWMutex
+	m map[uint16]Suite
+}{m: make(map[uint16]Suite)}
+
+// RegisterSuite makes s available to the framed encrypters and decrypters.
+// It panics if the ID is zero or already registered, and is meant to be
+// called from init.
+func RegisterSuite(s Suite) {
+	suites.Lock()
+	defer suites.Unlock()
+	if s.ID == 0 || s.New == nil && !s.authenticated() {
+		panic("aescbc: invalid suite " + s.Name)
+	}
+	if _, ok := suites.m[s.ID]; ok {
+		panic(fmt.Sprintf("aescbc: suite %d registered twice", s.ID))
+	}
+	suites.m[s.ID] = s
+}
+
+// LookupSuite returns the registered suite of id.
+func LookupSuite(id uint16) (Suite, error) {
+	suites.RLock()
+	defer suites.RUnlock()
+	if s, ok := suites.m[id]; !ok {
+		return Suite{}, fmt.Errorf("%w: %d", ErrUnknownSuite, id)
+	} else {
+		return s, nil
+	}
+}
+
+func init() {
+	RegisterSuite(Suite{
+		ID:   SuiteAESCBCPKCS7,
+		Name: "AES-CBC-PKCS7",
+		New: func(b cipher.Block, rng io.Reader) (Encrypter, Decrypter, error) {
+			x := &cbciv{b, PKCS7Padding, rng}
+			return x, x, nil
+		},
+	})
+	RegisterSuite(Suite{
+		ID:   SuiteAESCBCCTS3,
+		Name: "AES-CBC-CTS3",
+		New: func(b cipher.Block, rng io.Reader) (Encrypter, Decrypter, error) {
+			x := &cbcctsiv{b, CS3, rng}
+			return x, x, nil
+		},
+	})
+	RegisterSuite(Suite{
+		ID:             SuiteAESCBCPKCS7HMACSHA256,
+		Name:           "AES-CBC-PKCS7-HMAC-SHA256",
+		NewAEADWithKey: newHMACAEAD,
+	})
+}
+
+// Header is the header of a framed ciphertext.
+type Header struct {
+	Suite uint16
+	Flags uint8
+	KeyID []byte
+}
+
+// IsFramed tells whether src starts with the magic of the framed format.
+func IsFramed(src []byte) bool {
+	return bytes.HasPrefix(src, framedMagic)
+}
+
+// ParseHeader returns the header of a framed ciphertext and the payload
+// following it.
+func ParseHeader(src []byte) (*Header, []byte, error) {
+	if !IsFramed(src) {
+		return nil, nil, fmt.Errorf("No framed format magic")
+	}
+	if len(src) < framedHeaderSize {
+		return nil, nil, fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(src))
+	}
+	if src[4] != framedFormatVersion {
+		return nil, nil, fmt.Errorf("Unsupported framed format version %d", src[4])
+	}
+	h := &Header{
+		Suite: binary.BigEndian.Uint16(src[5:7]),
+		Flags: src[7],
+	}
+	if h.Flags&^FlagAuthenticatedHeader != 0 {
+		return nil, nil, fmt.Errorf("Unknown flags %#x", h.Flags)
+	}
+	size := framedHeaderSize + int(src[8])
+	if len(src) < size {
+		return nil, nil, fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(src))
+	}
+	h.KeyID = src[framedHeaderSize:size]
+	return h, src[size:], nil
+}
+
+// Marshal appends the encoded header to dst.
+func (h *Header) Marshal(dst []byte) ([]byte, error) {
+	if len(h.KeyID) > 255 {
+		return nil, fmt.Errorf("Invalid key ID length %d", len(h.KeyID))
+	}
+	dst = append(dst, framedMagic...)
+	dst = append(dst, framedFormatVersion)
+	dst = binary.BigEndian.AppendUint16(dst, h.Suite)
+	dst = append(dst, h.Flags, byte(len(h.KeyID)))
+	return append(dst, h.KeyID...), nil
+}
+
+// KeyVersion returns the key version of the key ID of the versioned
+// encrypters.
+func (h *Header) KeyVersion() (uint32, error) {
+	if len(h.KeyID) != 4 {
+		return 0, fmt.Errorf("%w: key ID %x", ErrUnknownKeyVersion, h.KeyID)
+	}
+	return binary.BigEndian.Uint32(h.KeyID), nil
+}
+
+// framed writes the framed format with the keys of a Keyring, and reads the
+// suites of allowed only.
+type framed struct {
+	ring    *Keyring
+	suite   Suite
+	rng     io.Reader
+	allowed []uint16
+}
+
+func (x *framed) ActiveVersion() uint32 {
+	return x.ring.ActiveVersion()
+}
+
+func (x *framed) SetActiveVersion(version uint32) error {
+	return x.ring.SetActiveVersion(version)
+}
+
+func (x *framed) Encrypt(src []byte) []byte {
+	return MustEncrypt(x.TryEncrypt(src))
+}
+
+func (x *framed) TryEncrypt(src []byte) ([]byte, error) {
+	return x.encrypt(x.ActiveVersion(), src, nil)
+}
+
+// EncryptWithAAD fails unless the suite of x is authenticated.
+func (x *framed) EncryptWithAAD(src, aad []byte) ([]byte, error) {
+	return x.encrypt(x.ActiveVersion(), src, aad)
+}
+
+// Reencrypt also migrates the ciphertexts of the other suites and of the
+// 4-byte version header to the suite of x.
+func (x *framed) Reencrypt(src []byte) ([]byte, bool, error) {
+	return x.ReencryptWithAAD(src, nil)
+}
+
+// ReencryptWithAAD is Reencrypt of a ciphertext bound to aad.
+func (x *framed) ReencryptWithAAD(src, aad []byte) ([]byte, bool, error) {
+	active := x.ActiveVersion()
+	if h, _, err := ParseHeader(src); err == nil && h.Suite == x.suite.ID && h.Flags == x.flags() {
+		if version, err := h.KeyVersion(); err == nil && version == active {
+			return src, false, nil
+		}
+	}
+	if plain, err := x.DecryptWithAAD(src, aad); err != nil {
+		return nil, false, err
+	} else if dst, err := x.encrypt(active, plain, aad); err != nil {
+		return nil, false, err
+	} else {
+		return dst, true, nil
+	}
+}
+
+func (x *framed) flags() uint8 {
+	if x.suite.authenticated() {
+		return FlagAuthenticatedHeader
+	}
+	return 0
+}
+
+// encrypt authenticates the header and aad as the associated data of the
+// authenticated suites.
+func (x *framed) encrypt(version uint32, src, aad []byte) ([]byte, error) {
+	if !x.suite.authenticated() && len(aad) > 0 {
+		return nil, fmt.Errorf("Suite %s is not authenticated", x.suite.Name)
+	}
+	keyID := binary.BigEndian.AppendUint32(nil, version)
+	dst, err := (&Header{Suite: x.suite.ID, Flags: x.flags(), KeyID: keyID}).Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x.suite.suiteKey(x.ring, version)
+	if err != nil {
+		return nil, err
+	}
+	if x.suite.authenticated() {
+		aead, err := x.suite.aead(key)
+		if err != nil {
+			return nil, err
+		}
+		header := len(dst)
+		dst = append(dst, make([]byte, aead.NonceSize())...)
+		nonce := dst[header:]
+		if err := readIV(x.rng, nonce); err != nil {
+			return nil, err
+		}
+		return aead.Seal(dst, nonce, src, append(append([]byte(nil), dst[:header]...), aad...)), nil
+	}
+
+	enc, _, err := x.suite.newCipher(key, x.rng)
+	if err != nil {
+		return nil, err
+	}
+	if payload, err := TryEncrypt(enc, src); err != nil {
+		return nil, err
+	} else {
+		return append(dst, payload...), nil
+	}
+}
+
+// WithRand shares the keyring, and so the active version, with x.
+func (x *framed) WithRand(rng io.Reader) Encrypter {
+	return &framed{x.ring, x.suite, rng, x.allowed}
+}
+
+func (x *framed) Decrypt(src []byte) ([]byte, error) {
+	return x.DecryptWithAAD(src, nil)
+}
+
+func (x *framed) DecryptWithAAD(src, aad []byte) ([]byte, error) {
+	if IsFramed(src) || x.suite.New == nil {
+		return decryptFramed(x.ring, src, aad, x.allowed)
+	}
+	version, err := CiphertextVersion(src)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x.ring.key(version)
+	if err != nil {
+		return nil, err
+	}
+
+	// the 4-byte version header is the associated data of the authenticated
+	// suites.
+	if x.suite.authenticated() {
+		if aead, err := x.suite.aead(key); err != nil {
+			return nil, err
+		} else {
+			return openAEAD(aead, src[4:], append(src[:4:4], aad...))
+		}
+	}
+
+	if len(aad) > 0 {
+		return nil, fmt.Errorf("Suite %s is not authenticated", x.suite.Name)
+	}
+	if _, dec, err := x.suite.newCipher(key, nil); err != nil {
+		return nil, err
+	} else {
+		return dec.Decrypt(src[4:])
+	}
+}
+
+// openAEAD opens "nonce + ciphertext + tag".
+func openAEAD(aead cipher.AEAD, src, aad []byte) ([]byte, error) {
+	ns := aead.NonceSize()
+	if len(src) < ns+aead.Overhead() {
+		return nil, fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(src))
+	}
+	if dst, err := aead.Open(nil, src[:ns], src[ns:], aad); err != nil {
+		return nil, ErrAuthenticationFailed
+	} else {
+		return dst, nil
+	}
+}
+
+// reencryptFramed migrates a framed ciphertext to the active version of ring
+// with the suite of src, which must be one of allowed.
+func reencryptFramed(ring *Keyring, rng io.Reader, src, aad []byte, allowed []uint16) ([]byte, bool, error) {
+	if h, _, err := ParseHeader(src); err != nil {
+		return nil, false, err
+	} else if !allowsSuite(allowed, h.Suite) {
+		return nil, false, fmt.Errorf("%w: %d", ErrSuiteNotAllowed, h.Suite)
+	} else if s, err := LookupSuite(h.Suite); err != nil {
+		return nil, false, err
+	} else {
+		return (&framed{ring, s, rng, []uint16{h.Suite}}).ReencryptWithAAD(src, aad)
+	}
+}
+
+// decryptFramed checks the suite of src against allowed before any key is
+// used, so that the header cannot select a weaker suite than the decrypter
+// is meant for.
+func decryptFramed(ring *Keyring, src, aad []byte, allowed []uint16) ([]byte, error) {
+	h, payload, err := ParseHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	if !allowsSuite(allowed, h.Suite) {
+		return nil, fmt.Errorf("%w: %d", ErrSuiteNotAllowed, h.Suite)
+	}
+	s, err := LookupSuite(h.Suite)
+	if err != nil {
+		return nil, err
+	}
+	authenticated := h.Flags&FlagAuthenticatedHeader != 0
+	if s.authenticated() && !authenticated {
+		return nil, fmt.Errorf("%w: suite %s without the authenticated header", ErrAuthenticationFailed, s.Name)
+	} else if !s.authenticated() && authenticated {
+		return nil, fmt.Errorf("Suite %s is not authenticated", s.Name)
+	} else if !authenticated && len(aad) > 0 {
+		return nil, fmt.Errorf("Suite %s is not authenticated", s.Name)
+	}
+	version, err := h.KeyVersion()
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.suiteKey(ring, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if authenticated {
+		header := len(src) - len(payload)
+		if aead, err := s.aead(key); err != nil {
+			return nil, err
+		} else {
+			return openAEAD(aead, payload, append(src[:header:header], aad...))
+		}
+	}
+	if _, dec, err := s.newCipher(key, nil); err != nil {
+		return nil, err
+	} else {
+		return dec.Decrypt(payload)
+	}
+}
+
+// NewFramedEncrypter writes the framed format with the suite of ID suite
+// and the active version of ring. The suite must be registered, e.g.
+// SuiteAESGCM by importing package aesgcm. Reencrypt migrates the
+// ciphertexts of suite and of the accepted suites, which must be
+// authenticated if suite is.
+func NewFramedEncrypter(ring *Keyring, suite uint16, accepted ...uint16) (VersionedEncrypter, error) {
+	if x, err := newFramed(ring, suite, accepted); err != nil {
+		return nil, err
+	} else {
+		return x, nil
+	}
+}
+
+// NewFramedDecrypter reads the framed format of the given suites only, so
+// that the header of a ciphertext cannot select another one. The versioned
+// decrypters, e.g. NewAESCBCPKCS7ivVerDecrypterWithKeyring, read it as well
+// as their 4-byte version header.
+//
+// The framed encrypters and decrypters are AEADEncrypter and AEADDecrypter,
+// whose associated data is authenticated with the authenticated suites only.
+func NewFramedDecrypter(ring *Keyring, suites ...uint16) (Decrypter, error) {
+	if len(suites) == 0 {
+		return nil, fmt.Errorf("No algorithm suite allowed")
+	} else if err := verifySuites(suites, false); err != nil {
+		return nil, err
+	} else {
+		return &framed{ring: ring, allowed: append([]uint16(nil), suites...)}, nil
+	}
+}
+
+// NewFramedEncDec returns a decrypter which reads suite and the accepted
+// suites, as NewFramedEncrypter, and also the 4-byte version header with the
+// payload of suite.
+func NewFramedEncDec(ring *Keyring, suite uint16, accepted ...uint16) (VersionedEncrypter, Decrypter, error) {
+	if x, err := newFramed(ring, suite, accepted); err != nil {
+		return nil, nil, err
+	} else {
+		return x, x, nil
+	}
+}
+
+// newFramed rejects accepted suites weaker than suite before any key is used.
+func newFramed(ring *Keyring, suite uint16, accepted []uint16) (*framed, error) {
+	s, err := LookupSuite(suite)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySuites(accepted, s.authenticated()); err != nil {
+		return nil, err
+	}
+	return &framed{ring: ring, suite: s, allowed: append([]uint16{suite}, accepted...)}, nil
+}
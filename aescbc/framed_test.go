@@ -0,0 +1,395 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestHeader_1(t *testing.T) {
+
+	h := &Header{Suite: SuiteAESCBCPKCS7, KeyID: []byte{0, 0, 0, 1}}
+	data, err := h.Marshal([]byte{0xff})
+	if err != nil {
+		t.Errorf("failed to marshal %s", err.Error())
+		return
+	}
+	if hex.EncodeToString(data) != "ff89474345010001000400000001" {
+		t.Errorf("header %x", data)
+		return
+	}
+
+	data = append(data[1:], "payload"...)
+	if !IsFramed(data) {
+		t.Error("Should be framed")
+		return
+	}
+	if h2, payload, err := ParseHeader(data); err != nil {
+		t.Errorf("failed to parse %s", err.Error())
+		return
+	} else if h2.Suite != h.Suite || h2.Flags != 0 || !bytes.Equal(h2.KeyID, h.KeyID) || string(payload) != "payload" {
+		t.Errorf("header %v, payload %q", h2, payload)
+		return
+	} else if version, err := h2.KeyVersion(); err != nil || version != 1 {
+		t.Errorf("key version %d", version)
+		return
+	}
+
+	// key ID of variable length
+	h = &Header{Suite: 0xabcd, KeyID: bytes.Repeat([]byte{'k'}, 255)}
+	if data, err := h.Marshal(nil); err != nil {
+		t.Errorf("failed to marshal %s", err.Error())
+		return
+	} else if h2, payload, err := ParseHeader(data); err != nil || h2.Suite != 0xabcd || !bytes.Equal(h2.KeyID, h.KeyID) || len(payload) != 0 {
+		t.Error("failed to parse")
+		return
+	} else if _, err := h2.KeyVersion(); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Error("Should fail with ErrUnknownKeyVersion")
+		return
+	}
+}
+
+func TestFramed_1(t *testing.T) {
+
+	ring := newEnvelopeTestKeyring(t, 0, 1)
+	for _, suite := range []uint16{SuiteAESCBCPKCS7, SuiteAESCBCCTS3} {
+		enc, dec, err := NewFramedEncDec(ring, suite)
+		if err != nil {
+			t.Errorf("%d: failed to create encrypter/decrypter %s", suite, err.Error())
+			return
+		}
+		for size := 16; size <= 64; size++ {
+			if !encdeccompare(t, size, enc, dec) {
+				t.Errorf("%d: size %d", suite, size)
+				return
+			}
+		}
+
+		src := []byte("0123456789abcdef0123")
+		c := enc.Encrypt(src)
+		if h, _, err := ParseHeader(c); err != nil || h.Suite != suite {
+			t.Errorf("%d: header %v", suite, h)
+			return
+		}
+		if version, err := CiphertextVersion(c); err != nil || version != 1 {
+			t.Errorf("%d: version %d", suite, version)
+			return
+		}
+		framedDec, err := NewFramedDecrypter(ring, suite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range []Decrypter{framedDec, NewAESCBCPKCS7ivVerDecrypterWithKeyring(ring)} {
+			if dst, err := d.Decrypt(c); err != nil || !bytes.Equal(dst, src) {
+				t.Errorf("%d: failed to decrypt %v", suite, err)
+				return
+			}
+		}
+	}
+}
+
+func TestFramed_Legacy(t *testing.T) {
+
+	ring := newEnvelopeTestKeyring(t, 0, 1)
+	legacy := NewAESCBCPKCS7ivVerEncrypterWithKeyring(ring)
+	enc, dec, err := NewFramedEncDec(ring, SuiteAESCBCPKCS7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := []byte("0123456789abcdef0123")
+	c0 := legacy.Encrypt(src)
+	if IsFramed(c0) {
+		t.Error("Should not be framed")
+		return
+	}
+	if dst, err := dec.Decrypt(c0); err != nil || !bytes.Equal(dst, src) {
+		t.Errorf("failed to decrypt %v", err)
+		return
+	}
+	if framedDec, err := NewFramedDecrypter(ring, SuiteAESCBCPKCS7); err != nil {
+		t.Fatal(err)
+	} else if _, err := framedDec.Decrypt(c0); err == nil {
+		t.Error("Should fail without framed format")
+		return
+	}
+
+	// migrate the 4-byte version header to the framed format
+	c1, ok, err := enc.Reencrypt(c0)
+	if err != nil || !ok || !IsFramed(c1) {
+		t.Errorf("failed to reencrypt %v", err)
+		return
+	}
+	if dst, err := dec.Decrypt(c1); err != nil || !bytes.Equal(dst, src) {
+		t.Errorf("failed to decrypt %v", err)
+		return
+	}
+	if c2, ok, err := enc.Reencrypt(c1); err != nil || ok || !bytes.Equal(c1, c2) {
+		t.Error("Should keep the framed ciphertext")
+		return
+	}
+	if c2, ok, err := legacy.Reencrypt(c1); err != nil || ok || !bytes.Equal(c1, c2) {
+		t.Error("Should keep the framed ciphertext of the active version")
+		return
+	}
+
+	// to another suite, which must be accepted
+	if cts, err := NewFramedEncrypter(ring, SuiteAESCBCCTS3); err != nil {
+		t.Fatal(err)
+	} else if _, _, err := cts.Reencrypt(c1); !errors.Is(err, ErrSuiteNotAllowed) {
+		t.Errorf("Should fail with ErrSuiteNotAllowed %v", err)
+		return
+	}
+	cts, _, err := NewFramedEncDec(ring, SuiteAESCBCCTS3, SuiteAESCBCPKCS7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2, ok, err := cts.Reencrypt(c1); err != nil || !ok {
+		t.Errorf("failed to reencrypt %v", err)
+		return
+	} else if h, _, _ := ParseHeader(c2); h.Suite != SuiteAESCBCCTS3 {
+		t.Errorf("suite %d", h.Suite)
+		return
+	}
+
+	// the versioned encrypter keeps the framed format and its suite
+	if err := cts.SetActiveVersion(0); err != nil {
+		t.Fatal(err)
+	}
+	c3 := cts.Encrypt(src)
+	if err := legacy.SetActiveVersion(1); err != nil {
+		t.Fatal(err)
+	}
+	if c4, ok, err := legacy.Reencrypt(c3); err != nil || !ok {
+		t.Errorf("failed to reencrypt %v", err)
+		return
+	} else if h, _, err := ParseHeader(c4); err != nil || h.Suite != SuiteAESCBCCTS3 {
+		t.Errorf("Should keep the suite %v", h)
+		return
+	} else if version, _ := CiphertextVersion(c4); version != 1 {
+		t.Errorf("version %d", version)
+		return
+	} else if dst, err := NewAESCBCPKCS7ivVerDecrypterWithKeyring(ring).Decrypt(c4); err != nil || !bytes.Equal(dst, src) {
+		t.Errorf("failed to decrypt %v", err)
+		return
+	} else if _, err := dec.Decrypt(c4); !errors.Is(err, ErrSuiteNotAllowed) {
+		t.Errorf("Should fail with ErrSuiteNotAllowed %v", err)
+		return
+	}
+}
+
+func TestFramed_HMAC(t *testing.T) {
+
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	ring, err := NewKeyringWithKeyStore(NewMemKeyStore(map[uint32][]byte{0: make([]byte, 32), 1: key}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, dec, err := NewFramedEncDec(ring, SuiteAESCBCPKCS7HMACSHA256)
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+	for size := 0; size <= 64; size++ {
+		if !encdeccompare(t, size, enc, dec) {
+			t.Errorf("size %d", size)
+			return
+		}
+	}
+
+	// the payload is that of the HMAC mode with the key of the suite and the
+	// header as associated data
+	src := []byte("0123456789abcdef0123")
+	c := enc.Encrypt(src)
+	h, payload, err := ParseHeader(c)
+	if err != nil || h.Suite != SuiteAESCBCPKCS7HMACSHA256 || h.Flags != FlagAuthenticatedHeader {
+		t.Errorf("header %v", h)
+		return
+	}
+	s, err := LookupSuite(SuiteAESCBCPKCS7HMACSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suiteKey, err := s.suiteKey(ring, 1)
+	if err != nil || bytes.Equal(suiteKey, key) {
+		t.Errorf("Should derive the key of the suite %v", err)
+		return
+	}
+	if _, err := NewAESCBCPKCS7HMACDecrypter(key); err != nil {
+		t.Fatal(err)
+	} else if hmacdec, err := NewAESCBCPKCS7HMACDecrypter(suiteKey); err != nil {
+		t.Fatal(err)
+	} else if dst, err := hmacdec.(AEADDecrypter).DecryptWithAAD(payload, c[:len(c)-len(payload)]); err != nil || !bytes.Equal(dst, src) {
+		t.Errorf("failed to decrypt the payload %v", err)
+		return
+	}
+	framedDec, err := NewFramedDecrypter(ring, SuiteAESCBCPKCS7HMACSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []Decrypter{framedDec, NewAESCBCPKCS7ivVerDecrypterWithKeyring(ring)} {
+		if dst, err := d.Decrypt(c); err != nil || !bytes.Equal(dst, src) {
+			t.Errorf("failed to decrypt %v", err)
+			return
+		}
+	}
+
+	// the header is authenticated
+	for _, tc := range []struct {
+		index int
+		value byte
+	}{
+		{7, 0},                           // flags
+		{12, 0},                          // key version
+		{len(c) - 1, c[len(c)-1] ^ 0x01}, // tag
+	} {
+		tampered := append([]byte(nil), c...)
+		tampered[tc.index] = tc.value
+		if _, err := dec.Decrypt(tampered); err == nil || tc.index != 7 && !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Should fail with byte %d: %v", tc.index, err)
+			return
+		}
+	}
+
+	// associated data
+	c, err = enc.(AEADEncrypter).EncryptWithAAD(src, []byte("users/1/email"))
+	if err != nil {
+		t.Errorf("failed to encrypt %s", err.Error())
+		return
+	}
+	if dst, err := dec.(AEADDecrypter).DecryptWithAAD(c, []byte("users/1/email")); err != nil || !bytes.Equal(dst, src) {
+		t.Errorf("failed to decrypt %v", err)
+		return
+	}
+	if _, err := dec.(AEADDecrypter).DecryptWithAAD(c, []byte("users/2/email")); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("Should fail with ErrAuthenticationFailed")
+		return
+	}
+
+	// reencrypted with the same suite
+	if err := enc.SetActiveVersion(0); err != nil {
+		t.Fatal(err)
+	}
+	c = enc.Encrypt(src)
+	if err := enc.SetActiveVersion(1); err != nil {
+		t.Fatal(err)
+	}
+	legacy := NewAESCBCPKCS7ivVerEncrypterWithKeyring(ring)
+	if c2, ok, err := legacy.Reencrypt(c); err != nil || !ok {
+		t.Errorf("failed to reencrypt %v", err)
+		return
+	} else if h, _, err := ParseHeader(c2); err != nil || h.Suite != SuiteAESCBCPKCS7HMACSHA256 || h.Flags != FlagAuthenticatedHeader {
+		t.Errorf("Should keep the suite %v", h)
+		return
+	} else if dst, err := dec.Decrypt(c2); err != nil || !bytes.Equal(dst, src) {
+		t.Errorf("failed to decrypt %v", err)
+		return
+	}
+}
+
+func TestFramed_ErrorCase(t *testing.T) {
+
+	ring := newEnvelopeTestKeyring(t, 0, 1)
+	if _, err := NewFramedEncrypter(ring, 0xffff); !errors.Is(err, ErrUnknownSuite) {
+		t.Error("Should fail with ErrUnknownSuite")
+		return
+	}
+	if _, _, err := NewFramedEncDec(ring, 0xffff); !errors.Is(err, ErrUnknownSuite) {
+		t.Error("Should fail with ErrUnknownSuite")
+		return
+	}
+	if _, err := NewFramedDecrypter(ring, SuiteAESCBCPKCS7, 0xffff); !errors.Is(err, ErrUnknownSuite) {
+		t.Error("Should fail with ErrUnknownSuite")
+		return
+	}
+	if _, err := NewFramedDecrypter(ring); err == nil {
+		t.Error("Should fail without suites")
+		return
+	}
+	if _, err := NewFramedEncrypter(ring, SuiteAESCBCPKCS7HMACSHA256, SuiteAESCBCPKCS7); !errors.Is(err, ErrSuiteNotAllowed) {
+		t.Error("Should fail with ErrSuiteNotAllowed")
+		return
+	}
+
+	enc, err := NewFramedEncrypter(ring, SuiteAESCBCPKCS7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := NewFramedDecrypter(ring, SuiteAESCBCPKCS7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := enc.Encrypt([]byte("0123456789"))
+
+	for _, n := range []int{4, 8, 12} {
+		if _, err := dec.Decrypt(c[:n]); !errors.Is(err, ErrCiphertextTooShort) {
+			t.Errorf("Should fail with ErrCiphertextTooShort %d", n)
+			return
+		}
+	}
+	for _, tc := range []struct {
+		index int
+		value byte
+		err   error
+	}{
+		{4, 2, nil},                           // format version
+		{6, 0xff, ErrSuiteNotAllowed},         // suite
+		{7, 0x02, nil},                        // flags
+		{8, 3, ErrUnknownKeyVersion},          // key ID length
+		{12, 9, ErrUnknownKeyVersion},         // key version
+		{28, c[28] ^ 0x01, ErrInvalidPadding}, // last byte of IV
+	} {
+		tampered := append([]byte(nil), c...)
+		tampered[tc.index] = tc.value
+		if _, err := dec.Decrypt(tampered); err == nil || tc.err != nil && !errors.Is(err, tc.err) {
+			t.Errorf("Should fail with byte %d: %v", tc.index, err)
+			return
+		}
+		if tc.index < 12 {
+			if _, err := CiphertextVersion(tampered); err == nil && tc.index != 6 {
+				t.Errorf("CiphertextVersion should fail with byte %d", tc.index)
+				return
+			}
+		}
+	}
+
+	if _, err := (&Header{KeyID: make([]byte, 256)}).Marshal(nil); err == nil {
+		t.Error("Should fail with key ID of 256 bytes")
+		return
+	}
+	if _, _, err := ParseHeader([]byte{0, 0, 0, 1}); err == nil {
+		t.Error("Should fail without magic")
+		return
+	}
+
+	newSuite := func(b cipher.Block, rng io.Reader) (Encrypter, Decrypter, error) { return nil, nil, nil }
+	for _, s := range []Suite{{ID: 0, New: newSuite}, {ID: SuiteAESCBCPKCS7, New: newSuite}, {ID: 0xfffe}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterSuite should panic %d", s.ID)
+				}
+			}()
+			RegisterSuite(s)
+		}()
+	}
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fuzz targets check that no input makes Decrypt panic.
+// Run "go test -fuzz FuzzXxx" to extend the corpus beyond the seeds and
+// testdata/fuzz, which go test runs as well.
+
+var fuzzKey = []byte("0123456789abcdef")
+
+func fuzzSeeds(f *testing.F, enc Encrypter) {
+	f.Add([]byte{})
+	f.Add([]byte{0x00})
+	f.Add([]byte{0x00, 0x00, 0x00, 0x01})
+	f.Add(bytes.Repeat([]byte{0x10}, 16))
+	f.Add(bytes.Repeat([]byte{0x00}, 33))
+	f.Add(bytes.Repeat([]byte{0xff}, 64))
+	for _, size := range []int{0, 1, 15, 16, 17, 100} {
+		c := enc.Encrypt(make([]byte, size))
+		f.Add(c)
+		f.Add(c[:len(c)-1])
+		f.Add(c[1:])
+	}
+}
+
+func FuzzAESCBCPKCS7Decrypt(f *testing.F) {
+	enc, dec, err := NewAESCBCPKCS7EncDec(fuzzKey, fuzzKey)
+	if err != nil {
+		f.Fatal(err)
+	}
+	fuzzSeeds(f, enc)
+	f.Fuzz(func(t *testing.T, src []byte) {
+		dec.Decrypt(src)
+	})
+}
+
+func FuzzAESCBCPKCS7ivDecrypt(f *testing.F) {
+	enc, dec, err := NewAESCBCPKCS7ivEncDec(fuzzKey)
+	if err != nil {
+		f.Fatal(err)
+	}
+	fuzzSeeds(f, enc)
+	f.Fuzz(func(t *testing.T, src []byte) {
+		dec.Decrypt(src)
+		if r, err := NewAESCBCPKCS7ivReader(fuzzKey, bytes.NewReader(src)); err == nil {
+			ioutil.ReadAll(r)
+		}
+	})
+}
+
+func FuzzAESCBCPKCS7HMACDecrypt(f *testing.F) {
+	enc, dec, err := NewAESCBCPKCS7HMACEncDec(fuzzKey)
+	if err != nil {
+		f.Fatal(err)
+	}
+	fuzzSeeds(f, enc)
+	f.Fuzz(func(t *testing.T, src []byte) {
+		dec.Decrypt(src)
+	})
+}
+
+func FuzzAESCBCPKCS7ivVerDecrypt(f *testing.F) {
+	wd, err := os.Getwd()
+	if err != nil {
+		f.Fatal(err)
+	}
+	keydir := filepath.Join(wd, "test", "versioned_1-2")
+	enc, dec, err := NewAESCBCPKCS7ivVerEncDec(keydir, filepath.Join(keydir, "pwd.yaml"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	fuzzSeeds(f, enc)
+	f.Fuzz(func(t *testing.T, src []byte) {
+		dec.Decrypt(src)
+	})
+}
+
+func FuzzAESCBCCTSivDecrypt(f *testing.F) {
+	enc, dec, err := NewAESCBCCTSivEncDec(fuzzKey, CS3)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add([]byte{})
+	f.Add(bytes.Repeat([]byte{0x00}, 31))
+	for _, size := range []int{16, 17, 31, 32, 100} {
+		f.Add(enc.Encrypt(make([]byte, size)))
+	}
+	f.Fuzz(func(t *testing.T, src []byte) {
+		dec.Decrypt(src)
+	})
+}
+
+func newFuzzKeyring(f *testing.F) *Keyring {
+	ring, err := NewKeyringWithKeyStore(NewMemKeyStore(map[uint32][]byte{1: fuzzKey, 2: bytes.Repeat(fuzzKey, 2)}))
+	if err != nil {
+		f.Fatal(err)
+	}
+	return ring
+}
+
+func FuzzFramedDecrypt(f *testing.F) {
+	ring := newFuzzKeyring(f)
+	suites := []uint16{SuiteAESCBCPKCS7, SuiteAESCBCCTS3, SuiteAESCBCPKCS7HMACSHA256}
+	dec, err := NewFramedDecrypter(ring, suites...)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, suite := range suites {
+		enc, err := NewFramedEncrypter(ring, suite)
+		if err != nil {
+			f.Fatal(err)
+		}
+		for _, size := range []int{16, 17, 100} {
+			c := enc.Encrypt(make([]byte, size))
+			f.Add(c)
+			f.Add(c[:len(c)-1])
+		}
+	}
+	if enc, err := NewFramedEncrypter(ring, SuiteAESCBCPKCS7HMACSHA256); err != nil {
+		f.Fatal(err)
+	} else if c, err := enc.(AEADEncrypter).EncryptWithAAD([]byte("0123456789"), []byte("aad")); err != nil {
+		f.Fatal(err)
+	} else {
+		f.Add(c)
+	}
+	f.Add(append(append([]byte(nil), framedMagic...), 1, 0, 1, 0, 4, 0, 0, 0, 1))
+	verdec := NewAESCBCPKCS7ivVerDecrypterWithKeyring(ring)
+	f.Fuzz(func(t *testing.T, src []byte) {
+		dec.Decrypt(src)
+		dec.(AEADDecrypter).DecryptWithAAD(src, []byte("aad"))
+		verdec.Decrypt(src)
+	})
+}
+
+func FuzzEnvelopeDecrypt(f *testing.F) {
+	ring := newFuzzKeyring(f)
+	enc, dec := NewEnvelopeEncDec(ring, PayloadAESCBCPKCS7HMACSHA256)
+	fuzzSeeds(f, enc)
+	f.Fuzz(func(t *testing.T, src []byte) {
+		dec.Decrypt(src)
+		enc.Reencrypt(src)
+	})
+}
+
+func FuzzPasswordDecrypt(f *testing.F) {
+	// the limits keep the KDF of a forged header cheap
+	dec := NewPasswordDecrypter("password", testPasswordParams...)
+	for _, params := range testPasswordParams {
+		enc, err := NewPasswordEncrypter("password", params)
+		if err != nil {
+			f.Fatal(err)
+		}
+		fuzzSeeds(f, enc)
+	}
+	f.Fuzz(func(t *testing.T, src []byte) {
+		dec.Decrypt(src)
+	})
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const hmacTagSize = sha256.Size
+
+// cbcpkcs7hmac is encrypt-then-MAC on top of cbciv:
+// "IV + ciphertext + HMAC-SHA256(IV + ciphertext)".
+// The tag is verified in constant time before the padding is looked at.
+// With associated data the tag is computed as in sign.
+type cbcpkcs7hmac struct {
+	iv     *cbciv
+	mackey []byte
+}
+
+func (x *cbcpkcs7hmac) Encrypt(src []byte) []byte {
+	return MustEncrypt(encryptMain(x, src))
+}
+
+func (x *cbcpkcs7hmac) TryEncrypt(src []byte) ([]byte, error) {
+	return encryptMain(x, src)
+}
+
+func (x *cbcpkcs7hmac) EncryptWithAAD(src, aad []byte) ([]byte, error) {
+	dst := make([]byte, x.calcDstSizeToEnc(src))
+	if err := x.seal(dst, src, aad); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+func (x *cbcpkcs7hmac) WithRand(rng io.Reader) Encrypter {
+	return &cbcpkcs7hmac{&cbciv{x.iv.b, x.iv.p, rng}, x.mackey}
+}
+
+func (x *cbcpkcs7hmac) doEncrypt(dst, src []byte) error {
+	return x.seal(dst, src, nil)
+}
+
+func (x *cbcpkcs7hmac) seal(dst, src, aad []byte) error {
+	size := len(dst) - hmacTagSize
+	if err := x.iv.doEncrypt(dst[:size], src); err != nil {
+		return err
+	}
+	x.sign(dst[size:size], dst[:size], aad)
+	return nil
+}
+
+func (x *cbcpkcs7hmac) calcDstSizeToEnc(src []byte) int {
+	return x.iv.calcDstSizeToEnc(src) + hmacTagSize
+}
+
+func (x *cbcpkcs7hmac) Decrypt(src []byte) ([]byte, error) {
+	return decryptMain(x, src)
+}
+
+func (x *cbcpkcs7hmac) DecryptWithAAD(src, aad []byte) ([]byte, error) {
+	size, err := x.calcDstSizeToDec(src)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, size)
+	if dstSize, err := x.open(dst, src, aad); err != nil {
+		return nil, err
+	} else {
+		return dst[:dstSize], nil
+	}
+}
+
+func (x *cbcpkcs7hmac) doDecrypt(dst, src []byte) (int, error) {
+	return x.open(dst, src, nil)
+}
+
+func (x *cbcpkcs7hmac) open(dst, src, aad []byte) (int, error) {
+	size := len(src) - hmacTagSize
+	if !hmac.Equal(src[size:], x.sign(nil, src[:size], aad)) {
+		return -1, ErrAuthenticationFailed
+	}
+	return x.iv.doDecrypt(dst, src[:size])
+}
+
+func (x *cbcpkcs7hmac) calcDstSizeToDec(src []byte) (int, error) {
+	if len(src) < hmacTagSize {
+		return -1, fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(src))
+	}
+	return x.iv.calcDstSizeToDec(src[:len(src)-hmacTagSize])
+}
+
+// sign appends the tag of data to dst. With associated data the tag is
+// HMAC-SHA256(aad + data + bit length of aad (8B)), as in RFC 7518, under a
+// key derived from mackey, so that it never verifies as the tag of another
+// ciphertext without associated data.
+func (x *cbcpkcs7hmac) sign(dst, data, aad []byte) []byte {
+	if len(aad) == 0 {
+		mac := hmac.New(sha256.New, x.mackey)
+		mac.Write(data)
+		return mac.Sum(dst)
+	}
+	mac := hmac.New(sha256.New, x.mackey)
+	mac.Write([]byte("aescbc-hmac-sha256 associated data"))
+	mac = hmac.New(sha256.New, mac.Sum(nil))
+	mac.Write(aad)
+	mac.Write(data)
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(len(aad))*8))
+	return mac.Sum(dst)
+}
+
+// deriveHMACKeys derives independent encryption and MAC keys from key, so
+// that the same bytes are never used for both purposes.
+func deriveHMACKeys(key []byte) ([]byte, []byte, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, nil, aes.KeySizeError(len(key))
+	}
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	return derive("aescbc-hmac-sha256 encryption")[:len(key)], derive("aescbc-hmac-sha256 authentication"), nil
+}
+
+func newAESCBCPKCS7HMAC(key []byte) (*cbcpkcs7hmac, error) {
+	if enckey, mackey, err := deriveHMACKeys(key); err != nil {
+		return nil, err
+	} else if b, err := aes.NewCipher(enckey); err != nil {
+		return nil, err
+	} else {
+		return &cbcpkcs7hmac{&cbciv{b: b, p: PKCS7Padding}, mackey}, nil
+	}
+}
+
+// hmacAEAD is the HMAC mode as a cipher.AEAD, whose nonce is the IV, for
+// SuiteAESCBCPKCS7HMACSHA256.
+type hmacAEAD struct {
+	x *cbcpkcs7hmac
+}
+
+func newHMACAEAD(key []byte) (cipher.AEAD, error) {
+	if x, err := newAESCBCPKCS7HMAC(key); err != nil {
+		return nil, err
+	} else {
+		return &hmacAEAD{x}, nil
+	}
+}
+
+func (a *hmacAEAD) NonceSize() int {
+	return aes.BlockSize
+}
+
+// Overhead is the longest padding and the tag.
+func (a *hmacAEAD) Overhead() int {
+	return aes.BlockSize + hmacTagSize
+}
+
+func (a *hmacAEAD) Seal(dst, nonce, plaintext, aad []byte) []byte {
+	if len(nonce) != aes.BlockSize {
+		panic("aescbc: incorrect nonce length given to HMAC mode")
+	}
+	x := &cbcpkcs7hmac{&cbciv{a.x.iv.b, a.x.iv.p, bytes.NewReader(nonce)}, a.x.mackey}
+	sealed := make([]byte, x.calcDstSizeToEnc(plaintext))
+	if err := x.seal(sealed, plaintext, aad); err != nil {
+		panic(err.Error())
+	}
+	return append(dst, sealed[len(nonce):]...)
+}
+
+func (a *hmacAEAD) Open(dst, nonce, ciphertext, aad []byte) ([]byte, error) {
+	if len(nonce) != aes.BlockSize {
+		panic("aescbc: incorrect nonce length given to HMAC mode")
+	}
+	src := append(append([]byte(nil), nonce...), ciphertext...)
+	if plain, err := a.x.DecryptWithAAD(src, aad); err != nil {
+		return nil, err
+	} else {
+		return append(dst, plain...), nil
+	}
+}
+
+// NewCBCPKCS7HMACEncrypter uses b for encryption and mackey for HMAC-SHA256.
+// The two keys must be independent.
+func NewCBCPKCS7HMACEncrypter(b cipher.Block, mackey []byte) Encrypter {
+	return &cbcpkcs7hmac{&cbciv{b: b, p: PKCS7Padding}, mackey}
+}
+
+func NewCBCPKCS7HMACDecrypter(b cipher.Block, mackey []byte) Decrypter {
+	return &cbcpkcs7hmac{&cbciv{b: b, p: PKCS7Padding}, mackey}
+}
+
+// NewAESCBCPKCS7HMACEncrypter derives an AES key and an HMAC-SHA256 key from
+// key and encrypts then MACs. This is the recommended mode of this package.
+// The encrypters and decrypters of this mode are AEADEncrypter and
+// AEADDecrypter as well.
+func NewAESCBCPKCS7HMACEncrypter(key []byte) (Encrypter, error) {
+	if x, err := newAESCBCPKCS7HMAC(key); err != nil {
+		return nil, err
+	} else {
+		return x, nil
+	}
+}
+
+func NewAESCBCPKCS7HMACDecrypter(key []byte) (Decrypter, error) {
+	if x, err := newAESCBCPKCS7HMAC(key); err != nil {
+		return nil, err
+	} else {
+		return x, nil
+	}
+}
+
+func NewAESCBCPKCS7HMACEncDec(key []byte) (Encrypter, Decrypter, error) {
+	if x, err := newAESCBCPKCS7HMAC(key); err != nil {
+		return nil, nil, err
+	} else {
+		return x, x, nil
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestAESCBCPKCS7HMAC_1(t *testing.T) {
+	numOfTrial := 5
+	maxSize := 512
+
+	for i := 0; i < numOfTrial; i++ {
+
+		key := make([]byte, 16)
+		if n, err := rand.Read(key); n != 16 || err != nil {
+			t.Error("failed to create key")
+			return
+		}
+		mackey := make([]byte, 32)
+		if n, err := rand.Read(mackey); n != 32 || err != nil {
+			t.Error("failed to create mackey")
+			return
+		}
+
+		cipher, err := aes.NewCipher(key)
+		if err != nil {
+			t.Error("failed to create cipher")
+			return
+		}
+
+		enc := NewCBCPKCS7HMACEncrypter(cipher, mackey)
+		dec := NewCBCPKCS7HMACDecrypter(cipher, mackey)
+
+		for size := 0; size <= maxSize; size++ {
+			encdeccompare(t, size, enc, dec)
+		}
+	}
+}
+
+func TestAESCBCPKCS7HMAC_2(t *testing.T) {
+	numOfTrial := 5
+	maxSize := 512
+
+	for i := 0; i < numOfTrial; i++ {
+
+		key := make([]byte, 32)
+		if n, err := rand.Read(key); n != 32 || err != nil {
+			t.Error("failed to create key")
+			return
+		}
+
+		enc, err := NewAESCBCPKCS7HMACEncrypter(key)
+		if err != nil {
+			t.Error("failed to create encrypter")
+			return
+		}
+		dec, err := NewAESCBCPKCS7HMACDecrypter(key)
+		if err != nil {
+			t.Error("failed to create decrypter")
+			return
+		}
+
+		for size := 0; size <= maxSize; size++ {
+			encdeccompare(t, size, enc, dec)
+		}
+	}
+}
+
+func TestAESCBCPKCS7HMAC_3(t *testing.T) {
+	numOfTrial := 5
+	maxSize := 512
+
+	for i := 0; i < numOfTrial; i++ {
+
+		key := make([]byte, 24)
+		if n, err := rand.Read(key); n != 24 || err != nil {
+			t.Error("failed to create key")
+			return
+		}
+
+		enc, dec, err := NewAESCBCPKCS7HMACEncDec(key)
+		if err != nil {
+			t.Error("failed to create encrypter")
+			return
+		}
+
+		for size := 0; size <= maxSize; size++ {
+			encdeccompare(t, size, enc, dec)
+		}
+	}
+}
+
+func TestAESCBCPKCS7HMAC_ErrorCase(t *testing.T) {
+	numOfTrial := 5
+
+	for i := 0; i < numOfTrial; i++ {
+
+		for _, size := range []int{0, 15, 17, 33} {
+			key := make([]byte, size)
+			if _, err := NewAESCBCPKCS7HMACEncrypter(key); err == nil {
+				t.Error("Should fail")
+				return
+			}
+			if _, err := NewAESCBCPKCS7HMACDecrypter(key); err == nil {
+				t.Error("Should fail")
+				return
+			}
+			if _, _, err := NewAESCBCPKCS7HMACEncDec(key); err == nil {
+				t.Error("Should fail")
+				return
+			}
+		}
+
+		key := make([]byte, 16)
+		if n, err := rand.Read(key); n != 16 || err != nil {
+			t.Error("failed to create key")
+			return
+		}
+		enc, dec, err := NewAESCBCPKCS7HMACEncDec(key)
+		if err != nil {
+			t.Error("failed to create encrypter")
+			return
+		}
+
+		c := enc.Encrypt([]byte("0123456789"))
+		for j := 0; j < len(c); j++ {
+			for _, bit := range []byte{0x01, 0x80} {
+				c[j] ^= bit
+				if _, err := dec.Decrypt(c); err != ErrAuthenticationFailed {
+					t.Errorf("Should fail with ErrAuthenticationFailed at %d", j)
+					return
+				}
+				c[j] ^= bit
+			}
+		}
+		for j := 0; j < len(c); j++ {
+			if _, err := dec.Decrypt(c[:j]); err == nil {
+				t.Errorf("Should fail %d", j)
+				return
+			}
+		}
+
+		plain, err := NewAESCBCPKCS7ivEncrypter(key)
+		if err != nil {
+			t.Error("failed to create encrypter")
+			return
+		}
+		if _, err := dec.Decrypt(plain.Encrypt([]byte("0123456789"))); err == nil {
+			t.Error("Should fail")
+			return
+		}
+	}
+}
+
+func TestAESCBCPKCS7HMAC_AAD(t *testing.T) {
+
+	key := make([]byte, 16)
+	if n, err := rand.Read(key); n != 16 || err != nil {
+		t.Error("failed to create key")
+		return
+	}
+	enc, dec, err := NewAESCBCPKCS7HMACEncDec(key)
+	if err != nil {
+		t.Error("failed to create encrypter")
+		return
+	}
+	aenc, adec := enc.(AEADEncrypter), dec.(AEADDecrypter)
+
+	src := []byte("0123456789")
+	aad := []byte("users/1/email0123456789abcdef")
+	c, err := aenc.EncryptWithAAD(src, aad)
+	if err != nil {
+		t.Errorf("failed to encrypt %s", err.Error())
+		return
+	}
+	if dst, err := adec.DecryptWithAAD(c, aad); err != nil || !bytes.Equal(dst, src) {
+		t.Errorf("failed to decrypt %v", err)
+		return
+	}
+	for _, other := range [][]byte{nil, []byte("users/2/email0123456789abcdef"), aad[:len(aad)-1]} {
+		if _, err := adec.DecryptWithAAD(c, other); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Should fail with ErrAuthenticationFailed with %q", other)
+			return
+		}
+	}
+	if _, err := dec.Decrypt(c); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("Should fail with ErrAuthenticationFailed")
+		return
+	}
+
+	// a block of aad moved to the ciphertext
+	if _, err := adec.DecryptWithAAD(append(append([]byte(nil), aad[len(aad)-16:]...), c...), aad[:len(aad)-16]); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("Should fail with ErrAuthenticationFailed")
+		return
+	}
+
+	// empty associated data is the same as Encrypt and Decrypt
+	if c, err := aenc.EncryptWithAAD(src, []byte{}); err != nil {
+		t.Errorf("failed to encrypt %s", err.Error())
+		return
+	} else if dst, err := dec.Decrypt(c); err != nil || !bytes.Equal(dst, src) {
+		t.Errorf("failed to decrypt %v", err)
+		return
+	}
+	if dst, err := adec.DecryptWithAAD(enc.Encrypt(src), nil); err != nil || !bytes.Equal(dst, src) {
+		t.Errorf("failed to decrypt %v", err)
+		return
+	}
+}
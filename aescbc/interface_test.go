@@ -0,0 +1,126 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/agwlvssainokuni/go-crypto/aescbc"
+	"github.com/agwlvssainokuni/go-crypto/aesgcm"
+)
+
+// countingEncDec wraps another Encrypter/Decrypter from outside the package.
+type countingEncDec struct {
+	enc   aescbc.Encrypter
+	dec   aescbc.Decrypter
+	count int
+}
+
+func (x *countingEncDec) Encrypt(src []byte) []byte {
+	x.count++
+	return x.enc.Encrypt(src)
+}
+
+func (x *countingEncDec) TryEncrypt(src []byte) ([]byte, error) {
+	x.count++
+	return aescbc.TryEncrypt(x.enc, src)
+}
+
+func (x *countingEncDec) Decrypt(src []byte) ([]byte, error) {
+	x.count++
+	return x.dec.Decrypt(src)
+}
+
+// failingDecrypter is a mock which always fails.
+type failingDecrypter struct{}
+
+func (failingDecrypter) Decrypt(src []byte) ([]byte, error) {
+	return nil, errors.New("failed")
+}
+
+// upperEncrypter implements Encrypt only, and panics with an empty source.
+type upperEncrypter struct{}
+
+func (upperEncrypter) Encrypt(src []byte) []byte {
+	if len(src) == 0 {
+		panic(errors.New("empty"))
+	}
+	return bytes.ToUpper(src)
+}
+
+func roundTrip(enc aescbc.Encrypter, dec aescbc.Decrypter, src []byte) ([]byte, error) {
+	return dec.Decrypt(enc.Encrypt(src))
+}
+
+func TestExternalImplementation_1(t *testing.T) {
+
+	key := make([]byte, 16)
+	if n, err := rand.Read(key); n != 16 || err != nil {
+		t.Error("failed to create key")
+		return
+	}
+
+	enc, dec, err := aescbc.NewAESCBCPKCS7HMACEncDec(key)
+	if err != nil {
+		t.Error("failed to create encrypter")
+		return
+	}
+	gcmenc, gcmdec, err := aesgcm.NewAESGCMEncDec(key)
+	if err != nil {
+		t.Error("failed to create encrypter")
+		return
+	}
+
+	for _, x := range []*countingEncDec{{enc: enc, dec: dec}, {enc: gcmenc, dec: gcmdec}} {
+		src := []byte("0123456789")
+		if dst, err := roundTrip(x, x, src); err != nil {
+			t.Errorf("failed to decrypt %s", err.Error())
+			return
+		} else if !bytes.Equal(src, dst) {
+			t.Error("data mismatch")
+			return
+		}
+		if x.count != 2 {
+			t.Errorf("count %d", x.count)
+			return
+		}
+	}
+
+	if _, err := roundTrip(enc, failingDecrypter{}, []byte("0123456789")); err == nil {
+		t.Error("Should fail")
+		return
+	}
+}
+
+func TestExternalImplementation_TryEncrypt(t *testing.T) {
+
+	if dst, err := aescbc.TryEncrypt(upperEncrypter{}, []byte("abc")); err != nil || string(dst) != "ABC" {
+		t.Errorf("failed to encrypt %v", err)
+		return
+	}
+	if _, err := aescbc.TryEncrypt(upperEncrypter{}, nil); err == nil || err.Error() != "failed to encrypt: empty" {
+		t.Errorf("Should fail with the panic %v", err)
+		return
+	}
+	if _, ok := aescbc.Encrypter(upperEncrypter{}).(aescbc.TryEncrypter); ok {
+		t.Error("Should not be a TryEncrypter")
+		return
+	}
+}
@@ -0,0 +1,264 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keyring holds the keys of a KeyStore, by default a versioned key directory,
+// and can reload them while encrypters made from it are in use. A reload
+// swaps in the new keys atomically. Versions which are no longer listed are
+// kept, so that old ciphertexts can still be decrypted, unless the Keyring is
+// made with WithDropRemovedVersions. When a reload brings a version higher
+// than any loaded before, it becomes the active version, unless the active
+// version is pinned by SetActiveVersion or WithActiveVersion.
+type Keyring struct {
+	ks          KeyStore
+	dropRemoved bool
+	keys        atomic.Value // *keyset
+	reloadMu    sync.Mutex   // serializes the reloads
+	mu          sync.Mutex   // guards the swaps of keys and hooks
+	hooks       []func(versions []uint32, err error)
+}
+
+type keyset struct {
+	blocks map[uint32]cipher.Block
+	keys   map[uint32][]byte
+	active uint32
+	pinned bool
+}
+
+// KeyringOption configures a Keyring at its construction.
+type KeyringOption func(*keyringOptions)
+
+type keyringOptions struct {
+	active      *uint32
+	dropRemoved bool
+}
+
+// WithActiveVersion makes version the active version of a new Keyring
+// instead of the highest one, pinned as by SetActiveVersion. The
+// construction fails with ErrUnknownKeyVersion unless version is loaded.
+func WithActiveVersion(version uint32) KeyringOption {
+	return func(o *keyringOptions) {
+		o.active = &version
+	}
+}
+
+// WithDropRemovedVersions makes the reloads of a new Keyring drop the
+// versions which the KeyStore no longer lists, except the active version, so
+// that deleting the key of a version makes its ciphertexts unreadable
+// (crypto-shredding) without a restart.
+func WithDropRemovedVersions() KeyringOption {
+	return func(o *keyringOptions) {
+		o.dropRemoved = true
+	}
+}
+
+func NewKeyring(topdir, pwdfile string, opts ...KeyringOption) (*Keyring, error) {
+	return NewKeyringWithKeyStore(NewDirKeyStore(topdir, pwdfile), opts...)
+}
+
+// NewKeyringWithKeyStore loads the keys from ks, also on every reload.
+func NewKeyringWithKeyStore(ks KeyStore, opts ...KeyringOption) (*Keyring, error) {
+	var o keyringOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	k := &Keyring{ks: ks, dropRemoved: o.dropRemoved}
+	if keymap, err := loadKeyStore(ks); err != nil {
+		return nil, err
+	} else if ks, err := k.mergeKeyset(&keyset{}, keymap); err != nil {
+		return nil, err
+	} else if o.active == nil {
+		k.keys.Store(ks)
+		return k, nil
+	} else if _, ok := ks.blocks[*o.active]; !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKeyVersion, *o.active)
+	} else {
+		ks.active, ks.pinned = *o.active, true
+		k.keys.Store(ks)
+		return k, nil
+	}
+}
+
+func (k *Keyring) current() *keyset {
+	return k.keys.Load().(*keyset)
+}
+
+// mergeKeyset merges the keys of keymap into old, or with dropRemoved
+// replaces them but the active version.
+func (k *Keyring) mergeKeyset(old *keyset, keymap map[uint32][]byte) (*keyset, error) {
+	blocks := make(map[uint32]cipher.Block)
+	keys := make(map[uint32][]byte)
+	for vr, b := range old.blocks {
+		if !k.dropRemoved || vr == old.active {
+			blocks[vr] = b
+			keys[vr] = old.keys[vr]
+		}
+	}
+	for vr, key := range keymap {
+		if b, err := aes.NewCipher(key); err != nil {
+			return nil, err
+		} else {
+			blocks[vr] = b
+			keys[vr] = key
+		}
+	}
+	highest, err := highestVersion(blocks)
+	if err != nil {
+		return nil, err
+	}
+	ks := &keyset{blocks: blocks, keys: keys, active: old.active, pinned: old.pinned}
+	if len(old.blocks) == 0 {
+		ks.active = highest
+	} else if oldHighest, _ := highestVersion(old.blocks); highest > oldHighest && !old.pinned {
+		ks.active = highest
+	}
+	return ks, nil
+}
+
+func highestVersion(blocks map[uint32]cipher.Block) (uint32, error) {
+	if len(blocks) == 0 {
+		return 0, fmt.Errorf("No key version loaded")
+	}
+	highest := uint32(0)
+	for vr := range blocks {
+		if vr > highest {
+			highest = vr
+		}
+	}
+	return highest, nil
+}
+
+// Reload re-reads the key directory. On failure the keys loaded so far stay
+// in use. Either way the callbacks registered with OnReload are called. The
+// keys are loaded without blocking SetActiveVersion, which may be slow with
+// a KMS or a password prompt.
+func (k *Keyring) Reload() error {
+	k.reloadMu.Lock()
+	defer k.reloadMu.Unlock()
+
+	keymap, err := loadKeyStore(k.ks)
+	k.mu.Lock()
+	if err == nil {
+		var ks *keyset
+		if ks, err = k.mergeKeyset(k.current(), keymap); err == nil {
+			k.keys.Store(ks)
+		}
+	}
+	versions := k.Versions()
+	hooks := k.hooks
+	k.mu.Unlock()
+
+	for _, f := range hooks {
+		f(versions, err)
+	}
+	return err
+}
+
+// OnReload registers f to be called after every reload with the versions
+// then available and the error of the reload, if any.
+func (k *Keyring) OnReload(f func(versions []uint32, err error)) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.hooks = append(k.hooks[:len(k.hooks):len(k.hooks)], f)
+}
+
+// Poll reloads the keys every interval until ctx is done. Errors are reported
+// through the OnReload callbacks.
+func (k *Keyring) Poll(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Invalid poll interval %v", interval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			k.Reload()
+		}
+	}
+}
+
+// Versions returns the loaded versions in ascending order.
+func (k *Keyring) Versions() []uint32 {
+	ks := k.current()
+	versions := make([]uint32, 0, len(ks.blocks))
+	for vr := range ks.blocks {
+		versions = append(versions, vr)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+func (k *Keyring) ActiveVersion() uint32 {
+	return k.current().active
+}
+
+// SetActiveVersion changes the active version of every encrypter made from k,
+// and pins it, so that the reloads keep it even when they bring a higher
+// version, until ClearActiveVersion.
+func (k *Keyring) SetActiveVersion(version uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	ks := k.current()
+	if _, ok := ks.blocks[version]; !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownKeyVersion, version)
+	}
+	k.keys.Store(&keyset{blocks: ks.blocks, keys: ks.keys, active: version, pinned: true})
+	return nil
+}
+
+// ClearActiveVersion unpins the active version and makes the highest version
+// active, as after the construction.
+func (k *Keyring) ClearActiveVersion() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	ks := k.current()
+	highest, _ := highestVersion(ks.blocks)
+	k.keys.Store(&keyset{blocks: ks.blocks, keys: ks.keys, active: highest})
+}
+
+// Block returns the AES cipher of version.
+func (k *Keyring) Block(version uint32) (cipher.Block, error) {
+	if b, ok := k.current().blocks[version]; !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKeyVersion, version)
+	} else {
+		return b, nil
+	}
+}
+
+// key returns the AES key of version, for the suites which derive other keys
+// from it.
+func (k *Keyring) key(version uint32) ([]byte, error) {
+	if key, ok := k.current().keys[version]; !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKeyVersion, version)
+	} else {
+		return key, nil
+	}
+}
@@ -0,0 +1,441 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPasswds = map[uint32]string{0: "password", 1: ""}
+
+// writeKeydir copies the given versions of test/versioned_1-2 into keydir and
+// lists them in keydir/pwd.yaml.
+func writeKeydir(t *testing.T, keydir string, versions ...uint32) string {
+	pwd := ""
+	for _, vr := range versions {
+		dir := strconv.FormatUint(uint64(vr), 10)
+		if err := os.MkdirAll(filepath.Join(keydir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{PrivkeyFilename, AeskeyFilename} {
+			if data, err := ioutil.ReadFile(filepath.Join("test", "versioned_1-2", dir, name)); err != nil {
+				t.Fatal(err)
+			} else if err := ioutil.WriteFile(filepath.Join(keydir, dir, name), data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pwd += fmt.Sprintf("%d: %q\n", vr, testPasswds[vr])
+	}
+	pwdfile := filepath.Join(keydir, "pwd.yaml")
+	if err := ioutil.WriteFile(pwdfile, []byte(pwd), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pwdfile
+}
+
+func TestKeyring_Reload(t *testing.T) {
+
+	keydir := t.TempDir()
+	pwdfile := writeKeydir(t, keydir, 0)
+
+	ring, err := NewKeyring(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create keyring %s", err.Error())
+		return
+	}
+	var reloaded [][]uint32
+	ring.OnReload(func(versions []uint32, err error) {
+		if err != nil {
+			t.Errorf("failed to reload %s", err.Error())
+		}
+		reloaded = append(reloaded, versions)
+	})
+	enc, dec := NewAESCBCPKCS7ivVerEncDecWithKeyring(ring)
+
+	src := []byte("0123456789")
+	c0 := enc.Encrypt(src)
+	if v := binary.BigEndian.Uint32(c0); v != 0 {
+		t.Errorf("version %d", v)
+		return
+	}
+
+	// add version 1
+	writeKeydir(t, keydir, 0, 1)
+	if err := ring.Reload(); err != nil {
+		t.Errorf("failed to reload %s", err.Error())
+		return
+	}
+	if enc.ActiveVersion() != 1 {
+		t.Error("active version should switch to the new version")
+		return
+	}
+	c1 := enc.Encrypt(src)
+	if v := binary.BigEndian.Uint32(c1); v != 1 {
+		t.Errorf("version %d", v)
+		return
+	}
+
+	// drop version 0 from the directory, pinning version 0
+	if err := enc.SetActiveVersion(0); err != nil {
+		t.Errorf("failed to set version %s", err.Error())
+		return
+	}
+	writeKeydir(t, keydir, 1)
+	if err := ring.Reload(); err != nil {
+		t.Errorf("failed to reload %s", err.Error())
+		return
+	}
+	if enc.ActiveVersion() != 0 {
+		t.Error("active version should stay without a new version")
+		return
+	}
+	for _, c := range [][]byte{c0, c1, enc.Encrypt(src)} {
+		if dst, err := dec.Decrypt(c); err != nil {
+			t.Errorf("failed to decrypt %s", err.Error())
+			return
+		} else if string(dst) != string(src) {
+			t.Errorf("Decrypted %x", dst)
+			return
+		}
+	}
+
+	expected := [][]uint32{{0, 1}, {0, 1}}
+	if !reflect.DeepEqual(reloaded, expected) {
+		t.Errorf("Reloaded %v", reloaded)
+		return
+	}
+}
+
+func TestKeyring_ActiveVersion(t *testing.T) {
+
+	keydir := t.TempDir()
+	pwdfile := writeKeydir(t, keydir, 0, 1)
+
+	ring, err := NewKeyring(keydir, pwdfile, WithActiveVersion(0))
+	if err != nil {
+		t.Errorf("failed to create keyring %s", err.Error())
+		return
+	}
+	enc, dec := NewAESCBCPKCS7ivVerEncDecWithKeyring(ring)
+	if enc.ActiveVersion() != 0 {
+		t.Errorf("active version %d", enc.ActiveVersion())
+		return
+	}
+	c := enc.Encrypt([]byte("0123456789"))
+	if v := binary.BigEndian.Uint32(c); v != 0 {
+		t.Errorf("version %d", v)
+		return
+	}
+	if _, err := dec.Decrypt(c); err != nil {
+		t.Errorf("failed to decrypt %s", err.Error())
+		return
+	}
+
+	// kept by a reload without a new version
+	if err := ring.Reload(); err != nil {
+		t.Errorf("failed to reload %s", err.Error())
+		return
+	}
+	if enc.ActiveVersion() != 0 {
+		t.Errorf("active version %d", enc.ActiveVersion())
+		return
+	}
+
+	if ring, err := NewKeyringWithKeyStore(NewMemKeyStore(map[uint32][]byte{3: make([]byte, 16)}), WithActiveVersion(3)); err != nil || ring.ActiveVersion() != 3 {
+		t.Errorf("failed to create keyring %v", err)
+		return
+	}
+	if _, err := NewKeyring(keydir, pwdfile, WithActiveVersion(2)); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Errorf("Should fail with ErrUnknownKeyVersion %v", err)
+		return
+	}
+}
+
+func TestKeyring_DropRemovedVersions(t *testing.T) {
+
+	keydir := t.TempDir()
+	pwdfile := writeKeydir(t, keydir, 0, 1)
+
+	ring, err := NewKeyring(keydir, pwdfile, WithDropRemovedVersions())
+	if err != nil {
+		t.Errorf("failed to create keyring %s", err.Error())
+		return
+	}
+	enc, dec := NewAESCBCPKCS7ivVerEncDecWithKeyring(ring)
+	src := []byte("0123456789")
+	c1 := enc.Encrypt(src)
+	if err := enc.SetActiveVersion(0); err != nil {
+		t.Fatal(err)
+	}
+	c0 := enc.Encrypt(src)
+
+	// the active version is kept
+	writeKeydir(t, keydir, 1)
+	if err := ring.Reload(); err != nil {
+		t.Errorf("failed to reload %s", err.Error())
+		return
+	}
+	if !reflect.DeepEqual(ring.Versions(), []uint32{0, 1}) {
+		t.Errorf("Versions %v", ring.Versions())
+		return
+	}
+
+	// and dropped once no longer active
+	if err := enc.SetActiveVersion(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Reload(); err != nil {
+		t.Errorf("failed to reload %s", err.Error())
+		return
+	}
+	if !reflect.DeepEqual(ring.Versions(), []uint32{1}) {
+		t.Errorf("Versions %v", ring.Versions())
+		return
+	}
+	if _, err := dec.Decrypt(c0); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Errorf("Should fail with ErrUnknownKeyVersion %v", err)
+		return
+	}
+	if dst, err := dec.Decrypt(c1); err != nil || string(dst) != string(src) {
+		t.Errorf("failed to decrypt %v", err)
+		return
+	}
+
+	// without the option the versions are kept
+	writeKeydir(t, keydir, 0, 1)
+	ring, err = NewKeyring(keydir, pwdfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKeydir(t, keydir, 1)
+	if err := ring.Reload(); err != nil {
+		t.Errorf("failed to reload %s", err.Error())
+		return
+	}
+	if !reflect.DeepEqual(ring.Versions(), []uint32{0, 1}) {
+		t.Errorf("Versions %v", ring.Versions())
+		return
+	}
+}
+
+func TestKeyring_Pin(t *testing.T) {
+
+	keydir := t.TempDir()
+	pwdfile := writeKeydir(t, keydir, 0)
+
+	ring, err := NewKeyring(keydir, pwdfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.SetActiveVersion(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new version does not replace the pinned one
+	writeKeydir(t, keydir, 0, 1)
+	if err := ring.Reload(); err != nil {
+		t.Errorf("failed to reload %s", err.Error())
+		return
+	}
+	if ring.ActiveVersion() != 0 {
+		t.Errorf("active version %d", ring.ActiveVersion())
+		return
+	}
+
+	ring.ClearActiveVersion()
+	if ring.ActiveVersion() != 1 {
+		t.Errorf("active version %d", ring.ActiveVersion())
+		return
+	}
+}
+
+// blockingKeyStore blocks Versions until release is closed.
+type blockingKeyStore struct {
+	KeyStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (x *blockingKeyStore) Versions() ([]uint32, error) {
+	close(x.started)
+	<-x.release
+	return x.KeyStore.Versions()
+}
+
+func TestKeyring_ReloadWithoutLock(t *testing.T) {
+
+	mem := NewMemKeyStore(map[uint32][]byte{0: make([]byte, 16), 1: make([]byte, 16)})
+	ring, err := NewKeyringWithKeyStore(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := &blockingKeyStore{mem, make(chan struct{}), make(chan struct{})}
+	ring.ks = ks
+
+	done := make(chan error)
+	go func() {
+		done <- ring.Reload()
+	}()
+	<-ks.started
+
+	// the key store is being read
+	if err := ring.SetActiveVersion(0); err != nil {
+		t.Errorf("failed to set version %s", err.Error())
+		return
+	}
+	close(ks.release)
+	if err := <-done; err != nil {
+		t.Errorf("failed to reload %s", err.Error())
+		return
+	}
+	if ring.ActiveVersion() != 0 {
+		t.Errorf("active version %d", ring.ActiveVersion())
+		return
+	}
+}
+
+func TestKeyring_ErrorCase(t *testing.T) {
+
+	keydir := t.TempDir()
+	pwdfile := writeKeydir(t, keydir, 0)
+
+	if _, err := NewKeyring(keydir, filepath.Join(keydir, "none.yaml")); err == nil {
+		t.Error("Should fail")
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(keydir, "empty.yaml"), []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKeyring(keydir, filepath.Join(keydir, "empty.yaml")); err == nil {
+		t.Error("Should fail")
+		return
+	}
+
+	ring, err := NewKeyring(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create keyring %s", err.Error())
+		return
+	}
+	var errs []error
+	ring.OnReload(func(versions []uint32, err error) {
+		if !reflect.DeepEqual(versions, []uint32{0}) {
+			t.Errorf("Versions %v", versions)
+		}
+		errs = append(errs, err)
+	})
+	enc, dec := NewAESCBCPKCS7ivVerEncDecWithKeyring(ring)
+
+	if err := ioutil.WriteFile(pwdfile, []byte("1: \"\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Reload(); err == nil {
+		t.Error("Should fail")
+		return
+	}
+	if len(errs) != 1 || errs[0] == nil {
+		t.Errorf("Callback errors %v", errs)
+		return
+	}
+	if _, err := dec.Decrypt(enc.Encrypt([]byte("0123456789"))); err != nil {
+		t.Errorf("failed to decrypt %s", err.Error())
+		return
+	}
+	if err := ring.SetActiveVersion(1); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Error("Should fail with ErrUnknownKeyVersion")
+		return
+	}
+	if _, err := ring.Block(1); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Error("Should fail with ErrUnknownKeyVersion")
+		return
+	}
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := ring.Poll(context.Background(), interval); err == nil {
+			t.Errorf("Should fail with interval %v", interval)
+			return
+		}
+	}
+}
+
+func TestKeyring_Poll(t *testing.T) {
+
+	keydir := t.TempDir()
+	pwdfile := writeKeydir(t, keydir, 0)
+
+	ring, err := NewKeyring(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create keyring %s", err.Error())
+		return
+	}
+	updated := make(chan struct{})
+	var once sync.Once
+	ring.OnReload(func(versions []uint32, err error) {
+		if err == nil && len(versions) == 2 {
+			once.Do(func() { close(updated) })
+		}
+	})
+	enc, dec := NewAESCBCPKCS7ivVerEncDecWithKeyring(ring)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ring.Poll(ctx, 10*time.Millisecond)
+	}()
+
+	// encrypting while the keys are reloaded (run with -race)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := dec.Decrypt(enc.Encrypt([]byte("0123456789"))); err != nil {
+					t.Errorf("failed to decrypt %s", err.Error())
+					return
+				}
+			}
+		}()
+	}
+
+	writeKeydir(t, keydir, 0, 1)
+	select {
+	case <-updated:
+	case <-time.After(10 * time.Second):
+		t.Error("keys not reloaded")
+	}
+	wg.Wait()
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Poll returned %v", err)
+		return
+	}
+	if enc.ActiveVersion() != 1 {
+		t.Errorf("active version %d", enc.ActiveVersion())
+		return
+	}
+}
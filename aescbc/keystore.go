@@ -0,0 +1,241 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// KeyStore supplies the AES keys of the versioned encrypters. It may be
+// implemented outside this package, e.g. to fetch the keys from a secret
+// manager. Versions is called again on every reload of a Keyring.
+type KeyStore interface {
+	Versions() ([]uint32, error)
+	Key(version uint32) ([]byte, error)
+}
+
+// fsKeyStore reads <version>/privkey.pem, key.bin and meta.yaml from fsys for
+// every version of the key directory, with the passwords from pws. The
+// versions wrapped with KeyWrapKMS are unwrapped by kms instead.
+type fsKeyStore struct {
+	fsys fs.FS
+	pws  PasswordSource
+	kms  KMS
+}
+
+// NewDirKeyStore reads the key directory layout: topdir/<version>/ with
+// privkey.pem, key.bin and optionally meta.yaml for every version listed in
+// pwdfile.
+func NewDirKeyStore(topdir, pwdfile string) KeyStore {
+	return newDirKeyStore(topdir, NewPasswordFileSource(pwdfile))
+}
+
+// NewDirKeyStoreWithPasswordSource reads the same layout as NewDirKeyStore
+// with the passwords from pws instead of a password file.
+func NewDirKeyStoreWithPasswordSource(topdir string, pws PasswordSource) KeyStore {
+	return newDirKeyStore(topdir, pws)
+}
+
+func newDirKeyStore(topdir string, pws PasswordSource) *fsKeyStore {
+	return &fsKeyStore{fsys: os.DirFS(topdir), pws: pws}
+}
+
+// NewFSKeyStore reads the same layout as NewDirKeyStore from fsys, where
+// pwdfile is a path in fsys as well, e.g. "pwd.yaml". fsys may be an
+// embed.FS or a testing/fstest.MapFS.
+func NewFSKeyStore(fsys fs.FS, pwdfile string) KeyStore {
+	return &fsKeyStore{fsys: fsys, pws: &passwdFile{fsys, pwdfile}}
+}
+
+// NewFSKeyStoreWithPasswordSource reads the same layout as NewFSKeyStore
+// with the passwords from pws instead of a password file.
+func NewFSKeyStoreWithPasswordSource(fsys fs.FS, pws PasswordSource) KeyStore {
+	return &fsKeyStore{fsys: fsys, pws: pws}
+}
+
+// NewDirKeyStoreWithKMS reads the same layout as NewDirKeyStore, where
+// key.bin of the versions with "wrap: KMS" in meta.yaml is unwrapped by kms
+// under "key_id" of meta.yaml. pws gives the passwords of the other versions,
+// and may be nil if every version is wrapped by kms.
+func NewDirKeyStoreWithKMS(topdir string, kms KMS, pws PasswordSource) KeyStore {
+	x := newDirKeyStore(topdir, pws)
+	x.kms = kms
+	return x
+}
+
+// NewFSKeyStoreWithKMS reads the same layout as NewDirKeyStoreWithKMS from
+// fsys.
+func NewFSKeyStoreWithKMS(fsys fs.FS, kms KMS, pws PasswordSource) KeyStore {
+	return &fsKeyStore{fsys: fsys, pws: pws, kms: kms}
+}
+
+// passwords returns the password source of one load, which reads the
+// password file only once.
+func (x *fsKeyStore) passwords() (PasswordSource, error) {
+	if f, ok := x.pws.(*passwdFile); ok {
+		return f.passwdMap()
+	}
+	return x.pws, nil
+}
+
+func (x *fsKeyStore) Versions() ([]uint32, error) {
+	if pws, err := x.passwords(); err != nil {
+		return nil, err
+	} else {
+		return x.versions(pws)
+	}
+}
+
+func (x *fsKeyStore) versions(pws PasswordSource) ([]uint32, error) {
+	if lister, ok := pws.(versionLister); ok {
+		return lister.Versions()
+	}
+	entries, err := fs.ReadDir(x.fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	var versions []uint32
+	for _, ent := range entries {
+		if !ent.IsDir() {
+			continue
+		}
+		if vr, err := strconv.ParseUint(ent.Name(), 10, 32); err == nil && strconv.FormatUint(vr, 10) == ent.Name() {
+			versions = append(versions, uint32(vr))
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+func (x *fsKeyStore) Key(version uint32) ([]byte, error) {
+	pws, err := x.passwords()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := x.versions(pws)
+	if err != nil {
+		return nil, err
+	}
+	if i := sort.Search(len(versions), func(i int) bool { return versions[i] >= version }); i >= len(versions) || versions[i] != version {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKeyVersion, version)
+	}
+	return x.key(version, pws)
+}
+
+// loadKeys loads every version with the same passwords, so that a reload
+// never mixes two states of the password file.
+func (x *fsKeyStore) loadKeys() (map[uint32][]byte, error) {
+	pws, err := x.passwords()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := x.versions(pws)
+	if err != nil {
+		return nil, err
+	}
+	keymap := make(map[uint32][]byte)
+	for _, vr := range versions {
+		if key, err := x.key(vr, pws); err != nil {
+			return nil, fmt.Errorf("key version %d: %w", vr, err)
+		} else {
+			keymap[vr] = key
+		}
+	}
+	return keymap, nil
+}
+
+func (x *fsKeyStore) key(version uint32, pws PasswordSource) ([]byte, error) {
+	basedir := strconv.FormatUint(uint64(version), 10)
+	meta, err := loadKeyMeta(x.fsys, path.Join(basedir, MetaFilename))
+	if err != nil {
+		return nil, err
+	}
+	if meta.Wrap == KeyWrapKMS {
+		return loadKMSKey(x.fsys, path.Join(basedir, AeskeyFilename), x.kms, meta)
+	}
+	if pws == nil {
+		return nil, fmt.Errorf("No password source for key version %d", version)
+	}
+	if pw, err := pws.Password(version); err != nil {
+		return nil, err
+	} else if prvkey, err := loadPrivateKey(x.fsys, path.Join(basedir, PrivkeyFilename), pw); err != nil {
+		if f, ok := x.pws.(passwordForgetter); ok {
+			f.forget(version)
+		}
+		return nil, err
+	} else {
+		return loadAesKey(x.fsys, path.Join(basedir, AeskeyFilename), prvkey, meta)
+	}
+}
+
+type memKeyStore map[uint32][]byte
+
+// NewMemKeyStore holds a copy of keys.
+func NewMemKeyStore(keys map[uint32][]byte) KeyStore {
+	x := make(memKeyStore)
+	for vr, key := range keys {
+		x[vr] = append([]byte(nil), key...)
+	}
+	return x
+}
+
+func (x memKeyStore) Versions() ([]uint32, error) {
+	versions := make([]uint32, 0, len(x))
+	for vr := range x {
+		versions = append(versions, vr)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+func (x memKeyStore) Key(version uint32) ([]byte, error) {
+	if key, ok := x[version]; !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKeyVersion, version)
+	} else {
+		return append([]byte(nil), key...), nil
+	}
+}
+
+// keyLoader is implemented by the key stores which load all the keys at once
+// better than version by version.
+type keyLoader interface {
+	loadKeys() (map[uint32][]byte, error)
+}
+
+func loadKeyStore(ks KeyStore) (map[uint32][]byte, error) {
+	if loader, ok := ks.(keyLoader); ok {
+		return loader.loadKeys()
+	}
+	versions, err := ks.Versions()
+	if err != nil {
+		return nil, err
+	}
+	keymap := make(map[uint32][]byte)
+	for _, vr := range versions {
+		if key, err := ks.Key(vr); err != nil {
+			return nil, fmt.Errorf("key version %d: %w", vr, err)
+		} else {
+			keymap[vr] = key
+		}
+	}
+	return keymap, nil
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func TestKeyStore_FS(t *testing.T) {
+
+	keydir := filepath.Join("test", "versioned_1-2")
+	mapfs := fstest.MapFS{}
+	err := fs.WalkDir(os.DirFS(keydir), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(os.DirFS(keydir), name)
+		mapfs[name] = &fstest.MapFile{Data: data}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := LoadAesKeyMap(keydir, filepath.Join(keydir, "pwd.yaml"))
+	if err != nil {
+		t.Errorf("failed to load keys %s", err.Error())
+		return
+	}
+	for name, ks := range map[string]KeyStore{
+		"dir": NewDirKeyStore(keydir, filepath.Join(keydir, "pwd.yaml")),
+		"fs":  NewFSKeyStore(mapfs, "pwd.yaml"),
+	} {
+		if versions, err := ks.Versions(); err != nil {
+			t.Errorf("%s: failed to list %s", name, err.Error())
+			return
+		} else if !reflect.DeepEqual(versions, []uint32{0, 1}) {
+			t.Errorf("%s: Versions %v", name, versions)
+			return
+		}
+		if keymap, err := loadKeyStore(ks); err != nil {
+			t.Errorf("%s: failed to load keys %s", name, err.Error())
+			return
+		} else if !reflect.DeepEqual(keymap, expected) {
+			t.Errorf("%s: keys mismatch", name)
+			return
+		}
+		if _, err := ks.Key(2); !errors.Is(err, ErrUnknownKeyVersion) {
+			t.Errorf("%s: Should fail with ErrUnknownKeyVersion", name)
+			return
+		}
+	}
+
+	enc, _, err := NewAESCBCPKCS7ivVerEncDecWithKeyStore(NewFSKeyStore(mapfs, "pwd.yaml"))
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+	dec, err := NewAESCBCPKCS7ivVerDecrypter(keydir, filepath.Join(keydir, "pwd.yaml"))
+	if err != nil {
+		t.Errorf("failed to create decrypter %s", err.Error())
+		return
+	}
+	for size := 0; size <= 64; size++ {
+		encdeccompare(t, size, enc, dec)
+	}
+
+	delete(mapfs, "1/key.bin")
+	if _, err := NewAESCBCPKCS7ivVerEncrypterWithKeyStore(NewFSKeyStore(mapfs, "pwd.yaml")); err == nil {
+		t.Error("Should fail without key.bin")
+		return
+	}
+	if _, err := NewAESCBCPKCS7ivVerDecrypterWithKeyStore(NewFSKeyStore(mapfs, "none.yaml")); err == nil {
+		t.Error("Should fail without pwdfile")
+		return
+	}
+}
+
+// countingFS counts the opens of the password file.
+type countingFS struct {
+	fs.FS
+	mu    sync.Mutex
+	opens int
+}
+
+func (x *countingFS) Open(name string) (fs.File, error) {
+	if name == "pwd.yaml" {
+		x.mu.Lock()
+		x.opens++
+		x.mu.Unlock()
+	}
+	return x.FS.Open(name)
+}
+
+func TestKeyStore_PasswordFileOnce(t *testing.T) {
+
+	fsys := &countingFS{FS: os.DirFS(filepath.Join("test", "versioned_1-2"))}
+	ks := NewFSKeyStore(fsys, "pwd.yaml")
+	if keymap, err := loadKeyStore(ks); err != nil {
+		t.Errorf("failed to load keys %s", err.Error())
+		return
+	} else if len(keymap) != 2 {
+		t.Errorf("keys %d", len(keymap))
+		return
+	}
+	if fsys.opens != 1 {
+		t.Errorf("Password file read %d times", fsys.opens)
+		return
+	}
+
+	ring, err := NewKeyringWithKeyStore(ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys.opens = 0
+	if err := ring.Reload(); err != nil {
+		t.Errorf("failed to reload %s", err.Error())
+		return
+	}
+	if fsys.opens != 1 {
+		t.Errorf("Password file read %d times", fsys.opens)
+		return
+	}
+}
+
+func TestKeyStore_Mem(t *testing.T) {
+
+	keys := map[uint32][]byte{
+		3: bytes.Repeat([]byte{0x03}, 16),
+		7: bytes.Repeat([]byte{0x07}, 32),
+	}
+	ks := NewMemKeyStore(keys)
+	keys[3][0] = 0xff
+	keys[9] = bytes.Repeat([]byte{0x09}, 16)
+
+	if versions, err := ks.Versions(); err != nil || !reflect.DeepEqual(versions, []uint32{3, 7}) {
+		t.Errorf("Versions %v", versions)
+		return
+	}
+	if key, err := ks.Key(3); err != nil || !bytes.Equal(key, bytes.Repeat([]byte{0x03}, 16)) {
+		t.Errorf("Key %x", key)
+		return
+	} else {
+		key[0] = 0xff
+	}
+	if key, _ := ks.Key(3); key[0] != 0x03 {
+		t.Error("Key should return a copy")
+		return
+	}
+	if _, err := ks.Key(9); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Error("Should fail with ErrUnknownKeyVersion")
+		return
+	}
+
+	enc, dec, err := NewAESCBCPKCS7ivVerEncDecWithKeyStore(ks)
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+	if enc.ActiveVersion() != 7 {
+		t.Errorf("active version %d", enc.ActiveVersion())
+		return
+	}
+	for size := 0; size <= 64; size++ {
+		encdeccompare(t, size, enc, dec)
+	}
+
+	if _, err := NewAESCBCPKCS7ivVerEncrypterWithKeyStore(NewMemKeyStore(nil)); err == nil {
+		t.Error("Should fail without keys")
+		return
+	}
+	if _, err := NewAESCBCPKCS7ivVerEncrypterWithKeyStore(NewMemKeyStore(map[uint32][]byte{0: make([]byte, 20)})); err == nil {
+		t.Error("Should fail with key size 20")
+		return
+	}
+}
+
+// growingKeyStore adds a version on every call of add.
+type growingKeyStore struct {
+	mu   sync.Mutex
+	keys map[uint32][]byte
+}
+
+func (x *growingKeyStore) add(version uint32) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.keys[version] = bytes.Repeat([]byte{byte(version)}, 16)
+}
+
+func (x *growingKeyStore) Versions() ([]uint32, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return NewMemKeyStore(x.keys).Versions()
+}
+
+func (x *growingKeyStore) Key(version uint32) ([]byte, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return NewMemKeyStore(x.keys).Key(version)
+}
+
+func TestKeyStore_Reload(t *testing.T) {
+
+	ks := &growingKeyStore{keys: map[uint32][]byte{}}
+	ks.add(0)
+	ring, err := NewKeyringWithKeyStore(ks)
+	if err != nil {
+		t.Errorf("failed to create keyring %s", err.Error())
+		return
+	}
+	enc, dec := NewAESCBCPKCS7ivVerEncDecWithKeyring(ring)
+	c0 := enc.Encrypt([]byte("0123456789"))
+
+	ks.add(1)
+	if err := ring.Reload(); err != nil {
+		t.Errorf("failed to reload %s", err.Error())
+		return
+	}
+	if enc.ActiveVersion() != 1 {
+		t.Errorf("active version %d", enc.ActiveVersion())
+		return
+	}
+	if _, err := dec.Decrypt(c0); err != nil {
+		t.Errorf("failed to decrypt %s", err.Error())
+		return
+	}
+}
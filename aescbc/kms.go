@@ -0,0 +1,44 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// KMS is a key management service which keeps the key encryption keys to
+// itself, e.g. the HTTP client of package kms. Encrypt and GenerateDataKey
+// return a ciphertext which only Decrypt of the same service can open.
+// GenerateDataKey returns a new random key of size bytes, in plaintext and
+// encrypted under keyID.
+type KMS interface {
+	Encrypt(keyID string, plaintext []byte) ([]byte, error)
+	Decrypt(keyID string, ciphertext []byte) ([]byte, error)
+	GenerateDataKey(keyID string, size int) (plaintext, ciphertext []byte, err error)
+}
+
+func loadKMSKey(fsys fs.FS, aeskeyfile string, kms KMS, meta *KeyMeta) ([]byte, error) {
+	if kms == nil {
+		return nil, fmt.Errorf("Key wrapping %s requires a KMS: %s", KeyWrapKMS, aeskeyfile)
+	}
+	if data, err := fs.ReadFile(fsys, aeskeyfile); err != nil {
+		return nil, err
+	} else {
+		return kms.Decrypt(meta.KeyID, data)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// prefixKMS "encrypts" by prefixing the key ID.
+type prefixKMS struct{}
+
+func (prefixKMS) Encrypt(keyID string, plaintext []byte) ([]byte, error) {
+	return append([]byte(keyID+":"), plaintext...), nil
+}
+
+func (prefixKMS) Decrypt(keyID string, ciphertext []byte) ([]byte, error) {
+	if !bytes.HasPrefix(ciphertext, []byte(keyID+":")) {
+		return nil, ErrAuthenticationFailed
+	}
+	return ciphertext[len(keyID)+1:], nil
+}
+
+func (x prefixKMS) GenerateDataKey(keyID string, size int) ([]byte, []byte, error) {
+	key := bytes.Repeat([]byte{0x5a}, size)
+	ciphertext, err := x.Encrypt(keyID, key)
+	return key, ciphertext, err
+}
+
+func TestKeyStore_KMS(t *testing.T) {
+
+	// version 0 with privkey.pem, version 1 wrapped by the KMS
+	mapfs := fstest.MapFS{}
+	for _, name := range []string{PrivkeyFilename, AeskeyFilename} {
+		if data, err := ioutil.ReadFile(filepath.Join("test", "versioned_1-2", "0", name)); err != nil {
+			t.Fatal(err)
+		} else {
+			mapfs["0/"+name] = &fstest.MapFile{Data: data}
+		}
+	}
+	key, wrapped, _ := prefixKMS{}.GenerateDataKey("master", 32)
+	mapfs["1/"+AeskeyFilename] = &fstest.MapFile{Data: wrapped}
+	mapfs["1/"+MetaFilename] = &fstest.MapFile{Data: []byte("wrap: KMS\nkey_id: master\n")}
+
+	ks := NewFSKeyStoreWithKMS(mapfs, prefixKMS{}, NewPasswordMapSource(map[uint32]string{0: "password", 1: ""}))
+	if actual, err := ks.Key(1); err != nil || !bytes.Equal(actual, key) {
+		t.Errorf("failed to load version 1 %v", err)
+		return
+	}
+	enc, dec, err := NewAESCBCPKCS7ivVerEncDecWithKeyStore(ks)
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+	for size := 0; size <= 64; size++ {
+		encdeccompare(t, size, enc, dec)
+	}
+
+	// the KMS version alone needs no password
+	if actual, err := NewFSKeyStoreWithKMS(mapfs, prefixKMS{}, nil).Key(1); err != nil || !bytes.Equal(actual, key) {
+		t.Errorf("failed to load version 1 %v", err)
+		return
+	}
+}
+
+func TestKeyStore_KMSErrorCase(t *testing.T) {
+
+	mapfs := fstest.MapFS{
+		"0/" + PrivkeyFilename: &fstest.MapFile{Data: []byte("")},
+		"1/" + AeskeyFilename:  &fstest.MapFile{Data: []byte("other:0123456789abcdef")},
+		"1/" + MetaFilename:    &fstest.MapFile{Data: []byte("wrap: KMS\nkey_id: master\n")},
+	}
+	if _, err := NewFSKeyStoreWithKMS(mapfs, prefixKMS{}, nil).Key(1); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("Should fail with the KMS")
+		return
+	}
+	if _, err := NewFSKeyStoreWithKMS(mapfs, nil, nil).Key(1); err == nil {
+		t.Error("Should fail without KMS")
+		return
+	}
+	if _, err := NewFSKeyStoreWithKMS(mapfs, prefixKMS{}, nil).Key(0); err == nil {
+		t.Error("Should fail without password source")
+		return
+	}
+	delete(mapfs, "1/"+AeskeyFilename)
+	if _, err := NewFSKeyStoreWithKMS(mapfs, prefixKMS{}, nil).Key(1); err == nil {
+		t.Error("Should fail without key.bin")
+		return
+	}
+}
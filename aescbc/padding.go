@@ -17,9 +17,53 @@
 package aescbc
 
 import (
-	"fmt"
+	"crypto/subtle"
+	"io"
 )
 
+// Padding fills the last block before encryption and removes the filling
+// after decryption. Verify returns the size of the data without padding, and
+// ErrInvalidPadding if the padding is malformed.
+type Padding interface {
+	CalcDstSize(blockSize int, src []byte) int
+	Fill(blockSize int, dst, src []byte) error
+	Verify(blockSize int, src []byte) (int, error)
+}
+
+var (
+	// PKCS7Padding fills with n bytes of value n. (RFC 5652)
+	PKCS7Padding Padding = pkcs7Padding{}
+	// ANSIX923Padding fills with zeros and ends with the padding size.
+	ANSIX923Padding Padding = ansix923Padding{}
+	// ISO10126Padding fills with random bytes and ends with the padding size.
+	// See also NewISO10126Padding.
+	ISO10126Padding Padding = iso10126Padding{}
+	// ISO7816Padding fills with 0x80 followed by zeros. (ISO/IEC 7816-4)
+	ISO7816Padding Padding = iso7816Padding{}
+	// ZeroPadding fills with zeros, adding nothing to non-empty data of a
+	// whole number of blocks. Trailing zeros of the data cannot be told from
+	// the padding and are removed too.
+	ZeroPadding Padding = zeroPadding{}
+)
+
+type pkcs7Padding struct{}
+
+// NewISO10126Padding returns ISO 10126 padding which reads the random filling
+// from rng instead of crypto/rand.
+func NewISO10126Padding(rng io.Reader) Padding {
+	return iso10126Padding{rng}
+}
+
+type ansix923Padding struct{}
+
+type iso10126Padding struct {
+	rng io.Reader
+}
+
+type iso7816Padding struct{}
+
+type zeroPadding struct{}
+
 func addPaddingByPKCS7(blockSize int, src []byte) []byte {
 	dst := make([]byte, calcDstSizeForPaddingByPKCS7(blockSize, src))
 	fillPaddingByPKCS7(blockSize, dst, src)
@@ -46,19 +90,147 @@ func removePaddingByPKCS7(blockSize int, src []byte) ([]byte, error) {
 	}
 }
 
+// verifyPaddingByPKCS7 checks the padding in constant time over the last block
+// and returns the size of the data without padding. Every failure is reported
+// as ErrInvalidPadding so that callers cannot tell the reasons apart.
 func verifyPaddingByPKCS7(blockSize int, src []byte) (int, error) {
-	if len(src)%blockSize != 0 {
-		return -1, fmt.Errorf("Invalid data size %d for blockSize %d", len(src), blockSize)
+	if len(src) < blockSize || len(src)%blockSize != 0 {
+		return -1, ErrInvalidPadding
+	}
+	last := src[len(src)-blockSize:]
+	padding := int(last[blockSize-1])
+	good := subtle.ConstantTimeLessOrEq(1, padding) & subtle.ConstantTimeLessOrEq(padding, blockSize)
+	for i, b := range last {
+		inPadding := subtle.ConstantTimeLessOrEq(blockSize-i, padding)
+		good &= subtle.ConstantTimeByteEq(b, byte(padding)) | (inPadding ^ 1)
+	}
+	if good != 1 {
+		return -1, ErrInvalidPadding
+	}
+	return len(src) - padding, nil
+}
+
+func (pkcs7Padding) CalcDstSize(blockSize int, src []byte) int {
+	return calcDstSizeForPaddingByPKCS7(blockSize, src)
+}
+
+func (pkcs7Padding) Fill(blockSize int, dst, src []byte) error {
+	fillPaddingByPKCS7(blockSize, dst, src)
+	return nil
+}
+
+func (pkcs7Padding) Verify(blockSize int, src []byte) (int, error) {
+	return verifyPaddingByPKCS7(blockSize, src)
+}
+
+func (ansix923Padding) CalcDstSize(blockSize int, src []byte) int {
+	return calcDstSizeForPaddingByPKCS7(blockSize, src)
+}
+
+func (ansix923Padding) Fill(blockSize int, dst, src []byte) error {
+	copy(dst, src)
+	for i := len(src); i < len(dst)-1; i++ {
+		dst[i] = 0x00
+	}
+	dst[len(dst)-1] = byte(len(dst) - len(src))
+	return nil
+}
+
+func (ansix923Padding) Verify(blockSize int, src []byte) (int, error) {
+	if len(src) < blockSize || len(src)%blockSize != 0 {
+		return -1, ErrInvalidPadding
+	}
+	last := src[len(src)-blockSize:]
+	padding := int(last[blockSize-1])
+	good := subtle.ConstantTimeLessOrEq(1, padding) & subtle.ConstantTimeLessOrEq(padding, blockSize)
+	for i, b := range last[:blockSize-1] {
+		inPadding := subtle.ConstantTimeLessOrEq(blockSize-i, padding)
+		good &= subtle.ConstantTimeByteEq(b, 0x00) | (inPadding ^ 1)
+	}
+	if good != 1 {
+		return -1, ErrInvalidPadding
 	}
-	padding := src[len(src)-1]
-	if len(src) < int(padding) {
-		return -1, fmt.Errorf("Invalid padding 0x%x for data size %d", padding, len(src))
+	return len(src) - padding, nil
+}
+
+func (iso10126Padding) CalcDstSize(blockSize int, src []byte) int {
+	return calcDstSizeForPaddingByPKCS7(blockSize, src)
+}
+
+func (x iso10126Padding) Fill(blockSize int, dst, src []byte) error {
+	copy(dst, src)
+	if _, err := io.ReadFull(randReader(x.rng), dst[len(src):len(dst)-1]); err != nil {
+		return err
+	}
+	dst[len(dst)-1] = byte(len(dst) - len(src))
+	return nil
+}
+
+func (iso10126Padding) Verify(blockSize int, src []byte) (int, error) {
+	if len(src) < blockSize || len(src)%blockSize != 0 {
+		return -1, ErrInvalidPadding
+	}
+	padding := int(src[len(src)-1])
+	good := subtle.ConstantTimeLessOrEq(1, padding) & subtle.ConstantTimeLessOrEq(padding, blockSize)
+	if good != 1 {
+		return -1, ErrInvalidPadding
+	}
+	return len(src) - padding, nil
+}
+
+func (iso7816Padding) CalcDstSize(blockSize int, src []byte) int {
+	return calcDstSizeForPaddingByPKCS7(blockSize, src)
+}
+
+func (iso7816Padding) Fill(blockSize int, dst, src []byte) error {
+	copy(dst, src)
+	dst[len(src)] = 0x80
+	for i := len(src) + 1; i < len(dst); i++ {
+		dst[i] = 0x00
+	}
+	return nil
+}
+
+func (iso7816Padding) Verify(blockSize int, src []byte) (int, error) {
+	if len(src) < blockSize || len(src)%blockSize != 0 {
+		return -1, ErrInvalidPadding
+	}
+	last := src[len(src)-blockSize:]
+	good, found, pos := 1, 0, 0
+	for i := blockSize - 1; i >= 0; i-- {
+		isMark := subtle.ConstantTimeByteEq(last[i], 0x80)
+		good &= found | isMark | subtle.ConstantTimeByteEq(last[i], 0x00)
+		pos = subtle.ConstantTimeSelect(isMark&(found^1), i, pos)
+		found |= isMark
+	}
+	if good&found != 1 {
+		return -1, ErrInvalidPadding
+	}
+	return len(src) - blockSize + pos, nil
+}
+
+func (zeroPadding) CalcDstSize(blockSize int, src []byte) int {
+	if len(src) > 0 && len(src)%blockSize == 0 {
+		return len(src)
+	}
+	return calcDstSizeForPaddingByPKCS7(blockSize, src)
+}
+
+func (zeroPadding) Fill(blockSize int, dst, src []byte) error {
+	copy(dst, src)
+	for i := len(src); i < len(dst); i++ {
+		dst[i] = 0x00
+	}
+	return nil
+}
+
+func (zeroPadding) Verify(blockSize int, src []byte) (int, error) {
+	if len(src) < blockSize || len(src)%blockSize != 0 {
+		return -1, ErrInvalidPadding
 	}
-	dstSize := len(src) - int(padding)
-	for i, b := range src[dstSize:] {
-		if b != padding {
-			return -1, fmt.Errorf("Invalid padding 0x%x (at %dth)", b, i)
-		}
+	size := len(src)
+	for size > len(src)-blockSize && src[size-1] == 0x00 {
+		size--
 	}
-	return dstSize, nil
+	return size, nil
 }
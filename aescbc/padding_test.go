@@ -17,6 +17,7 @@
 package aescbc
 
 import (
+	"bytes"
 	"crypto/rand"
 	"testing"
 )
@@ -70,7 +71,7 @@ func TestPaddingByPKCS7_ErrorCase(t *testing.T) {
 		mid := addPaddingByPKCS7(blockSize, src)
 
 		for j := 1; j < blockSize; j++ {
-			if _, err := removePaddingByPKCS7(blockSize, mid[:len(mid)-j]); err == nil {
+			if _, err := removePaddingByPKCS7(blockSize, mid[:len(mid)-j]); err != ErrInvalidPadding {
 				t.Errorf("Should fail")
 				return
 			}
@@ -78,16 +79,170 @@ func TestPaddingByPKCS7_ErrorCase(t *testing.T) {
 
 		padSize := mid[len(mid)-1]
 		mid[len(mid)-1] = byte(len(mid) + 1)
-		if _, err := removePaddingByPKCS7(blockSize, mid); err == nil {
+		if _, err := removePaddingByPKCS7(blockSize, mid); err != ErrInvalidPadding {
 			t.Errorf("Should fail")
 			return
 		}
 
 		mid[len(mid)-1] = padSize
 		mid[len(mid)-int(padSize)] = padSize + 1
-		if _, err := removePaddingByPKCS7(blockSize, mid); err == nil {
+		if padSize == 1 && mid[len(mid)-2] == padSize+1 {
+			mid[len(mid)-2] = padSize + 2
+		}
+		if _, err := removePaddingByPKCS7(blockSize, mid); err != ErrInvalidPadding {
 			t.Errorf("Should fail")
 			return
 		}
 	}
 }
+
+func TestPaddingByPKCS7_ErrorCase2(t *testing.T) {
+	blockSize := 16
+
+	if _, err := removePaddingByPKCS7(blockSize, nil); err != ErrInvalidPadding {
+		t.Errorf("Should fail with ErrInvalidPadding")
+		return
+	}
+
+	for padding := 0; padding < 256; padding++ {
+		src := make([]byte, 2*blockSize)
+		rand.Read(src)
+		src[len(src)-1] = byte(padding)
+		if padding >= 1 && padding <= blockSize {
+			copy(src[len(src)-padding:], bytes.Repeat([]byte{byte(padding)}, padding))
+			if dst, err := removePaddingByPKCS7(blockSize, src); err != nil {
+				t.Errorf("Error %s for padding %d", err.Error(), padding)
+				return
+			} else if len(dst) != len(src)-padding {
+				t.Errorf("Data size %d for padding %d", len(dst), padding)
+				return
+			}
+		} else {
+			copy(src[len(src)-blockSize:], bytes.Repeat([]byte{byte(padding)}, blockSize))
+			if _, err := removePaddingByPKCS7(blockSize, src); err != ErrInvalidPadding {
+				t.Errorf("Should fail with ErrInvalidPadding for padding %d", padding)
+				return
+			}
+		}
+	}
+}
+
+func TestPadding_1(t *testing.T) {
+	blockSize := 16
+	maxLen := 512
+	paddings := map[string]Padding{
+		"PKCS7":    PKCS7Padding,
+		"ANSIX923": ANSIX923Padding,
+		"ISO10126": ISO10126Padding,
+		"ISO7816":  ISO7816Padding,
+		"Zero":     ZeroPadding,
+	}
+	for name, p := range paddings {
+		for i := 0; i < maxLen; i++ {
+
+			src := make([]byte, i)
+			rand.Read(src)
+			if i > 0 && src[i-1] == 0x00 {
+				src[i-1] = 0x01
+			}
+
+			mid := make([]byte, p.CalcDstSize(blockSize, src))
+			if len(mid) == 0 || len(mid)%blockSize != 0 {
+				t.Errorf("%s: Padded size is %d", name, len(mid))
+				return
+			}
+			if err := p.Fill(blockSize, mid, src); err != nil {
+				t.Errorf("%s: Error %s", name, err.Error())
+				return
+			}
+			if !bytes.Equal(src, mid[:len(src)]) {
+				t.Errorf("%s: Mid mismatch", name)
+				return
+			}
+
+			if size, err := p.Verify(blockSize, mid); err != nil {
+				t.Errorf("%s: Error %s", name, err.Error())
+				return
+			} else if size != len(src) {
+				t.Errorf("%s: Data size src %d and dst %d", name, len(src), size)
+				return
+			}
+		}
+	}
+}
+
+func TestPadding_2(t *testing.T) {
+	blockSize := 8
+	src := []byte{0xdd, 0xdd, 0xdd, 0xdd, 0xdd}
+	expected := map[string][]byte{
+		"PKCS7":    {0xdd, 0xdd, 0xdd, 0xdd, 0xdd, 0x03, 0x03, 0x03},
+		"ANSIX923": {0xdd, 0xdd, 0xdd, 0xdd, 0xdd, 0x00, 0x00, 0x03},
+		"ISO7816":  {0xdd, 0xdd, 0xdd, 0xdd, 0xdd, 0x80, 0x00, 0x00},
+		"Zero":     {0xdd, 0xdd, 0xdd, 0xdd, 0xdd, 0x00, 0x00, 0x00},
+	}
+	paddings := map[string]Padding{
+		"PKCS7":    PKCS7Padding,
+		"ANSIX923": ANSIX923Padding,
+		"ISO7816":  ISO7816Padding,
+		"Zero":     ZeroPadding,
+	}
+	for name, p := range paddings {
+		dst := make([]byte, p.CalcDstSize(blockSize, src))
+		p.Fill(blockSize, dst, src)
+		if !bytes.Equal(expected[name], dst) {
+			t.Errorf("%s: %x", name, dst)
+			return
+		}
+	}
+
+	dst := make([]byte, ISO10126Padding.CalcDstSize(blockSize, src))
+	ISO10126Padding.Fill(blockSize, dst, src)
+	if !bytes.Equal(src, dst[:5]) || dst[7] != 0x03 {
+		t.Errorf("ISO10126: %x", dst)
+		return
+	}
+
+	if size := ZeroPadding.CalcDstSize(blockSize, make([]byte, blockSize)); size != blockSize {
+		t.Errorf("Zero: Padded size is %d", size)
+		return
+	}
+}
+
+func TestPadding_ErrorCase(t *testing.T) {
+	blockSize := 16
+	invalid := map[string][][]byte{
+		"ANSIX923": {
+			append(bytes.Repeat([]byte{0x00}, 15), 0x00),
+			append(bytes.Repeat([]byte{0x00}, 15), 0x11),
+			append(append(bytes.Repeat([]byte{0x00}, 12), 0x01, 0x00, 0x00), 0x04),
+		},
+		"ISO10126": {
+			append(bytes.Repeat([]byte{0x00}, 15), 0x00),
+			append(bytes.Repeat([]byte{0x00}, 15), 0x11),
+		},
+		"ISO7816": {
+			bytes.Repeat([]byte{0x00}, 16),
+			append(bytes.Repeat([]byte{0x00}, 15), 0x01),
+			append(append(bytes.Repeat([]byte{0x00}, 13), 0x80, 0x01), 0x00),
+		},
+	}
+	paddings := map[string]Padding{
+		"ANSIX923": ANSIX923Padding,
+		"ISO10126": ISO10126Padding,
+		"ISO7816":  ISO7816Padding,
+	}
+	for name, p := range paddings {
+		for i, src := range invalid[name] {
+			if _, err := p.Verify(blockSize, src); err != ErrInvalidPadding {
+				t.Errorf("%s: Should fail with ErrInvalidPadding %d", name, i)
+				return
+			}
+		}
+		for _, size := range []int{0, 15, 17} {
+			if _, err := p.Verify(blockSize, make([]byte, size)); err != ErrInvalidPadding {
+				t.Errorf("%s: Should fail with ErrInvalidPadding for size %d", name, size)
+				return
+			}
+		}
+	}
+}
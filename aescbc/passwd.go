@@ -0,0 +1,238 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// PasswordSource gives the password of the private key of a version, where
+// an empty password is for an unencrypted private key.
+//
+// A PasswordSource which also has "Versions() ([]uint32, error)", as the
+// password file and the password map do, lists the versions of a key
+// directory. With the other sources every subdirectory named by a version
+// number is a version.
+type PasswordSource interface {
+	Password(version uint32) (string, error)
+}
+
+type versionLister interface {
+	Versions() ([]uint32, error)
+}
+
+// passwordForgetter is implemented by the sources which keep the passwords.
+// The key stores call forget when the password of a version fails to decrypt
+// its private key, so that it is asked again.
+type passwordForgetter interface {
+	forget(version uint32)
+}
+
+type passwdFile struct {
+	fsys fs.FS
+	name string
+}
+
+// NewPasswordFileSource reads pwdfile, YAML or JSON (by the suffix .json)
+// mapping versions to passwords, on every (re)load.
+func NewPasswordFileSource(pwdfile string) PasswordSource {
+	return &passwdFile{os.DirFS(filepath.Dir(pwdfile)), filepath.Base(pwdfile)}
+}
+
+func (x *passwdFile) passwdMap() (passwdMap, error) {
+	if data, err := fs.ReadFile(x.fsys, x.name); err != nil {
+		return nil, err
+	} else {
+		return ParsePasswdMap(x.name, data)
+	}
+}
+
+func (x *passwdFile) Versions() ([]uint32, error) {
+	if pwdmap, err := x.passwdMap(); err != nil {
+		return nil, err
+	} else {
+		return pwdmap.Versions()
+	}
+}
+
+func (x *passwdFile) Password(version uint32) (string, error) {
+	if pwdmap, err := x.passwdMap(); err != nil {
+		return "", err
+	} else {
+		return pwdmap.Password(version)
+	}
+}
+
+type passwdMap map[uint32]string
+
+// NewPasswordMapSource holds a copy of pwdmap.
+func NewPasswordMapSource(pwdmap map[uint32]string) PasswordSource {
+	x := make(passwdMap)
+	for vr, pw := range pwdmap {
+		x[vr] = pw
+	}
+	return x
+}
+
+func (x passwdMap) Versions() ([]uint32, error) {
+	versions := make([]uint32, 0, len(x))
+	for vr := range x {
+		versions = append(versions, vr)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+func (x passwdMap) Password(version uint32) (string, error) {
+	if pw, ok := x[version]; !ok {
+		return "", fmt.Errorf("%w: %d", ErrUnknownKeyVersion, version)
+	} else {
+		return pw, nil
+	}
+}
+
+type envPasswd string
+
+// NewEnvPasswordSource reads the password of a version from the environment
+// variable named by format with the version, e.g. "KEY_PASSWORD_%d". A set
+// but empty variable is an empty password.
+func NewEnvPasswordSource(format string) PasswordSource {
+	return envPasswd(format)
+}
+
+func (x envPasswd) Password(version uint32) (string, error) {
+	name := fmt.Sprintf(string(x), version)
+	if pw, ok := os.LookupEnv(name); !ok {
+		return "", fmt.Errorf("No password for key version %d in $%s", version, name)
+	} else {
+		return pw, nil
+	}
+}
+
+type secretFilePasswd struct {
+	dir    string
+	format string
+}
+
+// NewSecretFilePasswordSource reads the password of a version from the file
+// in dir named by format with the version, as mounted by Docker or
+// Kubernetes secrets, e.g. ("/run/secrets", "key-password-%d"). A trailing
+// newline is removed.
+func NewSecretFilePasswordSource(dir, format string) PasswordSource {
+	return &secretFilePasswd{dir, format}
+}
+
+func (x *secretFilePasswd) Password(version uint32) (string, error) {
+	if data, err := os.ReadFile(filepath.Join(x.dir, fmt.Sprintf(x.format, version))); err != nil {
+		return "", err
+	} else {
+		return trimNewline(string(data)), nil
+	}
+}
+
+type commandPasswd struct {
+	name string
+	args []string
+}
+
+// NewCommandPasswordSource runs the command name with args and the version
+// as the last argument, and reads the password from its standard output. A
+// trailing newline is removed.
+func NewCommandPasswordSource(name string, args ...string) PasswordSource {
+	return &commandPasswd{name, append([]string(nil), args...)}
+}
+
+func (x *commandPasswd) Password(version uint32) (string, error) {
+	args := append(append([]string(nil), x.args...), strconv.FormatUint(uint64(version), 10))
+	out, err := exec.Command(x.name, args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("Password command %s failed for key version %d: %w: %s", x.name, version, err, bytes.TrimSpace(exitErr.Stderr))
+		}
+		return "", fmt.Errorf("Password command %s failed for key version %d: %w", x.name, version, err)
+	}
+	return trimNewline(string(out)), nil
+}
+
+type promptPasswd struct {
+	mu     sync.Mutex
+	in     *os.File
+	out    io.Writer
+	reader *bufio.Reader
+	cache  map[uint32]string
+}
+
+// NewPromptPasswordSource asks for the password of a version on out and
+// reads it from in, without echo if in is a terminal, e.g.
+// (os.Stdin, os.Stderr). Every version is asked only once, and its password
+// is kept for the later reloads unless it fails to decrypt the private key.
+func NewPromptPasswordSource(in *os.File, out io.Writer) PasswordSource {
+	return &promptPasswd{in: in, out: out, reader: bufio.NewReader(in), cache: make(map[uint32]string)}
+}
+
+func (x *promptPasswd) Password(version uint32) (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if pw, ok := x.cache[version]; ok {
+		return pw, nil
+	}
+
+	fmt.Fprintf(x.out, "Password for key version %d: ", version)
+	var pw string
+	if fd := int(x.in.Fd()); term.IsTerminal(fd) {
+		data, err := term.ReadPassword(fd)
+		fmt.Fprintln(x.out)
+		if err != nil {
+			return "", err
+		}
+		pw = string(data)
+	} else {
+		line, err := x.reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", fmt.Errorf("No password for key version %d: %w", version, err)
+		}
+		pw = trimNewline(line)
+	}
+	x.cache[version] = pw
+	return pw, nil
+}
+
+func (x *promptPasswd) forget(version uint32) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.cache, version)
+}
+
+func trimNewline(s string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(s, "\n"), "\r")
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPasswordSource_1(t *testing.T) {
+
+	// test/versioned_1-2/pwd.yaml
+	expected := map[uint32]string{0: "password", 1: ""}
+
+	t.Setenv("TEST_KEY_PASSWORD_0", "password")
+	t.Setenv("TEST_KEY_PASSWORD_1", "")
+
+	secrets := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(secrets, "key-password-0"), []byte("password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(secrets, "key-password-1"), []byte(""), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	prompt, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prompt.Close()
+	w.WriteString("password\r\n\n")
+	w.Close()
+	var out bytes.Buffer
+
+	sources := map[string]PasswordSource{
+		"file":    NewPasswordFileSource(filepath.Join("test", "versioned_1-2", "pwd.yaml")),
+		"map":     NewPasswordMapSource(expected),
+		"env":     NewEnvPasswordSource("TEST_KEY_PASSWORD_%d"),
+		"secret":  NewSecretFilePasswordSource(secrets, "key-password-%d"),
+		"command": NewCommandPasswordSource("sh", "-c", `if [ "$1" = 0 ]; then echo password; fi`, "sh"),
+		"prompt":  NewPromptPasswordSource(prompt, &out),
+	}
+	for _, name := range []string{"file", "map", "env", "secret", "command", "prompt"} {
+		for _, vr := range []uint32{0, 1} {
+			if actual, err := sources[name].Password(vr); err != nil {
+				t.Errorf("%s: failed to get password %s", name, err.Error())
+				return
+			} else if actual != expected[vr] {
+				t.Errorf("%s: version %d password %q", name, vr, actual)
+				return
+			}
+		}
+	}
+
+	// the prompt asks every version only once
+	if pw, err := sources["prompt"].Password(0); err != nil || pw != "password" {
+		t.Errorf("prompt: version 0 password %q", pw)
+		return
+	}
+	if out.String() != "Password for key version 0: Password for key version 1: " {
+		t.Errorf("prompt: %q", out.String())
+		return
+	}
+
+	keydir := filepath.Join("test", "versioned_1-2")
+	keymap, err := LoadAesKeyMap(keydir, filepath.Join(keydir, "pwd.yaml"))
+	if err != nil {
+		t.Errorf("failed to load keys %s", err.Error())
+		return
+	}
+	for _, name := range []string{"map", "env", "command", "prompt"} {
+		ks := NewDirKeyStoreWithPasswordSource(keydir, sources[name])
+		if actual, err := loadKeyStore(ks); err != nil {
+			t.Errorf("%s: failed to load keys %s", name, err.Error())
+			return
+		} else if !reflect.DeepEqual(actual, keymap) {
+			t.Errorf("%s: keys mismatch", name)
+			return
+		}
+	}
+
+	enc, dec, err := NewAESCBCPKCS7ivVerEncDecWithKeyStore(NewDirKeyStoreWithPasswordSource(keydir, sources["env"]))
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+	if enc.ActiveVersion() != 1 {
+		t.Errorf("active version %d", enc.ActiveVersion())
+		return
+	}
+	for size := 0; size <= 64; size++ {
+		encdeccompare(t, size, enc, dec)
+	}
+}
+
+func TestPasswordSource_ErrorCase(t *testing.T) {
+
+	if _, err := NewPasswordFileSource(filepath.Join("test", "none.yaml")).Password(0); err == nil {
+		t.Error("file: Should fail without the file")
+		return
+	}
+	if _, err := NewPasswordMapSource(map[uint32]string{0: ""}).Password(1); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Error("map: Should fail with ErrUnknownKeyVersion")
+		return
+	}
+	os.Unsetenv("TEST_KEY_PASSWORD_9")
+	if _, err := NewEnvPasswordSource("TEST_KEY_PASSWORD_%d").Password(9); err == nil || !strings.Contains(err.Error(), "TEST_KEY_PASSWORD_9") {
+		t.Errorf("env: Should fail without the variable %v", err)
+		return
+	}
+	if _, err := NewSecretFilePasswordSource(t.TempDir(), "key-password-%d").Password(0); err == nil {
+		t.Error("secret: Should fail without the file")
+		return
+	}
+	if _, err := NewCommandPasswordSource("sh", "-c", "echo denied >&2; exit 1", "sh").Password(0); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("command: Should fail with the output %v", err)
+		return
+	}
+
+	prompt, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prompt.Close()
+	w.Close()
+	if _, err := NewPromptPasswordSource(prompt, ioutil.Discard).Password(0); err == nil {
+		t.Error("prompt: Should fail at EOF")
+		return
+	}
+
+	// a mistyped password is asked again
+	prompt, w, err = os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prompt.Close()
+	w.WriteString("wrong\npassword\n")
+	w.Close()
+	ks := NewDirKeyStoreWithPasswordSource(filepath.Join("test", "versioned_1-2"), NewPromptPasswordSource(prompt, ioutil.Discard))
+	if _, err := ks.Key(0); err == nil {
+		t.Error("prompt: Should fail with a wrong password")
+		return
+	}
+	if _, err := ks.Key(0); err != nil {
+		t.Errorf("prompt: failed to load with the password asked again %s", err.Error())
+		return
+	}
+
+	// wrong password, and a version without its directory
+	keydir := filepath.Join("test", "versioned_1-2")
+	if _, err := loadKeyStore(NewDirKeyStoreWithPasswordSource(keydir, NewPasswordMapSource(map[uint32]string{0: "wrong", 1: ""}))); err == nil {
+		t.Error("Should fail with a wrong password")
+		return
+	}
+	if _, err := NewDirKeyStoreWithPasswordSource(keydir, NewPasswordMapSource(nil)).Key(0); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Error("Should fail with ErrUnknownKeyVersion")
+		return
+	}
+	if _, err := NewDirKeyStoreWithPasswordSource(keydir, NewEnvPasswordSource("TEST_KEY_PASSWORD_%d")).Key(2); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Error("Should fail with ErrUnknownKeyVersion")
+		return
+	}
+}
@@ -0,0 +1,326 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Password-based encryption: every message is encrypted with a key derived
+// from the password and a new random salt, with the HMAC mode of
+// NewAESCBCPKCS7HMACEncrypter.
+// The output is "format version 1 (1B) + KDF ID (1B) + KDF parameters +
+// salt length (1B) + salt + IV + ciphertext + tag", all big-endian, where the
+// KDF parameters are
+//
+//	PBKDF2-HMAC-SHA256: iterations (4B)
+//	scrypt:             log2 N (1B) + r (1B) + p (1B)
+//	Argon2id:           iterations (4B) + memory in KiB (4B) + threads (1B)
+//
+// The header is authenticated as the associated data of the HMAC mode.
+
+// KDFs of password-based encryption. The IDs are stored in ciphertexts, so
+// they are never reused.
+const (
+	KDFPBKDF2SHA256 uint8 = 1
+	KDFScrypt       uint8 = 2
+	KDFArgon2id     uint8 = 3
+)
+
+const (
+	pbeFormatVersion = 1
+	pbeSaltSize      = 16
+	pbeKeySize       = 32
+
+	// bounds of any parameters; a decrypter accepts only those within its
+	// limits, the Default*Params unless given
+	maxPBKDF2Iterations = 10000000
+	maxArgon2Iterations = 100
+	maxScryptP          = 16
+	maxKDFMemory        = 1 << 30
+)
+
+// PasswordParams selects the KDF of password-based encryption and its cost.
+// Iterations is of PBKDF2-HMAC-SHA256 and Argon2id, Memory (KiB) and Threads
+// are of Argon2id, and LogN, R and P are of scrypt (N = 2^LogN).
+type PasswordParams struct {
+	KDF        uint8
+	Iterations uint32
+	Memory     uint32
+	Threads    uint8
+	LogN       uint8
+	R          uint8
+	P          uint8
+}
+
+// Recommended parameters as of OWASP and RFC 9106.
+var (
+	DefaultPBKDF2Params   = PasswordParams{KDF: KDFPBKDF2SHA256, Iterations: 600000}
+	DefaultScryptParams   = PasswordParams{KDF: KDFScrypt, LogN: 17, R: 8, P: 1}
+	DefaultArgon2idParams = PasswordParams{KDF: KDFArgon2id, Iterations: 3, Memory: 64 * 1024, Threads: 4}
+)
+
+func (p *PasswordParams) validate() error {
+	switch p.KDF {
+	case KDFPBKDF2SHA256:
+		if p.Iterations < 1 || p.Iterations > maxPBKDF2Iterations {
+			return fmt.Errorf("Invalid PBKDF2 iterations %d", p.Iterations)
+		}
+	case KDFScrypt:
+		if p.LogN < 1 || p.LogN > 30 || p.R < 1 || p.P < 1 || p.P > maxScryptP || 128*uint64(p.R)<<p.LogN > maxKDFMemory {
+			return fmt.Errorf("Invalid scrypt parameters N=2^%d r=%d p=%d", p.LogN, p.R, p.P)
+		}
+	case KDFArgon2id:
+		if p.Iterations < 1 || p.Iterations > maxArgon2Iterations || p.Threads < 1 ||
+			p.Memory < 8*uint32(p.Threads) || uint64(p.Memory)*1024 > maxKDFMemory {
+			return fmt.Errorf("Invalid Argon2id parameters t=%d m=%d p=%d", p.Iterations, p.Memory, p.Threads)
+		}
+	default:
+		return fmt.Errorf("Unknown KDF %d", p.KDF)
+	}
+	return nil
+}
+
+// within tells whether p costs no more than limit of the same KDF.
+func (p *PasswordParams) within(limit PasswordParams) bool {
+	switch p.KDF {
+	case KDFPBKDF2SHA256:
+		return p.Iterations <= limit.Iterations
+	case KDFScrypt:
+		return p.LogN <= limit.LogN && p.R <= limit.R && p.P <= limit.P
+	case KDFArgon2id:
+		return p.Iterations <= limit.Iterations && p.Memory <= limit.Memory && p.Threads <= limit.Threads
+	default:
+		return false
+	}
+}
+
+// passwordLimits returns the limits of the parameters of each KDF, which are
+// the Default*Params unless given in limits.
+func passwordLimits(limits []PasswordParams) map[uint8]PasswordParams {
+	m := map[uint8]PasswordParams{
+		KDFPBKDF2SHA256: DefaultPBKDF2Params,
+		KDFScrypt:       DefaultScryptParams,
+		KDFArgon2id:     DefaultArgon2idParams,
+	}
+	for _, p := range limits {
+		m[p.KDF] = p
+	}
+	return m
+}
+
+func (p *PasswordParams) deriveKey(password, salt []byte) ([]byte, error) {
+	switch p.KDF {
+	case KDFPBKDF2SHA256:
+		return pbkdf2.Key(password, salt, int(p.Iterations), pbeKeySize, sha256.New), nil
+	case KDFScrypt:
+		return scrypt.Key(password, salt, 1<<p.LogN, int(p.R), int(p.P), pbeKeySize)
+	case KDFArgon2id:
+		return argon2.IDKey(password, salt, p.Iterations, p.Memory, p.Threads, pbeKeySize), nil
+	default:
+		return nil, fmt.Errorf("Unknown KDF %d", p.KDF)
+	}
+}
+
+func (p *PasswordParams) marshal(dst []byte) []byte {
+	dst = append(dst, pbeFormatVersion, p.KDF)
+	switch p.KDF {
+	case KDFPBKDF2SHA256:
+		dst = binary.BigEndian.AppendUint32(dst, p.Iterations)
+	case KDFScrypt:
+		dst = append(dst, p.LogN, p.R, p.P)
+	case KDFArgon2id:
+		dst = binary.BigEndian.AppendUint32(dst, p.Iterations)
+		dst = binary.BigEndian.AppendUint32(dst, p.Memory)
+		dst = append(dst, p.Threads)
+	}
+	return dst
+}
+
+// parsePasswordHeader returns the parameters and the salt of src, and the
+// size of the header. Parameters beyond limits are rejected before any key is
+// derived with them.
+func parsePasswordHeader(src []byte, limits map[uint8]PasswordParams) (*PasswordParams, []byte, int, error) {
+	if len(src) < 2 {
+		return nil, nil, -1, fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(src))
+	}
+	if src[0] != pbeFormatVersion {
+		return nil, nil, -1, fmt.Errorf("Unknown format version %d", src[0])
+	}
+	p := &PasswordParams{KDF: src[1]}
+	var size int
+	switch p.KDF {
+	case KDFPBKDF2SHA256:
+		size = 2 + 4
+	case KDFScrypt:
+		size = 2 + 3
+	case KDFArgon2id:
+		size = 2 + 9
+	default:
+		return nil, nil, -1, fmt.Errorf("Unknown KDF %d", p.KDF)
+	}
+	if len(src) < size+1 || len(src) < size+1+int(src[size]) {
+		return nil, nil, -1, fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(src))
+	}
+	switch p.KDF {
+	case KDFPBKDF2SHA256:
+		p.Iterations = binary.BigEndian.Uint32(src[2:6])
+	case KDFScrypt:
+		p.LogN, p.R, p.P = src[2], src[3], src[4]
+	case KDFArgon2id:
+		p.Iterations = binary.BigEndian.Uint32(src[2:6])
+		p.Memory = binary.BigEndian.Uint32(src[6:10])
+		p.Threads = src[10]
+	}
+	if err := p.validate(); err != nil {
+		return nil, nil, -1, err
+	}
+	if !p.within(limits[p.KDF]) {
+		return nil, nil, -1, fmt.Errorf("%w: %+v", ErrKDFLimitExceeded, *p)
+	}
+	salt := src[size+1 : size+1+int(src[size])]
+	return p, salt, size + 1 + len(salt), nil
+}
+
+// pbe derives the key of every message from password.
+type pbe struct {
+	password []byte
+	params   PasswordParams
+	limits   map[uint8]PasswordParams
+	rng      io.Reader
+}
+
+func (x *pbe) Encrypt(src []byte) []byte {
+	return MustEncrypt(x.TryEncrypt(src))
+}
+
+func (x *pbe) TryEncrypt(src []byte) ([]byte, error) {
+	return x.EncryptWithAAD(src, nil)
+}
+
+func (x *pbe) EncryptWithAAD(src, aad []byte) ([]byte, error) {
+
+	salt := make([]byte, pbeSaltSize)
+	if _, err := io.ReadFull(randReader(x.rng), salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	header := append(x.params.marshal(nil), pbeSaltSize)
+	header = append(header, salt...)
+
+	key, err := x.params.deriveKey(x.password, salt)
+	if err != nil {
+		return nil, err
+	}
+	encdec, err := newAESCBCPKCS7HMAC(key)
+	if err != nil {
+		return nil, err
+	}
+	encdec.iv.rng = x.rng
+
+	dst := make([]byte, len(header)+encdec.calcDstSizeToEnc(src))
+	copy(dst, header)
+	if err := encdec.seal(dst[len(header):], src, append(header, aad...)); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// WithRand reads the salts from rng as well as the IVs.
+func (x *pbe) WithRand(rng io.Reader) Encrypter {
+	return &pbe{x.password, x.params, x.limits, rng}
+}
+
+func (x *pbe) Decrypt(src []byte) ([]byte, error) {
+	return x.DecryptWithAAD(src, nil)
+}
+
+func (x *pbe) DecryptWithAAD(src, aad []byte) ([]byte, error) {
+
+	params, salt, size, err := parsePasswordHeader(src, x.limits)
+	if err != nil {
+		return nil, err
+	}
+	key, err := params.deriveKey(x.password, salt)
+	if err != nil {
+		return nil, err
+	}
+	encdec, err := newAESCBCPKCS7HMAC(key)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := src[size:]
+	dstSize, err := encdec.calcDstSizeToDec(payload)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, dstSize)
+	if dstSize, err := encdec.open(dst, payload, append(src[:size:size], aad...)); err != nil {
+		return nil, err
+	} else {
+		return dst[:dstSize], nil
+	}
+}
+
+// NewPasswordEncrypter derives the key of every message from password with
+// the KDF of params, e.g. DefaultArgon2idParams. It is an AEADEncrypter as
+// well.
+func NewPasswordEncrypter(password string, params PasswordParams) (Encrypter, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return &pbe{password: []byte(password), params: params}, nil
+}
+
+// NewPasswordDecrypter reads the KDF and its parameters from the ciphertext.
+// So that a forged header cannot exhaust the memory or the CPU, they must
+// not exceed the limits of the same KDF, or the Default*Params of the KDFs
+// not in limits; otherwise Decrypt fails with ErrKDFLimitExceeded. It is an
+// AEADDecrypter as well.
+func NewPasswordDecrypter(password string, limits ...PasswordParams) Decrypter {
+	return &pbe{password: []byte(password), limits: passwordLimits(limits)}
+}
+
+// NewPasswordEncDec limits the parameters read by the decrypter as
+// NewPasswordDecrypter, raised to params so that it decrypts what the
+// encrypter writes.
+func NewPasswordEncDec(password string, params PasswordParams, limits ...PasswordParams) (Encrypter, Decrypter, error) {
+	if err := params.validate(); err != nil {
+		return nil, nil, err
+	}
+	m := passwordLimits(limits)
+	if limit := m[params.KDF]; !params.within(limit) {
+		m[params.KDF] = PasswordParams{
+			KDF:        params.KDF,
+			Iterations: max(params.Iterations, limit.Iterations),
+			Memory:     max(params.Memory, limit.Memory),
+			Threads:    max(params.Threads, limit.Threads),
+			LogN:       max(params.LogN, limit.LogN),
+			R:          max(params.R, limit.R),
+			P:          max(params.P, limit.P),
+		}
+	}
+	x := &pbe{password: []byte(password), params: params, limits: m}
+	return x, x, nil
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// cheap parameters for the tests
+var testPasswordParams = []PasswordParams{
+	{KDF: KDFPBKDF2SHA256, Iterations: 1000},
+	{KDF: KDFScrypt, LogN: 10, R: 8, P: 1},
+	{KDF: KDFArgon2id, Iterations: 1, Memory: 64, Threads: 1},
+}
+
+func TestPassword_1(t *testing.T) {
+
+	for _, params := range testPasswordParams {
+		enc, dec, err := NewPasswordEncDec("password", params)
+		if err != nil {
+			t.Errorf("%d: failed to create encrypter/decrypter %s", params.KDF, err.Error())
+			return
+		}
+		for size := 0; size <= 64; size += 7 {
+			if !encdeccompare(t, size, enc, dec) {
+				t.Errorf("%d: size %d", params.KDF, size)
+				return
+			}
+		}
+
+		// decryption needs only the password
+		src := []byte("0123456789")
+		c := enc.Encrypt(src)
+		if c[0] != 1 || c[1] != params.KDF {
+			t.Errorf("%d: header %x", params.KDF, c[:2])
+			return
+		}
+		if dst, err := NewPasswordDecrypter("password").Decrypt(c); err != nil || !bytes.Equal(dst, src) {
+			t.Errorf("%d: failed to decrypt %v", params.KDF, err)
+			return
+		}
+		if bytes.Equal(c, enc.Encrypt(src)) {
+			t.Errorf("%d: Should use a new salt", params.KDF)
+			return
+		}
+		if _, err := NewPasswordDecrypter("wrong").Decrypt(c); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("%d: Should fail with ErrAuthenticationFailed", params.KDF)
+			return
+		}
+
+		// associated data
+		c, err = enc.(AEADEncrypter).EncryptWithAAD(src, []byte("users/1/email"))
+		if err != nil {
+			t.Errorf("%d: failed to encrypt %s", params.KDF, err.Error())
+			return
+		}
+		if dst, err := dec.(AEADDecrypter).DecryptWithAAD(c, []byte("users/1/email")); err != nil || !bytes.Equal(dst, src) {
+			t.Errorf("%d: failed to decrypt %v", params.KDF, err)
+			return
+		}
+		if _, err := dec.(AEADDecrypter).DecryptWithAAD(c, []byte("users/2/email")); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("%d: Should fail with ErrAuthenticationFailed", params.KDF)
+			return
+		}
+	}
+}
+
+func TestPassword_WithRand(t *testing.T) {
+
+	enc, err := NewPasswordEncrypter("password", testPasswordParams[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1 := WithRand(enc, bytes.NewReader(make([]byte, 32))).Encrypt([]byte("0123456789"))
+	c2 := WithRand(enc, bytes.NewReader(make([]byte, 32))).Encrypt([]byte("0123456789"))
+	if !bytes.Equal(c1, c2) {
+		t.Error("Should be deterministic")
+		return
+	}
+	if _, err := TryEncrypt(WithRand(enc, bytes.NewReader(make([]byte, 16))), []byte("0123456789")); err == nil {
+		t.Error("Should fail without IV")
+		return
+	}
+}
+
+func TestPassword_ErrorCase(t *testing.T) {
+
+	for _, params := range []PasswordParams{
+		{},
+		{KDF: 9, Iterations: 1000},
+		{KDF: KDFPBKDF2SHA256},
+		{KDF: KDFPBKDF2SHA256, Iterations: 100000000},
+		{KDF: KDFScrypt, LogN: 0, R: 8, P: 1},
+		{KDF: KDFScrypt, LogN: 21, R: 8, P: 1},
+		{KDF: KDFScrypt, LogN: 60, R: 8, P: 1},
+		{KDF: KDFScrypt, LogN: 10, R: 8, P: 0},
+		{KDF: KDFArgon2id, Iterations: 0, Memory: 64, Threads: 1},
+		{KDF: KDFArgon2id, Iterations: 1, Memory: 4, Threads: 1},
+		{KDF: KDFArgon2id, Iterations: 1, Memory: 4 * 1024 * 1024, Threads: 1},
+	} {
+		if _, err := NewPasswordEncrypter("password", params); err == nil {
+			t.Errorf("Should fail with %v", params)
+			return
+		}
+		if _, _, err := NewPasswordEncDec("password", params); err == nil {
+			t.Errorf("Should fail with %v", params)
+			return
+		}
+	}
+
+	enc, dec, err := NewPasswordEncDec("password", testPasswordParams[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := enc.Encrypt([]byte("0123456789"))
+	for _, n := range []int{0, 1, 6, 22, 23, 70} {
+		if _, err := dec.Decrypt(c[:n]); !errors.Is(err, ErrCiphertextTooShort) {
+			t.Errorf("Should fail with ErrCiphertextTooShort %d: %v", n, err)
+			return
+		}
+	}
+
+	// the header is authenticated
+	for _, index := range []int{5, 7, 22} {
+		tampered := append([]byte(nil), c...)
+		tampered[index] ^= 0x01
+		if _, err := dec.Decrypt(tampered); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Should fail with ErrAuthenticationFailed with byte %d: %v", index, err)
+			return
+		}
+	}
+
+	// forged parameters are rejected before the key derivation
+	tampered := append([]byte(nil), c...)
+	binary.BigEndian.PutUint32(tampered[2:6], 0xffffffff)
+	if _, err := dec.Decrypt(tampered); err == nil || errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Should fail with the iterations %v", err)
+		return
+	}
+	for _, header := range [][]byte{
+		{2, KDFPBKDF2SHA256},
+		{1, 9, 0, 0, 0, 1},
+		{1, KDFArgon2id, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff, 1, 0},
+	} {
+		if _, err := dec.Decrypt(append(header, c[6:]...)); err == nil || errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Should fail with header %x: %v", header, err)
+			return
+		}
+	}
+
+	// valid parameters beyond the limits are rejected before the key
+	// derivation, which would take long and, for scrypt and Argon2id,
+	// allocate 1 GiB
+	for _, header := range [][]byte{
+		{1, KDFPBKDF2SHA256, 0, 0x98, 0x96, 0x80},
+		{1, KDFScrypt, 20, 8, 1},
+		{1, KDFArgon2id, 0, 0, 0, 100, 0, 0x10, 0, 0, 4},
+	} {
+		if _, err := NewPasswordDecrypter("password").Decrypt(append(header, c[6:]...)); !errors.Is(err, ErrKDFLimitExceeded) {
+			t.Errorf("Should fail with ErrKDFLimitExceeded with header %x: %v", header, err)
+			return
+		}
+	}
+
+	// limits given to the decrypter
+	if _, err := NewPasswordDecrypter("password", PasswordParams{KDF: KDFPBKDF2SHA256, Iterations: 999}).Decrypt(c); !errors.Is(err, ErrKDFLimitExceeded) {
+		t.Errorf("Should fail with ErrKDFLimitExceeded: %v", err)
+		return
+	}
+	if _, err := NewPasswordDecrypter("password", PasswordParams{KDF: KDFPBKDF2SHA256, Iterations: 1000}).Decrypt(c); err != nil {
+		t.Errorf("failed to decrypt %s", err.Error())
+		return
+	}
+
+	// the decrypter of NewPasswordEncDec accepts the parameters of its
+	// encrypter
+	params := PasswordParams{KDF: KDFArgon2id, Iterations: 1, Memory: 64, Threads: 8}
+	enc, dec, err = NewPasswordEncDec("password", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = enc.Encrypt([]byte("0123456789"))
+	if _, err := dec.Decrypt(c); err != nil {
+		t.Errorf("failed to decrypt %s", err.Error())
+		return
+	}
+	if _, err := NewPasswordDecrypter("password").Decrypt(c); !errors.Is(err, ErrKDFLimitExceeded) {
+		t.Errorf("Should fail with ErrKDFLimitExceeded: %v", err)
+		return
+	}
+	if _, err := NewPasswordDecrypter("password", params).Decrypt(c); err != nil {
+		t.Errorf("failed to decrypt %s", err.Error())
+		return
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted PKCS#8 private keys (RFC 5958) with PBES2 (RFC 8018), as written
+// by "openssl genpkey -aes-256-cbc" or "openssl pkcs8 -topk8 [-scrypt]".
+// The key derivation is PBKDF2 or scrypt (RFC 7914) and the encryption
+// AES-CBC.
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA224 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// pbes2Iterations is the PBKDF2 iteration count of MarshalPrivateKeyPEM.
+const pbes2Iterations = 100000
+
+// MarshalPrivateKeyPEM encodes prvkey as a PKCS#8 PEM block, which is
+// encrypted with PBES2 (PBKDF2-HMAC-SHA256 and AES-256-CBC) unless passwd is
+// empty.
+func MarshalPrivateKeyPEM(rng io.Reader, prvkey crypto.PrivateKey, passwd string) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(prvkey)
+	if err != nil {
+		return nil, err
+	}
+	if passwd == "" {
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+	if der, err = encryptPKCS8(randReader(rng), der, passwd); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), nil
+}
+
+func encryptPKCS8(rng io.Reader, der []byte, passwd string) ([]byte, error) {
+
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rng, salt); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rng, iv); err != nil {
+		return nil, err
+	}
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbes2Iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := aes.NewCipher(pbkdf2.Key([]byte(passwd), salt, pbes2Iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	encrypted := make([]byte, PKCS7Padding.CalcDstSize(aes.BlockSize, der))
+	if err := PKCS7Padding.Fill(aes.BlockSize, encrypted, der); err != nil {
+		return nil, err
+	}
+	cipher.NewCBCEncrypter(b, iv).CryptBlocks(encrypted, encrypted)
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+}
+
+// decryptPKCS8 returns the DER of the PKCS#8 private key encrypted in der.
+func decryptPKCS8(der []byte, passwd string) ([]byte, error) {
+
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("Unsupported private key encryption %s", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+
+	var keyLen int
+	switch es := params.EncryptionScheme.Algorithm; {
+	case es.Equal(oidAES128CBC):
+		keyLen = 16
+	case es.Equal(oidAES192CBC):
+		keyLen = 24
+	case es.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("Unsupported private key cipher %s", es)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	} else if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("Invalid IV length %d", len(iv))
+	}
+
+	key, err := deriveKeyPBES2(params.KeyDerivationFunc, []byte(passwd), keyLen)
+	if err != nil {
+		return nil, err
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyCiphertextSize(aes.BlockSize, aes.BlockSize, info.EncryptedData); err != nil {
+		return nil, err
+	}
+	dst := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(b, iv).CryptBlocks(dst, info.EncryptedData)
+	if size, err := PKCS7Padding.Verify(aes.BlockSize, dst); err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key, wrong password?: %w", err)
+	} else {
+		return dst[:size], nil
+	}
+}
+
+func deriveKeyPBES2(kdf pkix.AlgorithmIdentifier, passwd []byte, keyLen int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		} else if params.KeyLength != 0 && params.KeyLength != keyLen {
+			return nil, fmt.Errorf("Invalid key length %d", params.KeyLength)
+		} else if h, err := pbkdf2PRF(params.PRF); err != nil {
+			return nil, err
+		} else {
+			return pbkdf2.Key(passwd, params.Salt, params.IterationCount, keyLen, h), nil
+		}
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		} else if params.KeyLength != 0 && params.KeyLength != keyLen {
+			return nil, fmt.Errorf("Invalid key length %d", params.KeyLength)
+		} else {
+			return scrypt.Key(passwd, params.Salt, params.CostParameter, params.BlockSize, params.ParallelizationParameter, keyLen)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported key derivation function %s", kdf.Algorithm)
+	}
+}
+
+// pbkdf2PRF defaults to HMAC-SHA1 as RFC 8018 does.
+func pbkdf2PRF(prf pkix.AlgorithmIdentifier) (func() hash.Hash, error) {
+	switch {
+	case len(prf.Algorithm) == 0, prf.Algorithm.Equal(oidHMACWithSHA1):
+		return sha1.New, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA224):
+		return sha256.New224, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA256):
+		return sha256.New, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA384):
+		return sha512.New384, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA512):
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("Unsupported PBKDF2 PRF %s", prf.Algorithm)
+	}
+}
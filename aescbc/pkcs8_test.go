@@ -0,0 +1,144 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLoadAesKeyMap_PKCS8(t *testing.T) {
+
+	keydir := filepath.Join("test", "versioned_pkcs8")
+	pwdfile := filepath.Join(keydir, "pwd.yaml")
+
+	// 0: PKCS#8, 1: PBES2 PBKDF2-HMAC-SHA256 AES-256-CBC,
+	// 2: PBES2 scrypt AES-128-CBC, 3: PBES2 PBKDF2-HMAC-SHA1 AES-192-CBC
+	expected := map[uint32]string{
+		0: "4f3a72269a6d2f4708c57a6b89ebec4a",
+		1: "ba897e524504534e2d2aa1ca87e0c3e7",
+		2: "a18553cb2494d4510d6988d57e769494",
+		3: "e62254036eb9ba41bfa8576906c0f015",
+	}
+	keymap, err := LoadAesKeyMap(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to load keys %s", err.Error())
+		return
+	}
+	if len(keymap) != len(expected) {
+		t.Errorf("%d versions loaded", len(keymap))
+		return
+	}
+	for vr, key := range keymap {
+		if hex.EncodeToString(key) != expected[vr] {
+			t.Errorf("version %d: key %x", vr, key)
+			return
+		}
+	}
+}
+
+func TestLoadPrivateKey_1(t *testing.T) {
+
+	keys := map[string]elliptic.Curve{
+		"ec_p256.pem":        elliptic.P256(),
+		"ec_p256_sec1.pem":   elliptic.P256(),
+		"ec_p256_scrypt.pem": elliptic.P256(),
+		"ec_p384_pbkdf2.pem": elliptic.P384(),
+	}
+	var p256 *ecdsa.PrivateKey
+	for name, curve := range keys {
+		if prvkey, err := loadPrivateKey(os.DirFS(filepath.Join("test", "pkcs8")), name, "password"); err != nil {
+			t.Errorf("%s: failed to load %s", name, err.Error())
+			return
+		} else if eckey, ok := prvkey.(*ecdsa.PrivateKey); !ok {
+			t.Errorf("%s: %T", name, prvkey)
+			return
+		} else if eckey.Curve != curve {
+			t.Errorf("%s: curve %s", name, eckey.Curve.Params().Name)
+			return
+		} else if curve == elliptic.P256() {
+			if p256 == nil {
+				p256 = eckey
+			} else if !p256.Equal(eckey) {
+				t.Errorf("%s: key mismatch", name)
+				return
+			}
+		}
+	}
+
+	for vr, pw := range []string{"", "password", "secret", "sha1"} {
+		prvkeyfile := path.Join("versioned_pkcs8", strconv.Itoa(vr), PrivkeyFilename)
+		if prvkey, err := loadPrivateKey(os.DirFS("test"), prvkeyfile, pw); err != nil {
+			t.Errorf("%d: failed to load %s", vr, err.Error())
+			return
+		} else if _, ok := prvkey.(*rsa.PrivateKey); !ok {
+			t.Errorf("%d: %T", vr, prvkey)
+			return
+		}
+	}
+}
+
+func TestLoadPrivateKey_ErrorCase(t *testing.T) {
+
+	if _, err := loadPrivateKey(os.DirFS("test"), path.Join("versioned_pkcs8", "0", AeskeyFilename), ""); err == nil {
+		t.Error("Should fail without PEM block")
+		return
+	} else if !strings.Contains(err.Error(), "No PEM block") {
+		t.Errorf("Error %s", err.Error())
+		return
+	}
+
+	for _, name := range []string{"ec_p256_scrypt.pem", "ec_p384_pbkdf2.pem"} {
+		if _, err := loadPrivateKey(os.DirFS(filepath.Join("test", "pkcs8")), name, "wrong"); err == nil {
+			t.Errorf("%s: Should fail with wrong password", name)
+			return
+		}
+	}
+
+	// EC keys cannot unwrap key.bin with RSA-OAEP
+	keydir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(keydir, "0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join("test", "pkcs8", "ec_p256.pem")); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(filepath.Join(keydir, "0", PrivkeyFilename), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(keydir, "0", AeskeyFilename), make([]byte, 256), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(keydir, "0", MetaFilename), []byte("wrap: RSA-OAEP-SHA256\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(keydir, "pwd.yaml"), []byte("0: \"\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAesKeyMap(keydir, filepath.Join(keydir, "pwd.yaml")); err == nil {
+		t.Error("Should fail with an EC key")
+		return
+	}
+}
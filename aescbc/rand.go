@@ -0,0 +1,54 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// Randomizer is implemented by the encrypters which draw IVs, nonces or
+// salts from a source of randomness, in this package and in aesgcm.
+type Randomizer interface {
+	WithRand(rng io.Reader) Encrypter
+}
+
+// WithRand returns a copy of x which reads IVs from rng instead of
+// crypto/rand, e.g. for deterministic test vectors or a DRBG. Encrypters which
+// are not a Randomizer, as the fixed-IV ones, are returned as they are and
+// never read rng; assert Randomizer where rng must be used.
+func WithRand(x Encrypter, rng io.Reader) Encrypter {
+	if r, ok := x.(Randomizer); ok {
+		return r.WithRand(rng)
+	}
+	return x
+}
+
+func randReader(rng io.Reader) io.Reader {
+	if rng == nil {
+		return rand.Reader
+	}
+	return rng
+}
+
+func readIV(rng io.Reader, iv []byte) error {
+	if _, err := io.ReadFull(randReader(rng), iv); err != nil {
+		return fmt.Errorf("failed to generate IV: %w", err)
+	}
+	return nil
+}
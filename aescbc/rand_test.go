@@ -0,0 +1,156 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+)
+
+func newTestEncrypters(t *testing.T) map[string]Encrypter {
+	key := []byte("0123456789abcdef")
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		t.Error("failed to create cipher")
+		return nil
+	}
+	hmacenc, err := NewAESCBCPKCS7HMACEncrypter(key)
+	if err != nil {
+		t.Error("failed to create encrypter")
+		return nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("failed to os.Getwd() %s", err.Error())
+		return nil
+	}
+	keydir := filepath.Join(wd, "test", "versioned_1-2")
+	verenc, err := NewAESCBCPKCS7ivVerEncrypter(keydir, filepath.Join(keydir, "pwd.yaml"))
+	if err != nil {
+		t.Errorf("failed to create encrypter %s", err.Error())
+		return nil
+	}
+	ctsenc, err := NewCBCCTSivEncrypter(b, CS3)
+	if err != nil {
+		t.Errorf("failed to create encrypter %s", err.Error())
+		return nil
+	}
+	return map[string]Encrypter{
+		"iv":        NewCBCPKCS7ivEncrypter(b),
+		"hmac":      hmacenc,
+		"cts":       ctsenc,
+		"versioned": verenc,
+	}
+}
+
+func TestWithRand_1(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x42}, 16)
+	src := []byte("0123456789abcdef0123")
+
+	for name, enc := range newTestEncrypters(t) {
+		c1 := WithRand(enc, bytes.NewReader(seed)).Encrypt(src)
+		c2, err := TryEncrypt(WithRand(enc, bytes.NewReader(seed)), src)
+		if err != nil {
+			t.Errorf("%s: %s", name, err.Error())
+			return
+		}
+		if !bytes.Equal(c1, c2) {
+			t.Errorf("%s: not deterministic", name)
+			return
+		}
+		if !bytes.Contains(c1, seed) {
+			t.Errorf("%s: IV not taken from rng", name)
+			return
+		}
+		if bytes.Equal(c1, enc.Encrypt(src)) {
+			t.Errorf("%s: original encrypter affected", name)
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	b, _ := aes.NewCipher([]byte("0123456789abcdef"))
+	w, err := NewCBCPKCS7ivWriterWithRand(b, &buf, bytes.NewReader(seed))
+	if err != nil {
+		t.Errorf("failed to create writer %s", err.Error())
+		return
+	}
+	w.Write(src)
+	w.Close()
+	if !bytes.Equal(buf.Bytes(), WithRand(NewCBCPKCS7ivEncrypter(b), bytes.NewReader(seed)).Encrypt(src)) {
+		t.Error("writer mismatch")
+		return
+	}
+
+	p := NewISO10126Padding(bytes.NewReader(seed))
+	dst := make([]byte, p.CalcDstSize(16, src))
+	if err := p.Fill(16, dst, src); err != nil {
+		t.Errorf("failed to fill %s", err.Error())
+		return
+	}
+	if !bytes.Equal(dst[len(src):len(dst)-1], seed[:len(dst)-len(src)-1]) {
+		t.Errorf("padding not taken from rng %x", dst)
+		return
+	}
+}
+
+func TestWithRand_ErrorCase(t *testing.T) {
+	src := []byte("0123456789abcdef0123")
+	rngErr := errors.New("entropy exhausted")
+
+	for name, enc := range newTestEncrypters(t) {
+		failing := WithRand(enc, iotest.ErrReader(rngErr))
+		if _, err := TryEncrypt(failing, src); !errors.Is(err, rngErr) {
+			t.Errorf("%s: Should fail", name)
+			return
+		}
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("%s: Should panic", name)
+				} else if err, ok := r.(error); !ok || !errors.Is(err, rngErr) {
+					t.Errorf("%s: Should panic with the error %v", name, r)
+				}
+			}()
+			failing.Encrypt(src)
+		}()
+	}
+
+	b, _ := aes.NewCipher([]byte("0123456789abcdef"))
+	if _, err := NewCBCPKCS7ivWriterWithRand(b, &bytes.Buffer{}, iotest.ErrReader(rngErr)); !errors.Is(err, rngErr) {
+		t.Error("Should fail")
+		return
+	}
+	enc := NewCBCivEncrypterWithPadding(b, NewISO10126Padding(iotest.ErrReader(rngErr)))
+	if _, err := TryEncrypt(WithRand(enc, bytes.NewReader(make([]byte, 16))), src); !errors.Is(err, rngErr) {
+		t.Error("Should fail")
+		return
+	}
+
+	if ctsenc, err := NewCBCCTSivEncrypter(b, CS3); err != nil {
+		t.Error("failed to create encrypter")
+		return
+	} else if _, err := TryEncrypt(ctsenc, src[:15]); err == nil {
+		t.Error("Should fail")
+		return
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+)
+
+const streamChunkSize = 32 * 1024
+
+// cbcpkcs7ivWriter writes "IV + ciphertext" in the same layout as cbciv with PKCS#7
+// padding.
+// Whole blocks are encrypted as they arrive; the remainder is kept until Close,
+// where PKCS#7 padding is added. After the underlying writer fails, the
+// chain of blocks is broken, so every later Write and Close returns the same
+// error.
+type cbcpkcs7ivWriter struct {
+	w      io.Writer
+	bm     cipher.BlockMode
+	buf    []byte
+	closed bool
+	err    error
+}
+
+// cbcpkcs7ivReader reads "IV + ciphertext" in the same layout as cbciv with PKCS#7
+// padding.
+// The last block is held back until EOF so that its padding can be verified.
+type cbcpkcs7ivReader struct {
+	r   io.Reader
+	b   cipher.Block
+	bm  cipher.BlockMode
+	in  []byte
+	out []byte
+	err error
+}
+
+func (x *cbcpkcs7ivWriter) Write(p []byte) (int, error) {
+	if x.err != nil {
+		return 0, x.err
+	}
+	if x.closed {
+		return 0, fmt.Errorf("Write to closed writer")
+	}
+	bs := x.bm.BlockSize()
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > streamChunkSize {
+			n = streamChunkSize
+		}
+		x.buf = append(x.buf, p[:n]...)
+		if size := len(x.buf) / bs * bs; size > 0 {
+			x.bm.CryptBlocks(x.buf[:size], x.buf[:size])
+			if _, err := x.w.Write(x.buf[:size]); err != nil {
+				x.err = err
+				return written, err
+			}
+			x.buf = x.buf[:copy(x.buf, x.buf[size:])]
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close writes the final padded block. It does not close the underlying writer.
+func (x *cbcpkcs7ivWriter) Close() error {
+	if x.err != nil || x.closed {
+		return x.err
+	}
+	x.closed = true
+	dst := addPaddingByPKCS7(x.bm.BlockSize(), x.buf)
+	x.bm.CryptBlocks(dst, dst)
+	if _, err := x.w.Write(dst); err != nil {
+		x.err = err
+	}
+	return x.err
+}
+
+func (x *cbcpkcs7ivReader) Read(p []byte) (int, error) {
+	for len(x.out) == 0 && x.err == nil {
+		x.fill()
+	}
+	if len(x.out) > 0 {
+		n := copy(p, x.out)
+		x.out = x.out[n:]
+		return n, nil
+	}
+	return 0, x.err
+}
+
+func (x *cbcpkcs7ivReader) fill() {
+	bs := x.b.BlockSize()
+	if x.bm == nil {
+		iv := make([]byte, bs)
+		if _, err := io.ReadFull(x.r, iv); err == io.EOF || err == io.ErrUnexpectedEOF {
+			x.err = fmt.Errorf("%w: missing IV", ErrCiphertextTooShort)
+			return
+		} else if err != nil {
+			x.err = fmt.Errorf("failed to read IV: %w", err)
+			return
+		}
+		x.bm = cipher.NewCBCDecrypter(x.b, iv)
+		x.in = make([]byte, 0, streamChunkSize+bs)
+	}
+
+	n, err := x.r.Read(x.in[len(x.in):cap(x.in)])
+	x.in = x.in[:len(x.in)+n]
+
+	if err == io.EOF {
+		if len(x.in) == 0 {
+			x.err = fmt.Errorf("%w: missing ciphertext", ErrCiphertextTooShort)
+			return
+		} else if len(x.in)%bs != 0 {
+			x.err = fmt.Errorf("%w: %d bytes left for blockSize %d", ErrNotBlockAligned, len(x.in), bs)
+			return
+		}
+		x.bm.CryptBlocks(x.in, x.in)
+		last := x.in[len(x.in)-bs:]
+		if size, err := verifyPaddingByPKCS7(bs, last); err != nil {
+			x.err = err
+		} else {
+			x.out = x.in[:len(x.in)-bs+size]
+			x.in = nil
+			x.err = io.EOF
+		}
+		return
+	} else if err != nil {
+		x.err = err
+		return
+	}
+
+	if len(x.in) == 0 {
+		return
+	}
+	// hold back the tail, which may turn out to be the final block
+	size := (len(x.in) - 1) / bs * bs
+	if size > 0 {
+		out := make([]byte, size)
+		x.bm.CryptBlocks(out, x.in[:size])
+		x.in = x.in[:copy(x.in, x.in[size:])]
+		x.out = out
+	}
+}
+
+func NewCBCPKCS7ivWriter(b cipher.Block, w io.Writer) (io.WriteCloser, error) {
+	return NewCBCPKCS7ivWriterWithRand(b, w, nil)
+}
+
+// NewCBCPKCS7ivWriterWithRand reads the IV from rng instead of crypto/rand.
+func NewCBCPKCS7ivWriterWithRand(b cipher.Block, w io.Writer, rng io.Reader) (io.WriteCloser, error) {
+	iv := make([]byte, b.BlockSize())
+	if err := readIV(rng, iv); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(iv); err != nil {
+		return nil, err
+	}
+	return &cbcpkcs7ivWriter{w: w, bm: cipher.NewCBCEncrypter(b, iv)}, nil
+}
+
+func NewCBCPKCS7ivReader(b cipher.Block, r io.Reader) io.Reader {
+	return &cbcpkcs7ivReader{r: r, b: b}
+}
+
+func NewAESCBCPKCS7ivWriter(key []byte, w io.Writer) (io.WriteCloser, error) {
+	if b, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	} else {
+		return NewCBCPKCS7ivWriter(b, w)
+	}
+}
+
+func NewAESCBCPKCS7ivReader(key []byte, r io.Reader) (io.Reader, error) {
+	if b, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	} else {
+		return NewCBCPKCS7ivReader(b, r), nil
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aescbc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func TestAESCBCPKCS7ivStream_1(t *testing.T) {
+	numOfTrial := 5
+	maxSize := 512
+
+	for i := 0; i < numOfTrial; i++ {
+
+		key := make([]byte, 16)
+		if n, err := rand.Read(key); n != 16 || err != nil {
+			t.Error("failed to create key")
+			return
+		}
+
+		enc, dec, err := NewAESCBCPKCS7ivEncDec(key)
+		if err != nil {
+			t.Error("failed to create encrypter")
+			return
+		}
+
+		for size := 0; size <= maxSize; size++ {
+
+			src := make([]byte, size)
+			if n, err := rand.Read(src); n != size || err != nil {
+				t.Error("failed to create source data")
+				return
+			}
+
+			// Writer -> Decrypter
+			var mid bytes.Buffer
+			w, err := NewAESCBCPKCS7ivWriter(key, &mid)
+			if err != nil {
+				t.Errorf("failed to create writer %s", err.Error())
+				return
+			}
+			for j := 0; j < size; j += 7 {
+				end := j + 7
+				if end > size {
+					end = size
+				}
+				if _, err := w.Write(src[j:end]); err != nil {
+					t.Errorf("failed to write %s", err.Error())
+					return
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Errorf("failed to close %s", err.Error())
+				return
+			}
+			if len(mid.Bytes()) != len(enc.Encrypt(src)) {
+				t.Errorf("size mismatch %d", size)
+				return
+			}
+			if dst, err := dec.Decrypt(mid.Bytes()); err != nil {
+				t.Errorf("failed to decrypt %s", err.Error())
+				return
+			} else if !bytes.Equal(src, dst) {
+				t.Errorf("data mismatch %d", size)
+				return
+			}
+
+			// Encrypter -> Reader
+			r, err := NewAESCBCPKCS7ivReader(key, iotest.OneByteReader(bytes.NewReader(enc.Encrypt(src))))
+			if err != nil {
+				t.Errorf("failed to create reader %s", err.Error())
+				return
+			}
+			if dst, err := ioutil.ReadAll(r); err != nil {
+				t.Errorf("failed to read %s", err.Error())
+				return
+			} else if !bytes.Equal(src, dst) {
+				t.Errorf("data mismatch %d", size)
+				return
+			}
+		}
+	}
+}
+
+func TestAESCBCPKCS7ivStream_2(t *testing.T) {
+	size := 3*streamChunkSize + 5
+
+	key := make([]byte, 16)
+	if n, err := rand.Read(key); n != 16 || err != nil {
+		t.Error("failed to create key")
+		return
+	}
+	src := make([]byte, size)
+	if n, err := rand.Read(src); n != size || err != nil {
+		t.Error("failed to create source data")
+		return
+	}
+
+	var mid bytes.Buffer
+	w, err := NewAESCBCPKCS7ivWriter(key, &mid)
+	if err != nil {
+		t.Errorf("failed to create writer %s", err.Error())
+		return
+	}
+	if _, err := w.Write(src); err != nil {
+		t.Errorf("failed to write %s", err.Error())
+		return
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("failed to close %s", err.Error())
+		return
+	}
+
+	r, err := NewAESCBCPKCS7ivReader(key, iotest.HalfReader(&mid))
+	if err != nil {
+		t.Errorf("failed to create reader %s", err.Error())
+		return
+	}
+	if dst, err := ioutil.ReadAll(r); err != nil {
+		t.Errorf("failed to read %s", err.Error())
+		return
+	} else if !bytes.Equal(src, dst) {
+		t.Error("data mismatch")
+		return
+	}
+}
+
+func TestAESCBCPKCS7ivStream_ErrorCase(t *testing.T) {
+
+	key := make([]byte, 16)
+	if n, err := rand.Read(key); n != 16 || err != nil {
+		t.Error("failed to create key")
+		return
+	}
+	enc, err := NewAESCBCPKCS7ivEncrypter(key)
+	if err != nil {
+		t.Error("failed to create encrypter")
+		return
+	}
+	mid := enc.Encrypt([]byte("0123456789abcdef0123"))
+
+	for _, size := range []int{0, 8, 16, 24, 47} {
+		r, err := NewAESCBCPKCS7ivReader(key, bytes.NewReader(mid[:size]))
+		if err != nil {
+			t.Errorf("failed to create reader %s", err.Error())
+			return
+		}
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Errorf("Should fail %d", size)
+			return
+		}
+	}
+
+	w, err := NewAESCBCPKCS7ivWriter(key, ioutil.Discard)
+	if err != nil {
+		t.Errorf("failed to create writer %s", err.Error())
+		return
+	}
+	w.Close()
+	if _, err := w.Write([]byte("x")); err == nil {
+		t.Error("Should fail")
+		return
+	}
+
+	// the errors of the underlying reader and writer
+	boom := errors.New("boom")
+	if r, err := NewAESCBCPKCS7ivReader(key, iotest.ErrReader(boom)); err != nil {
+		t.Fatal(err)
+	} else if _, err := ioutil.ReadAll(r); !errors.Is(err, boom) || errors.Is(err, ErrCiphertextTooShort) {
+		t.Errorf("Should fail with the read error %v", err)
+		return
+	}
+	fw := &failingWriter{n: 1, err: boom}
+	w, err = NewAESCBCPKCS7ivWriter(key, fw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("0123456789abcdef")); !errors.Is(err, boom) {
+		t.Errorf("Should fail with the write error %v", err)
+		return
+	}
+	fw.err = nil
+	if _, err := w.Write([]byte("0123456789abcdef")); !errors.Is(err, boom) {
+		t.Errorf("Should keep the write error %v", err)
+		return
+	}
+	if err := w.Close(); !errors.Is(err, boom) {
+		t.Errorf("Should keep the write error %v", err)
+		return
+	}
+	if fw.writes != 2 {
+		t.Errorf("Should not write after the error %d", fw.writes)
+		return
+	}
+
+	if _, err := NewAESCBCPKCS7ivWriter(key[:15], ioutil.Discard); err == nil {
+		t.Error("Should fail")
+		return
+	}
+	if _, err := NewAESCBCPKCS7ivReader(key[:15], bytes.NewReader(mid)); err == nil {
+		t.Error("Should fail")
+		return
+	}
+
+}
+
+// failingWriter fails with err after n writes.
+type failingWriter struct {
+	n      int
+	err    error
+	writes int
+}
+
+func (x *failingWriter) Write(p []byte) (int, error) {
+	x.writes++
+	if x.writes > x.n && x.err != nil {
+		return 0, x.err
+	}
+	return len(p), nil
+}
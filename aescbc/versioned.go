@@ -17,162 +17,329 @@
 package aescbc
 
 import (
-	"crypto/aes"
-	"crypto/rand"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
 	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/binary"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
-	"path/filepath"
-	"strconv"
+	"io/fs"
 	"strings"
 
 	"github.com/go-yaml/yaml"
 )
 
 var (
-	KeyVersion      = uint32(0)
 	PrivkeyFilename = "privkey.pem"
 	AeskeyFilename  = "key.bin"
+	MetaFilename    = "meta.yaml"
 )
 
+// Key wrapping algorithms of key.bin, given as "wrap" in the metadata file
+// of a version. Without the metadata file key.bin is read as
+// KeyWrapRSAPKCS1v15 with an RSA private key and as KeyWrapECIES with an EC
+// (P-256, P-384) or X25519 private key. For the RSA-OAEP algorithms "label"
+// gives the OAEP label. KeyWrapKMS has key.bin unwrapped by a KMS under
+// "key_id", without privkey.pem and password.
+const (
+	KeyWrapRSAPKCS1v15   = "RSA-PKCS1v15"
+	KeyWrapRSAOAEPSHA1   = "RSA-OAEP-SHA1"
+	KeyWrapRSAOAEPSHA256 = "RSA-OAEP-SHA256"
+	KeyWrapECIES         = "ECIES-HKDF-SHA256-AES-256-GCM"
+	KeyWrapKMS           = "KMS"
+)
+
+// KeyMeta is the content of the metadata file of a version.
+type KeyMeta struct {
+	Wrap  string `yaml:"wrap"`
+	Label string `yaml:"label,omitempty"`
+	KeyID string `yaml:"key_id,omitempty"`
+}
+
+// VersionedEncrypter writes the active key version in front of every
+// ciphertext. The active version defaults to the highest loaded version and
+// can be changed at any time, also while encrypting from other goroutines.
+type VersionedEncrypter interface {
+	Encrypter
+	Reencrypter
+	ActiveVersion() uint32
+	SetActiveVersion(version uint32) error
+}
+
+// Reencrypter is part of VersionedEncrypter. Reencrypt migrates src to the
+// active version. It returns src as
+// it is and false if src is already of the active version, and otherwise
+// decrypts src with its version and encrypts the result with the active one.
+type Reencrypter interface {
+	Reencrypt(src []byte) ([]byte, bool, error)
+}
+
+// CiphertextVersion returns the key version of a ciphertext of a versioned
+// encrypter, in the framed format or with the 4-byte version header, without
+// decrypting it.
+func CiphertextVersion(src []byte) (uint32, error) {
+	if IsFramed(src) {
+		if h, _, err := ParseHeader(src); err != nil {
+			return 0, err
+		} else {
+			return h.KeyVersion()
+		}
+	}
+	if len(src) < 4 {
+		return 0, fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(src))
+	}
+	return binary.BigEndian.Uint32(src[:4]), nil
+}
+
+// versionedSuites are the suites of the framed format which the versioned
+// decrypters read: those of this package and AES-GCM, none weaker than the
+// 4-byte version header.
+var versionedSuites = []uint16{SuiteAESCBCPKCS7, SuiteAESGCM, SuiteAESCBCCTS3, SuiteAESCBCPKCS7HMACSHA256}
+
+// versioned reads the keys and the active version from a Keyring.
 type versioned struct {
-	encdec map[uint32]*cbcpkcs7iv
+	ring *Keyring
+	rng  io.Reader
+}
+
+func (x *versioned) ActiveVersion() uint32 {
+	return x.ring.ActiveVersion()
+}
+
+func (x *versioned) SetActiveVersion(version uint32) error {
+	return x.ring.SetActiveVersion(version)
 }
 
 func (x *versioned) Encrypt(src []byte) []byte {
-	return encryptMain(x, src)
+	return MustEncrypt(x.TryEncrypt(src))
+}
+
+func (x *versioned) TryEncrypt(src []byte) ([]byte, error) {
+	return x.encrypt(x.ActiveVersion(), src)
 }
 
-func (x *versioned) doEncrypt(dst, src []byte) {
-	binary.BigEndian.PutUint32(dst[:4], KeyVersion)
-	x.encdec[KeyVersion].doEncrypt(dst[4:], src)
+// Reencrypt keeps the format of src: a framed ciphertext is sealed again with
+// its own suite, and not downgraded to the 4-byte version header.
+func (x *versioned) Reencrypt(src []byte) ([]byte, bool, error) {
+	if IsFramed(src) {
+		return reencryptFramed(x.ring, x.rng, src, nil, versionedSuites)
+	}
+	active := x.ActiveVersion()
+	if version, err := CiphertextVersion(src); err != nil {
+		return nil, false, err
+	} else if version == active {
+		return src, false, nil
+	} else if plain, err := x.Decrypt(src); err != nil {
+		return nil, false, err
+	} else if dst, err := x.encrypt(active, plain); err != nil {
+		return nil, false, err
+	} else {
+		return dst, true, nil
+	}
+}
+
+func (x *versioned) encrypt(version uint32, src []byte) ([]byte, error) {
+	b, err := x.ring.Block(version)
+	if err != nil {
+		return nil, err
+	}
+	encdec := &cbciv{b, PKCS7Padding, x.rng}
+	dst := make([]byte, 4+encdec.calcDstSizeToEnc(src))
+	binary.BigEndian.PutUint32(dst[:4], version)
+	if err := encdec.doEncrypt(dst[4:], src); err != nil {
+		return nil, err
+	}
+	return dst, nil
 }
 
-func (x *versioned) calcDstSizeToEnc(src []byte) int {
-	return x.encdec[KeyVersion].calcDstSizeToEnc(src) + 4
+// WithRand shares the keyring, and so the active version, with x.
+func (x *versioned) WithRand(rng io.Reader) Encrypter {
+	return &versioned{x.ring, rng}
 }
 
+// Decrypt reads the framed format as well.
 func (x *versioned) Decrypt(src []byte) ([]byte, error) {
+	if IsFramed(src) {
+		return decryptFramed(x.ring, src, nil, versionedSuites)
+	}
 	return decryptMain(x, src)
 }
 
 func (x *versioned) doDecrypt(dst, src []byte) (int, error) {
-	version := binary.BigEndian.Uint32(src[:4])
-	return x.encdec[version].doDecrypt(dst, src[4:])
+	if encdec, err := x.lookup(src); err != nil {
+		return -1, err
+	} else {
+		return encdec.doDecrypt(dst, src[4:])
+	}
 }
 
-func (x *versioned) calcDstSizeToDec(src []byte) int {
-	version := binary.BigEndian.Uint32(src[:4])
-	return x.encdec[version].calcDstSizeToDec(src[4:])
+func (x *versioned) calcDstSizeToDec(src []byte) (int, error) {
+	if encdec, err := x.lookup(src); err != nil {
+		return -1, err
+	} else {
+		return encdec.calcDstSizeToDec(src[4:])
+	}
 }
 
-func NewAESCBCPKCS7ivVerEncrypter(topdir, pwdfile string) (Encrypter, error) {
-	if encdec, err := loadCryptoMap(topdir, pwdfile); err != nil {
+func (x *versioned) lookup(src []byte) (*cbciv, error) {
+	if version, err := CiphertextVersion(src); err != nil {
+		return nil, err
+	} else if b, err := x.ring.Block(version); err != nil {
 		return nil, err
 	} else {
-		return &versioned{encdec}, nil
+		return &cbciv{b: b, p: PKCS7Padding}, nil
+	}
+}
+
+func NewAESCBCPKCS7ivVerEncrypter(topdir, pwdfile string) (VersionedEncrypter, error) {
+	if ring, err := NewKeyring(topdir, pwdfile); err != nil {
+		return nil, err
+	} else {
+		return &versioned{ring: ring}, nil
 	}
 }
 
 func NewAESCBCPKCS7ivVerDecrypter(topdir, pwdfile string) (Decrypter, error) {
-	if encdec, err := loadCryptoMap(topdir, pwdfile); err != nil {
+	if ring, err := NewKeyring(topdir, pwdfile); err != nil {
 		return nil, err
 	} else {
-		return &versioned{encdec}, nil
+		return &versioned{ring: ring}, nil
 	}
 }
 
-func NewAESCBCPKCS7ivVerEncDec(topdir, pwdfile string) (Encrypter, Decrypter, error) {
-	if encdec, err := loadCryptoMap(topdir, pwdfile); err != nil {
+func NewAESCBCPKCS7ivVerEncDec(topdir, pwdfile string) (VersionedEncrypter, Decrypter, error) {
+	if ring, err := NewKeyring(topdir, pwdfile); err != nil {
 		return nil, nil, err
 	} else {
-		return &versioned{encdec}, &versioned{encdec}, nil
+		x := &versioned{ring: ring}
+		return x, x, nil
 	}
 }
 
-func loadCryptoMap(topdir, pwdfile string) (map[uint32]*cbcpkcs7iv, error) {
-	if keymap, err := loadAesKeyMap(topdir, pwdfile); err != nil {
-		return nil, err
+// NewAESCBCPKCS7ivVerEncDecWithRand generates the IVs from rng.
+func NewAESCBCPKCS7ivVerEncDecWithRand(topdir, pwdfile string, rng io.Reader) (VersionedEncrypter, Decrypter, error) {
+	if ring, err := NewKeyring(topdir, pwdfile); err != nil {
+		return nil, nil, err
 	} else {
-		encdec := make(map[uint32]*cbcpkcs7iv)
-		for vr, key := range keymap {
-			if b, err := aes.NewCipher(key); err != nil {
-				return nil, err
-			} else {
-				encdec[vr] = &cbcpkcs7iv{b}
-			}
-		}
-		return encdec, nil
+		return &versioned{ring, rng}, &versioned{ring: ring}, nil
 	}
 }
 
-func loadAesKeyMap(topdir, pwdfile string) (map[uint32][]byte, error) {
-	if pwdmap, err := loadPasswdMap(pwdfile); err != nil {
+func NewAESCBCPKCS7ivVerEncrypterWithKeyStore(ks KeyStore) (VersionedEncrypter, error) {
+	if ring, err := NewKeyringWithKeyStore(ks); err != nil {
 		return nil, err
 	} else {
-		rng := rand.Reader
-		aeskeymap := make(map[uint32][]byte)
-		for vr, pw := range pwdmap {
-			basedir := filepath.Join(topdir, strconv.FormatUint(uint64(vr), 10))
-			if prvkey, err := loadPrivateKey(filepath.Join(basedir, PrivkeyFilename), pw); err != nil {
-				return nil, err
-			} else if aeskey, err := loadAesKey(filepath.Join(basedir, AeskeyFilename), prvkey, rng); err != nil {
-				return nil, err
-			} else {
-				aeskeymap[vr] = aeskey
-			}
-		}
-		return aeskeymap, nil
+		return &versioned{ring: ring}, nil
 	}
 }
 
-func loadPasswdMap(pwdfile string) (map[uint32]string, error) {
-
-	if data, err := ioutil.ReadFile(pwdfile); err != nil {
+func NewAESCBCPKCS7ivVerDecrypterWithKeyStore(ks KeyStore) (Decrypter, error) {
+	if ring, err := NewKeyringWithKeyStore(ks); err != nil {
 		return nil, err
 	} else {
+		return &versioned{ring: ring}, nil
+	}
+}
+
+func NewAESCBCPKCS7ivVerEncDecWithKeyStore(ks KeyStore) (VersionedEncrypter, Decrypter, error) {
+	if ring, err := NewKeyringWithKeyStore(ks); err != nil {
+		return nil, nil, err
+	} else {
+		x := &versioned{ring: ring}
+		return x, x, nil
+	}
+}
 
-		var pwdmap map[uint32]string
-		if strings.HasSuffix(pwdfile, ".json") {
-			err = json.Unmarshal(data, &pwdmap)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			err = yaml.Unmarshal(data, &pwdmap)
-			if err != nil {
-				return nil, err
-			}
+// NewAESCBCPKCS7ivVerEncrypterWithKeyring follows the reloads of ring, and
+// shares its active version with the other encrypters made from ring.
+func NewAESCBCPKCS7ivVerEncrypterWithKeyring(ring *Keyring) VersionedEncrypter {
+	return &versioned{ring: ring}
+}
+
+func NewAESCBCPKCS7ivVerDecrypterWithKeyring(ring *Keyring) Decrypter {
+	return &versioned{ring: ring}
+}
+
+func NewAESCBCPKCS7ivVerEncDecWithKeyring(ring *Keyring) (VersionedEncrypter, Decrypter) {
+	x := &versioned{ring: ring}
+	return x, x
+}
+
+// LoadAesKeyMap loads the AES keys of every version listed in pwdfile from
+// topdir/<version>/ (wrapped key.bin, privkey.pem and optionally meta.yaml).
+func LoadAesKeyMap(topdir, pwdfile string) (map[uint32][]byte, error) {
+	return loadKeyStore(NewDirKeyStore(topdir, pwdfile))
+}
+
+// ParsePasswdMap parses the content of a password file, JSON if its name
+// ends with .json and YAML otherwise, mapping versions to passwords. An empty
+// file is an empty map.
+func ParsePasswdMap(pwdfile string, data []byte) (map[uint32]string, error) {
+
+	var pwdmap map[uint32]string
+	if strings.HasSuffix(pwdfile, ".json") {
+		if err := json.Unmarshal(data, &pwdmap); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := yaml.Unmarshal(data, &pwdmap); err != nil {
+			return nil, err
 		}
+	}
 
-		return pwdmap, nil
+	if pwdmap == nil {
+		pwdmap = map[uint32]string{}
 	}
+	return pwdmap, nil
 }
 
-func loadPrivateKey(prvkeyfile, passwd string) (*rsa.PrivateKey, error) {
+// loadPrivateKey reads PKCS#1 (RSA PRIVATE KEY) and SEC 1 (EC PRIVATE KEY)
+// blocks, optionally with the legacy PEM encryption, and PKCS#8 blocks, either
+// plain (PRIVATE KEY) or encrypted with PBES2 (ENCRYPTED PRIVATE KEY).
+func loadPrivateKey(fsys fs.FS, prvkeyfile, passwd string) (crypto.PrivateKey, error) {
 
-	data, err := ioutil.ReadFile(prvkeyfile)
+	data, err := fs.ReadFile(fsys, prvkeyfile)
 	if err != nil {
 		return nil, err
 	}
 
-	var der []byte
-	if blk, _ := pem.Decode(data); blk == nil {
-		return nil, err
-	} else if x509.IsEncryptedPEMBlock(blk) {
-		der, err = x509.DecryptPEMBlock(blk, []byte(passwd))
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		der = blk.Bytes
+	blk, _ := pem.Decode(data)
+	if blk == nil {
+		return nil, fmt.Errorf("No PEM block found in %s", prvkeyfile)
 	}
 
-	prvkey, err := x509.ParsePKCS1PrivateKey(der)
+	var prvkey crypto.PrivateKey
+	switch blk.Type {
+	case "RSA PRIVATE KEY", "EC PRIVATE KEY":
+		der := blk.Bytes
+		if x509.IsEncryptedPEMBlock(blk) {
+			der, err = x509.DecryptPEMBlock(blk, []byte(passwd))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if blk.Type == "RSA PRIVATE KEY" {
+			prvkey, err = x509.ParsePKCS1PrivateKey(der)
+		} else {
+			prvkey, err = x509.ParseECPrivateKey(der)
+		}
+	case "PRIVATE KEY":
+		prvkey, err = x509.ParsePKCS8PrivateKey(blk.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		var der []byte
+		if der, err = decryptPKCS8(blk.Bytes, passwd); err == nil {
+			prvkey, err = x509.ParsePKCS8PrivateKey(der)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block %s in %s", blk.Type, prvkeyfile)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -180,17 +347,73 @@ func loadPrivateKey(prvkeyfile, passwd string) (*rsa.PrivateKey, error) {
 	return prvkey, nil
 }
 
-func loadAesKey(aeskeyfile string, prvkey *rsa.PrivateKey, rng io.Reader) ([]byte, error) {
+// loadKeyMeta returns an empty KeyMeta, which selects the key wrapping by the
+// type of the private key, if metafile does not exist.
+func loadKeyMeta(fsys fs.FS, metafile string) (*KeyMeta, error) {
+
+	data, err := fs.ReadFile(fsys, metafile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &KeyMeta{}, nil
+	} else if err != nil {
+		return nil, err
+	}
 
-	data, err := ioutil.ReadFile(aeskeyfile)
+	meta := &KeyMeta{}
+	if err := yaml.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func loadAesKey(fsys fs.FS, aeskeyfile string, prvkey crypto.PrivateKey, meta *KeyMeta) ([]byte, error) {
+
+	data, err := fs.ReadFile(fsys, aeskeyfile)
 	if err != nil {
 		return nil, err
 	}
 
-	aeskey, err := rsa.DecryptPKCS1v15(rng, prvkey, data)
+	wrap := meta.Wrap
+	rsakey, isRSA := prvkey.(*rsa.PrivateKey)
+	if wrap == "" && isRSA {
+		wrap = KeyWrapRSAPKCS1v15
+	} else if wrap == "" {
+		wrap = KeyWrapECIES
+	}
+	if !isRSA && wrap != KeyWrapECIES {
+		return nil, fmt.Errorf("Key wrapping %s requires an RSA private key: %s", wrap, aeskeyfile)
+	}
+
+	// crypto/rsa ignores the source of randomness of the decryption
+	var aeskey []byte
+	switch wrap {
+	case KeyWrapECIES:
+		var eckey *ecdh.PrivateKey
+		if eckey, err = ecdhPrivateKey(prvkey); err == nil {
+			aeskey, err = UnwrapKeyECIES(eckey, data)
+		}
+	case KeyWrapRSAPKCS1v15:
+		aeskey, err = rsa.DecryptPKCS1v15(nil, rsakey, data)
+	case KeyWrapRSAOAEPSHA1:
+		aeskey, err = rsa.DecryptOAEP(sha1.New(), nil, rsakey, data, []byte(meta.Label))
+	case KeyWrapRSAOAEPSHA256:
+		aeskey, err = rsa.DecryptOAEP(sha256.New(), nil, rsakey, data, []byte(meta.Label))
+	default:
+		return nil, fmt.Errorf("Unknown key wrapping %s in %s", wrap, aeskeyfile)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	return aeskey, nil
 }
+
+func ecdhPrivateKey(prvkey crypto.PrivateKey) (*ecdh.PrivateKey, error) {
+	switch k := prvkey.(type) {
+	case *ecdh.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k.ECDH()
+	default:
+		return nil, fmt.Errorf("Key wrapping %s requires an EC private key", KeyWrapECIES)
+	}
+}
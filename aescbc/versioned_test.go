@@ -17,8 +17,14 @@
 package aescbc
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -77,3 +83,285 @@ func TestNewAESCBCPKCS7ivVer_2(t *testing.T) {
 		}
 	}
 }
+
+func TestNewAESCBCPKCS7ivVer_ErrorCase(t *testing.T) {
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("failed to os.Getwd() %s", err.Error())
+		return
+	}
+	keydir := filepath.Join(wd, "test", "versioned_1-2")
+	pwdfile := filepath.Join(keydir, "pwd.yaml")
+
+	enc, dec, err := NewAESCBCPKCS7ivVerEncDec(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+
+	c := enc.Encrypt([]byte("0123456789"))
+	for j := 0; j < 4+32; j++ {
+		if _, err := dec.Decrypt(c[:j]); !errors.Is(err, ErrCiphertextTooShort) {
+			t.Errorf("Should fail with ErrCiphertextTooShort %d", j)
+			return
+		}
+	}
+	if _, err := dec.Decrypt(append(c, 0x00)); !errors.Is(err, ErrNotBlockAligned) {
+		t.Error("Should fail with ErrNotBlockAligned")
+		return
+	}
+
+	binary.BigEndian.PutUint32(c[:4], 2)
+	if _, err := dec.Decrypt(c); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Error("Should fail with ErrUnknownKeyVersion")
+		return
+	}
+}
+
+func TestNewAESCBCPKCS7ivVer_ActiveVersion(t *testing.T) {
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("failed to os.Getwd() %s", err.Error())
+		return
+	}
+	keydir := filepath.Join(wd, "test", "versioned_1-2")
+	pwdfile := filepath.Join(keydir, "pwd.yaml")
+
+	enc1, dec1, err := NewAESCBCPKCS7ivVerEncDec(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+	enc2, err := NewAESCBCPKCS7ivVerEncrypter(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create encrypter %s", err.Error())
+		return
+	}
+
+	if enc1.ActiveVersion() != 1 || enc2.ActiveVersion() != 1 {
+		t.Error("active version should default to the highest")
+		return
+	}
+
+	if err := enc1.SetActiveVersion(0); err != nil {
+		t.Errorf("failed to set version %s", err.Error())
+		return
+	}
+	if err := enc1.SetActiveVersion(2); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Error("Should fail with ErrUnknownKeyVersion")
+		return
+	}
+	if enc1.ActiveVersion() != 0 || enc2.ActiveVersion() != 1 {
+		t.Error("active version should be per instance")
+		return
+	}
+
+	src := []byte("0123456789")
+	for _, c := range [][]byte{enc1.Encrypt(src), enc2.Encrypt(src), WithRand(enc1, nil).Encrypt(src)} {
+		if _, err := dec1.Decrypt(c); err != nil {
+			t.Errorf("failed to decrypt %s", err.Error())
+			return
+		}
+	}
+	if v := binary.BigEndian.Uint32(enc1.Encrypt(src)); v != 0 {
+		t.Errorf("version %d", v)
+		return
+	}
+	if v := binary.BigEndian.Uint32(WithRand(enc1, nil).Encrypt(src)); v != 0 {
+		t.Errorf("version %d", v)
+		return
+	}
+	if v := binary.BigEndian.Uint32(enc2.Encrypt(src)); v != 1 {
+		t.Errorf("version %d", v)
+		return
+	}
+
+	// changing the version while encrypting (run with -race)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if i == 0 {
+					enc1.SetActiveVersion(uint32(j % 2))
+				} else if _, err := dec1.Decrypt(enc1.Encrypt(src)); err != nil {
+					t.Errorf("failed to decrypt %s", err.Error())
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestNewAESCBCPKCS7ivVer_Reencrypt(t *testing.T) {
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("failed to os.Getwd() %s", err.Error())
+		return
+	}
+	keydir := filepath.Join(wd, "test", "versioned_1-2")
+	pwdfile := filepath.Join(keydir, "pwd.yaml")
+
+	enc, dec, err := NewAESCBCPKCS7ivVerEncDec(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+
+	src := []byte("0123456789")
+	enc.SetActiveVersion(0)
+	c0 := enc.Encrypt(src)
+	enc.SetActiveVersion(1)
+	c1 := enc.Encrypt(src)
+
+	if v, err := CiphertextVersion(c0); err != nil || v != 0 {
+		t.Errorf("version %d", v)
+		return
+	}
+	if v, err := CiphertextVersion(c1); err != nil || v != 1 {
+		t.Errorf("version %d", v)
+		return
+	}
+
+	if c, ok, err := enc.Reencrypt(c1); err != nil {
+		t.Errorf("failed to reencrypt %s", err.Error())
+		return
+	} else if ok || !bytes.Equal(c, c1) {
+		t.Error("current ciphertext should be left as it is")
+		return
+	}
+
+	if c, ok, err := enc.Reencrypt(c0); err != nil {
+		t.Errorf("failed to reencrypt %s", err.Error())
+		return
+	} else if !ok {
+		t.Error("old ciphertext should be reencrypted")
+		return
+	} else if v, _ := CiphertextVersion(c); v != 1 {
+		t.Errorf("version %d", v)
+		return
+	} else if dst, err := dec.Decrypt(c); err != nil {
+		t.Errorf("failed to decrypt %s", err.Error())
+		return
+	} else if !bytes.Equal(src, dst) {
+		t.Errorf("Decrypted %x", dst)
+		return
+	}
+}
+
+func TestNewAESCBCPKCS7ivVer_ReencryptErrorCase(t *testing.T) {
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("failed to os.Getwd() %s", err.Error())
+		return
+	}
+	keydir := filepath.Join(wd, "test", "versioned_1-2")
+	pwdfile := filepath.Join(keydir, "pwd.yaml")
+
+	enc, err := NewAESCBCPKCS7ivVerEncrypter(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create encrypter %s", err.Error())
+		return
+	}
+
+	if _, err := CiphertextVersion([]byte{0, 0, 1}); !errors.Is(err, ErrCiphertextTooShort) {
+		t.Error("Should fail with ErrCiphertextTooShort")
+		return
+	}
+	if _, _, err := enc.Reencrypt([]byte{0, 0, 1}); !errors.Is(err, ErrCiphertextTooShort) {
+		t.Error("Should fail with ErrCiphertextTooShort")
+		return
+	}
+
+	c := enc.Encrypt([]byte("0123456789"))
+	binary.BigEndian.PutUint32(c[:4], 2)
+	if _, _, err := enc.Reencrypt(c); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Error("Should fail with ErrUnknownKeyVersion")
+		return
+	}
+	binary.BigEndian.PutUint32(c[:4], 0)
+	if _, _, err := enc.Reencrypt(c[:20]); !errors.Is(err, ErrCiphertextTooShort) {
+		t.Error("Should fail with ErrCiphertextTooShort")
+		return
+	}
+}
+
+func TestLoadAesKeyMap_OAEP(t *testing.T) {
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("failed to os.Getwd() %s", err.Error())
+		return
+	}
+	keydir := filepath.Join(wd, "test", "versioned_oaep")
+	pwdfile := filepath.Join(keydir, "pwd.yaml")
+
+	expected := map[uint32]string{
+		0: "472c1b6f76d96bbe9bee9848b28639d3",
+		1: "e0dab3dbfdc59c9ecaba74e6c1679081bd5ef2327f6ff7ec",
+		2: "e3180c7683291c906e2c1381d300889efe3a7879d890e569beb8c4898aebf596",
+	}
+	keymap, err := LoadAesKeyMap(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to load keys %s", err.Error())
+		return
+	}
+	if len(keymap) != len(expected) {
+		t.Errorf("%d versions loaded", len(keymap))
+		return
+	}
+	for vr, key := range keymap {
+		if hex.EncodeToString(key) != expected[vr] {
+			t.Errorf("version %d: key %x", vr, key)
+			return
+		}
+	}
+
+	enc, dec, err := NewAESCBCPKCS7ivVerEncDec(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+	for size := 0; size <= 64; size++ {
+		encdeccompare(t, size, enc, dec)
+	}
+}
+
+func TestLoadAesKeyMap_OAEPErrorCase(t *testing.T) {
+
+	metas := []string{
+		"wrap: RSA-OAEP-MD5\n",
+		"wrap: RSA-OAEP-SHA1\n",
+		"wrap: RSA-OAEP-SHA256\nlabel: other\n",
+		"wrap: [\n",
+	}
+	for i, meta := range metas {
+		keydir := t.TempDir()
+		for _, name := range []string{PrivkeyFilename, AeskeyFilename} {
+			if data, err := ioutil.ReadFile(filepath.Join("test", "versioned_oaep", "0", name)); err != nil {
+				t.Fatal(err)
+			} else if err := os.MkdirAll(filepath.Join(keydir, "0"), 0755); err != nil {
+				t.Fatal(err)
+			} else if err := ioutil.WriteFile(filepath.Join(keydir, "0", name), data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(keydir, "0", MetaFilename), []byte(meta), 0600); err != nil {
+			t.Fatal(err)
+		}
+		pwdfile := filepath.Join(keydir, "pwd.yaml")
+		if err := ioutil.WriteFile(pwdfile, []byte("0: password\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadAesKeyMap(keydir, pwdfile); err == nil {
+			t.Errorf("Should fail %d", i)
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aesgcm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"github.com/agwlvssainokuni/go-crypto/aescbc"
+)
+
+// Errors are shared with aescbc so that errors.Is works across both packages.
+var (
+	ErrCiphertextTooShort   = aescbc.ErrCiphertextTooShort
+	ErrUnknownKeyVersion    = aescbc.ErrUnknownKeyVersion
+	ErrAuthenticationFailed = aescbc.ErrAuthenticationFailed
+	ErrSuiteNotAllowed      = aescbc.ErrSuiteNotAllowed
+)
+
+// Encrypter and Decrypter are the same interfaces as aescbc's, so that
+// AES-GCM can be used wherever aescbc is.
+type Encrypter = aescbc.Encrypter
+
+type Decrypter = aescbc.Decrypter
+
+type AEADEncrypter = aescbc.AEADEncrypter
+
+type AEADDecrypter = aescbc.AEADDecrypter
+
+// SuiteAESGCM is the algorithm suite of gcmiv in the framed format of
+// aescbc, registered by this package.
+const SuiteAESGCM = aescbc.SuiteAESGCM
+
+// PayloadAESGCM is NewAESGCMEncDec as the payload cipher of the envelopes of
+// aescbc.
+var PayloadAESGCM = aescbc.PayloadCipher{ID: aescbc.PayloadIDAESGCM, Name: "AES-GCM", New: NewAESGCMEncDec}
+
+func init() {
+	aescbc.RegisterSuite(aescbc.Suite{
+		ID:   SuiteAESGCM,
+		Name: "AES-GCM",
+		New: func(b cipher.Block, rng io.Reader) (Encrypter, Decrypter, error) {
+			if x, err := newGCMiv(b); err != nil {
+				return nil, nil, err
+			} else {
+				x.rng = rng
+				return x, x, nil
+			}
+		},
+		NewAEAD: cipher.NewGCM,
+	})
+}
+
+// gcmiv prepends a random nonce to the sealed data, as aescbc prepends an IV:
+// "nonce(12B) + ciphertext + tag(16B)". It is an AEADEncrypter and an
+// AEADDecrypter, and Encrypt and Decrypt use empty associated data.
+type gcmiv struct {
+	aead cipher.AEAD
+	rng  io.Reader
+}
+
+// WithRand is aescbc.WithRand: it returns a copy of x, of this package or of
+// aescbc, which reads nonces and IVs from rng instead of crypto/rand.
+func WithRand(x Encrypter, rng io.Reader) Encrypter {
+	return aescbc.WithRand(x, rng)
+}
+
+func (x *gcmiv) Encrypt(src []byte) []byte {
+	return aescbc.MustEncrypt(x.TryEncrypt(src))
+}
+
+func (x *gcmiv) TryEncrypt(src []byte) ([]byte, error) {
+	return x.seal(make([]byte, 0, x.calcDstSizeToEnc(src)), src, nil)
+}
+
+func (x *gcmiv) EncryptWithAAD(src, aad []byte) ([]byte, error) {
+	return x.seal(make([]byte, 0, x.calcDstSizeToEnc(src)), src, aad)
+}
+
+func (x *gcmiv) WithRand(rng io.Reader) Encrypter {
+	return &gcmiv{x.aead, rng}
+}
+
+// seal appends "nonce + ciphertext + tag" of src to dst, authenticating aad
+// as well.
+func (x *gcmiv) seal(dst, src, aad []byte) ([]byte, error) {
+	rng := x.rng
+	if rng == nil {
+		rng = rand.Reader
+	}
+	ns := x.aead.NonceSize()
+	nonce := dst[len(dst) : len(dst)+ns]
+	if _, err := io.ReadFull(rng, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return x.aead.Seal(dst[:len(dst)+ns], nonce, src, aad), nil
+}
+
+func (x *gcmiv) calcDstSizeToEnc(src []byte) int {
+	return x.aead.NonceSize() + len(src) + x.aead.Overhead()
+}
+
+func (x *gcmiv) Decrypt(src []byte) ([]byte, error) {
+	return x.open(src, nil)
+}
+
+func (x *gcmiv) DecryptWithAAD(src, aad []byte) ([]byte, error) {
+	return x.open(src, aad)
+}
+
+func (x *gcmiv) open(src, aad []byte) ([]byte, error) {
+	ns := x.aead.NonceSize()
+	if len(src) < ns+x.aead.Overhead() {
+		return nil, fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(src))
+	}
+	if dst, err := x.aead.Open(nil, src[:ns], src[ns:], aad); err != nil {
+		return nil, ErrAuthenticationFailed
+	} else {
+		return dst, nil
+	}
+}
+
+func newGCMiv(b cipher.Block) (*gcmiv, error) {
+	if aead, err := cipher.NewGCM(b); err != nil {
+		return nil, err
+	} else {
+		return &gcmiv{aead: aead}, nil
+	}
+}
+
+func NewGCMEncrypter(b cipher.Block) (Encrypter, error) {
+	if x, err := newGCMiv(b); err != nil {
+		return nil, err
+	} else {
+		return x, nil
+	}
+}
+
+func NewGCMDecrypter(b cipher.Block) (Decrypter, error) {
+	if x, err := newGCMiv(b); err != nil {
+		return nil, err
+	} else {
+		return x, nil
+	}
+}
+
+func NewAESGCMEncrypter(key []byte) (Encrypter, error) {
+	if b, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	} else if x, err := newGCMiv(b); err != nil {
+		return nil, err
+	} else {
+		return x, nil
+	}
+}
+
+func NewAESGCMDecrypter(key []byte) (Decrypter, error) {
+	if b, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	} else if x, err := newGCMiv(b); err != nil {
+		return nil, err
+	} else {
+		return x, nil
+	}
+}
+
+func NewAESGCMEncDec(key []byte) (Encrypter, Decrypter, error) {
+	if b, err := aes.NewCipher(key); err != nil {
+		return nil, nil, err
+	} else if x, err := newGCMiv(b); err != nil {
+		return nil, nil, err
+	} else {
+		return x, x, nil
+	}
+}
@@ -0,0 +1,283 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aesgcm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/agwlvssainokuni/go-crypto/aescbc"
+)
+
+func TestAESGCM_1(t *testing.T) {
+	numOfTrial := 5
+	maxSize := 512
+
+	for i := 0; i < numOfTrial; i++ {
+
+		key := make([]byte, 16)
+		if n, err := rand.Read(key); n != 16 || err != nil {
+			t.Error("failed to create key")
+			return
+		}
+
+		cipher, err := aes.NewCipher(key)
+		if err != nil {
+			t.Error("failed to create cipher")
+			return
+		}
+
+		enc, err := NewGCMEncrypter(cipher)
+		if err != nil {
+			t.Error("failed to create encrypter")
+			return
+		}
+		dec, err := NewGCMDecrypter(cipher)
+		if err != nil {
+			t.Error("failed to create decrypter")
+			return
+		}
+
+		for size := 0; size <= maxSize; size++ {
+			encdeccompare(t, size, enc, dec)
+		}
+	}
+}
+
+func TestAESGCM_2(t *testing.T) {
+	numOfTrial := 5
+	maxSize := 512
+
+	for i := 0; i < numOfTrial; i++ {
+
+		key := make([]byte, 32)
+		if n, err := rand.Read(key); n != 32 || err != nil {
+			t.Error("failed to create key")
+			return
+		}
+
+		enc, err := NewAESGCMEncrypter(key)
+		if err != nil {
+			t.Error("failed to create encrypter")
+			return
+		}
+		dec, err := NewAESGCMDecrypter(key)
+		if err != nil {
+			t.Error("failed to create decrypter")
+			return
+		}
+
+		for size := 0; size <= maxSize; size++ {
+			encdeccompare(t, size, enc, dec)
+		}
+	}
+}
+
+func TestAESGCM_3(t *testing.T) {
+	numOfTrial := 5
+	maxSize := 512
+
+	for i := 0; i < numOfTrial; i++ {
+
+		key := make([]byte, 16)
+		if n, err := rand.Read(key); n != 16 || err != nil {
+			t.Error("failed to create key")
+			return
+		}
+
+		enc, dec, err := NewAESGCMEncDec(key)
+		if err != nil {
+			t.Error("failed to create encrypter")
+			return
+		}
+
+		for size := 0; size <= maxSize; size++ {
+			encdeccompare(t, size, enc, dec)
+		}
+	}
+}
+
+func TestAESGCM_ErrorCase(t *testing.T) {
+	numOfTrial := 5
+
+	for i := 0; i < numOfTrial; i++ {
+
+		key15 := make([]byte, 15)
+		if n, err := rand.Read(key15); n != 15 || err != nil {
+			t.Error("failed to create key15")
+			return
+		}
+
+		if _, err := NewAESGCMEncrypter(key15); err == nil {
+			t.Error("Should fail")
+			return
+		}
+		if _, err := NewAESGCMDecrypter(key15); err == nil {
+			t.Error("Should fail")
+			return
+		}
+		if _, _, err := NewAESGCMEncDec(key15); err == nil {
+			t.Error("Should fail")
+			return
+		}
+
+		key := make([]byte, 16)
+		if n, err := rand.Read(key); n != 16 || err != nil {
+			t.Error("failed to create key")
+			return
+		}
+		enc, dec, err := NewAESGCMEncDec(key)
+		if err != nil {
+			t.Error("failed to create encrypter")
+			return
+		}
+
+		c := enc.Encrypt([]byte("0123456789"))
+		for j := 0; j < len(c); j++ {
+			c[j] ^= 0x01
+			if _, err := dec.Decrypt(c); err != ErrAuthenticationFailed {
+				t.Errorf("Should fail with ErrAuthenticationFailed at %d", j)
+				return
+			}
+			c[j] ^= 0x01
+		}
+		for j := 0; j < 28; j++ {
+			if _, err := dec.Decrypt(c[:j]); err == nil {
+				t.Errorf("Should fail %d", j)
+				return
+			}
+		}
+	}
+}
+
+func encdeccompare(t *testing.T, size int, enc Encrypter, dec Decrypter) bool {
+
+	src := make([]byte, size)
+	if n, err := rand.Read(src); n != size || err != nil {
+		t.Error("failed to create source data")
+		return false
+	}
+	c := enc.Encrypt(src)
+	if len(c) != size+12+16 {
+		t.Errorf("ciphertext size %d for %d", len(c), size)
+		return false
+	}
+	dst, err := dec.Decrypt(c)
+	if err != nil {
+		t.Error("failed to decrypt")
+		return false
+	}
+
+	if !bytes.Equal(src, dst) {
+		t.Errorf("data mismatch %d", size)
+		return false
+	}
+
+	return true
+}
+
+func TestAESGCMWithRand_1(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x42}, 12)
+	src := []byte("0123456789")
+
+	keydir, pwdfile, ok := testKeydir(t)
+	if !ok {
+		return
+	}
+	verenc, err := NewAESGCMVerEncrypter(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create encrypter %s", err.Error())
+		return
+	}
+	enc, err := NewAESGCMEncrypter(make([]byte, 16))
+	if err != nil {
+		t.Error("failed to create encrypter")
+		return
+	}
+
+	for _, x := range []Encrypter{enc, verenc} {
+		c1 := aescbc.WithRand(x, bytes.NewReader(seed)).Encrypt(src)
+		c2, err := aescbc.TryEncrypt(WithRand(x, bytes.NewReader(seed)), src)
+		if err != nil {
+			t.Errorf("failed to encrypt %s", err.Error())
+			return
+		}
+		if !bytes.Equal(c1, c2) || !bytes.Contains(c1, seed) {
+			t.Error("nonce not taken from rng")
+			return
+		}
+
+		failing := WithRand(x, iotest.ErrReader(io.ErrUnexpectedEOF))
+		if _, err := aescbc.TryEncrypt(failing, src); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Error("Should fail")
+			return
+		}
+	}
+
+	// the encrypters of aescbc as well
+	cbcenc, err := aescbc.NewAESCBCPKCS7HMACEncrypter(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := WithRand(cbcenc, bytes.NewReader(bytes.Repeat([]byte{0x42}, 16))).Encrypt(src)
+	if !bytes.HasPrefix(c, bytes.Repeat([]byte{0x42}, 16)) {
+		t.Error("IV not taken from rng")
+		return
+	}
+}
+
+func TestAESGCM_AAD(t *testing.T) {
+
+	key := make([]byte, 16)
+	if n, err := rand.Read(key); n != 16 || err != nil {
+		t.Error("failed to create key")
+		return
+	}
+	enc, dec, err := NewAESGCMEncDec(key)
+	if err != nil {
+		t.Error("failed to create encrypter")
+		return
+	}
+	aenc, adec := enc.(AEADEncrypter), dec.(AEADDecrypter)
+
+	c, err := aenc.EncryptWithAAD([]byte("0123456789"), []byte("users/1/email"))
+	if err != nil {
+		t.Errorf("failed to encrypt %s", err.Error())
+		return
+	}
+	if dst, err := adec.DecryptWithAAD(c, []byte("users/1/email")); err != nil || string(dst) != "0123456789" {
+		t.Errorf("failed to decrypt %v", err)
+		return
+	}
+	if _, err := adec.DecryptWithAAD(c, []byte("users/2/email")); err != ErrAuthenticationFailed {
+		t.Error("Should fail with ErrAuthenticationFailed")
+		return
+	}
+	if _, err := dec.Decrypt(c); err != ErrAuthenticationFailed {
+		t.Error("Should fail with ErrAuthenticationFailed")
+		return
+	}
+	if dst, err := adec.DecryptWithAAD(enc.Encrypt([]byte("0123456789")), nil); err != nil || string(dst) != "0123456789" {
+		t.Errorf("failed to decrypt %v", err)
+		return
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aesgcm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/agwlvssainokuni/go-crypto/aescbc"
+)
+
+// VersionedEncrypter is the same interface as aescbc's.
+type VersionedEncrypter = aescbc.VersionedEncrypter
+
+type Reencrypter = aescbc.Reencrypter
+
+// CiphertextVersion returns the key version of a ciphertext of a versioned
+// encrypter without decrypting it.
+func CiphertextVersion(src []byte) (uint32, error) {
+	return aescbc.CiphertextVersion(src)
+}
+
+// Keyring is aescbc's reloadable set of key versions, which AES-GCM uses as
+// well, and KeyStore the source of its keys.
+type Keyring = aescbc.Keyring
+
+type KeyStore = aescbc.KeyStore
+
+// versionedSuites are the suites of the framed format which the versioned
+// decrypters read: the authenticated ones only, so that the header of a
+// ciphertext cannot downgrade them to a suite without authentication.
+var versionedSuites = []uint16{SuiteAESGCM, aescbc.SuiteAESCBCPKCS7HMACSHA256}
+
+// aadReencrypter is implemented by the framed encrypters of aescbc.
+type aadReencrypter interface {
+	ReencryptWithAAD(src, aad []byte) ([]byte, bool, error)
+}
+
+// versioned uses the same key directory layout as aescbc's versioned
+// encrypters and prefixes the output with a 4-byte big-endian key version,
+// which is authenticated as the associated data together with the aad of
+// EncryptWithAAD.
+type versioned struct {
+	ring *Keyring
+	rng  io.Reader
+}
+
+func (x *versioned) ActiveVersion() uint32 {
+	return x.ring.ActiveVersion()
+}
+
+func (x *versioned) SetActiveVersion(version uint32) error {
+	return x.ring.SetActiveVersion(version)
+}
+
+func (x *versioned) Encrypt(src []byte) []byte {
+	return aescbc.MustEncrypt(x.TryEncrypt(src))
+}
+
+func (x *versioned) TryEncrypt(src []byte) ([]byte, error) {
+	return x.encrypt(x.ActiveVersion(), src, nil)
+}
+
+func (x *versioned) EncryptWithAAD(src, aad []byte) ([]byte, error) {
+	return x.encrypt(x.ActiveVersion(), src, aad)
+}
+
+func (x *versioned) Reencrypt(src []byte) ([]byte, bool, error) {
+	return x.ReencryptWithAAD(src, nil)
+}
+
+// ReencryptWithAAD is Reencrypt of a ciphertext bound to aad. A framed
+// ciphertext of aescbc is sealed again with its own suite, which must be one
+// of versionedSuites.
+func (x *versioned) ReencryptWithAAD(src, aad []byte) ([]byte, bool, error) {
+	if aescbc.IsFramed(src) {
+		if h, _, err := aescbc.ParseHeader(src); err != nil {
+			return nil, false, err
+		} else if !allowsSuite(h.Suite) {
+			return nil, false, fmt.Errorf("%w: %d", ErrSuiteNotAllowed, h.Suite)
+		} else if enc, err := aescbc.NewFramedEncrypter(x.ring, h.Suite); err != nil {
+			return nil, false, err
+		} else {
+			return aescbc.WithRand(enc, x.rng).(aadReencrypter).ReencryptWithAAD(src, aad)
+		}
+	}
+	active := x.ActiveVersion()
+	if version, err := CiphertextVersion(src); err != nil {
+		return nil, false, err
+	} else if version == active {
+		return src, false, nil
+	} else if plain, err := x.DecryptWithAAD(src, aad); err != nil {
+		return nil, false, err
+	} else if dst, err := x.encrypt(active, plain, aad); err != nil {
+		return nil, false, err
+	} else {
+		return dst, true, nil
+	}
+}
+
+func (x *versioned) encrypt(version uint32, src, aad []byte) ([]byte, error) {
+	encdec, err := x.gcmiv(version)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, 4, 4+encdec.calcDstSizeToEnc(src))
+	binary.BigEndian.PutUint32(dst, version)
+	return encdec.seal(dst, src, append(append([]byte(nil), dst...), aad...))
+}
+
+// WithRand shares the keyring, and so the active version, with x.
+func (x *versioned) WithRand(rng io.Reader) Encrypter {
+	return &versioned{x.ring, rng}
+}
+
+// Decrypt reads the framed format of aescbc as well.
+func (x *versioned) Decrypt(src []byte) ([]byte, error) {
+	return x.DecryptWithAAD(src, nil)
+}
+
+func (x *versioned) DecryptWithAAD(src, aad []byte) ([]byte, error) {
+	if aescbc.IsFramed(src) {
+		if dec, err := aescbc.NewFramedDecrypter(x.ring, versionedSuites...); err != nil {
+			return nil, err
+		} else {
+			return dec.(AEADDecrypter).DecryptWithAAD(src, aad)
+		}
+	}
+	if version, err := CiphertextVersion(src); err != nil {
+		return nil, err
+	} else if encdec, err := x.gcmiv(version); err != nil {
+		return nil, err
+	} else {
+		return encdec.open(src[4:], append(src[:4:4], aad...))
+	}
+}
+
+func allowsSuite(id uint16) bool {
+	for _, s := range versionedSuites {
+		if s == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *versioned) gcmiv(version uint32) (*gcmiv, error) {
+	if b, err := x.ring.Block(version); err != nil {
+		return nil, err
+	} else if encdec, err := newGCMiv(b); err != nil {
+		return nil, err
+	} else {
+		encdec.rng = x.rng
+		return encdec, nil
+	}
+}
+
+func NewAESGCMVerEncrypter(topdir, pwdfile string) (VersionedEncrypter, error) {
+	if ring, err := aescbc.NewKeyring(topdir, pwdfile); err != nil {
+		return nil, err
+	} else {
+		return &versioned{ring: ring}, nil
+	}
+}
+
+func NewAESGCMVerDecrypter(topdir, pwdfile string) (Decrypter, error) {
+	if ring, err := aescbc.NewKeyring(topdir, pwdfile); err != nil {
+		return nil, err
+	} else {
+		return &versioned{ring: ring}, nil
+	}
+}
+
+func NewAESGCMVerEncDec(topdir, pwdfile string) (VersionedEncrypter, Decrypter, error) {
+	if ring, err := aescbc.NewKeyring(topdir, pwdfile); err != nil {
+		return nil, nil, err
+	} else {
+		x := &versioned{ring: ring}
+		return x, x, nil
+	}
+}
+
+// NewAESGCMVerEncDecWithRand generates the nonces from rng.
+func NewAESGCMVerEncDecWithRand(topdir, pwdfile string, rng io.Reader) (VersionedEncrypter, Decrypter, error) {
+	if ring, err := aescbc.NewKeyring(topdir, pwdfile); err != nil {
+		return nil, nil, err
+	} else {
+		return &versioned{ring, rng}, &versioned{ring: ring}, nil
+	}
+}
+
+func NewAESGCMVerEncrypterWithKeyStore(ks KeyStore) (VersionedEncrypter, error) {
+	if ring, err := aescbc.NewKeyringWithKeyStore(ks); err != nil {
+		return nil, err
+	} else {
+		return &versioned{ring: ring}, nil
+	}
+}
+
+func NewAESGCMVerDecrypterWithKeyStore(ks KeyStore) (Decrypter, error) {
+	if ring, err := aescbc.NewKeyringWithKeyStore(ks); err != nil {
+		return nil, err
+	} else {
+		return &versioned{ring: ring}, nil
+	}
+}
+
+func NewAESGCMVerEncDecWithKeyStore(ks KeyStore) (VersionedEncrypter, Decrypter, error) {
+	if ring, err := aescbc.NewKeyringWithKeyStore(ks); err != nil {
+		return nil, nil, err
+	} else {
+		x := &versioned{ring: ring}
+		return x, x, nil
+	}
+}
+
+// NewAESGCMVerEncrypterWithKeyring follows the reloads of ring, and shares its
+// active version with the other encrypters made from ring.
+func NewAESGCMVerEncrypterWithKeyring(ring *Keyring) VersionedEncrypter {
+	return &versioned{ring: ring}
+}
+
+func NewAESGCMVerDecrypterWithKeyring(ring *Keyring) Decrypter {
+	return &versioned{ring: ring}
+}
+
+func NewAESGCMVerEncDecWithKeyring(ring *Keyring) (VersionedEncrypter, Decrypter) {
+	x := &versioned{ring: ring}
+	return x, x
+}
@@ -0,0 +1,625 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aesgcm
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/agwlvssainokuni/go-crypto/aescbc"
+)
+
+func TestNewAESGCMVer_1(t *testing.T) {
+	numOfTrial := 5
+	maxSize := 512
+
+	keydir, pwdfile, ok := testKeydir(t)
+	if !ok {
+		return
+	}
+
+	enc, err := NewAESGCMVerEncrypter(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create encrypter %s", err.Error())
+		return
+	}
+
+	dec, err := NewAESGCMVerDecrypter(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create decrypter %s", err.Error())
+		return
+	}
+
+	for i := 0; i < numOfTrial; i++ {
+		for size := 0; size <= maxSize; size++ {
+			src := make([]byte, size)
+			c := enc.Encrypt(src)
+			if dst, err := dec.Decrypt(c); err != nil {
+				t.Errorf("failed to decrypt %s", err.Error())
+				return
+			} else if len(dst) != size {
+				t.Errorf("size mismatch %d", size)
+				return
+			}
+		}
+	}
+}
+
+func TestNewAESGCMVer_2(t *testing.T) {
+	maxSize := 512
+
+	keydir, pwdfile, ok := testKeydir(t)
+	if !ok {
+		return
+	}
+
+	enc, dec, err := NewAESGCMVerEncDec(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+
+	if enc.ActiveVersion() != 1 {
+		t.Errorf("active version %d", enc.ActiveVersion())
+		return
+	}
+
+	for size := 0; size <= maxSize; size++ {
+		for version := uint32(0); version <= 1; version++ {
+			if err := enc.SetActiveVersion(version); err != nil {
+				t.Errorf("failed to set version %s", err.Error())
+				return
+			}
+			c := enc.Encrypt(make([]byte, size))
+			if binary.BigEndian.Uint32(c[:4]) != version {
+				t.Errorf("version mismatch %d", version)
+				return
+			}
+			if _, err := dec.Decrypt(c); err != nil {
+				t.Errorf("failed to decrypt %s", err.Error())
+				return
+			}
+		}
+	}
+
+	if err := enc.SetActiveVersion(2); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Error("Should fail with ErrUnknownKeyVersion")
+		return
+	}
+}
+
+func TestNewAESGCMVer_ErrorCase(t *testing.T) {
+
+	keydir, pwdfile, ok := testKeydir(t)
+	if !ok {
+		return
+	}
+
+	enc, dec, err := NewAESGCMVerEncDec(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+
+	c := enc.Encrypt([]byte("0123456789"))
+	for j := 0; j < 4; j++ {
+		if _, err := dec.Decrypt(c[:j]); err == nil {
+			t.Errorf("Should fail %d", j)
+			return
+		}
+	}
+	binary.BigEndian.PutUint32(c[:4], 2)
+	if _, err := dec.Decrypt(c); err == nil {
+		t.Error("Should fail")
+		return
+	}
+	binary.BigEndian.PutUint32(c[:4], 0)
+	if _, err := dec.Decrypt(c); err != ErrAuthenticationFailed {
+		t.Error("Should fail with ErrAuthenticationFailed")
+		return
+	}
+
+	if _, err := NewAESGCMVerEncrypter(keydir, filepath.Join(keydir, "nonexistent.yaml")); err == nil {
+		t.Error("Should fail")
+		return
+	}
+}
+
+func testKeydir(t *testing.T) (string, string, bool) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("failed to os.Getwd() %s", err.Error())
+		return "", "", false
+	}
+	keydir := filepath.Join(wd, "..", "aescbc", "test", "versioned_1-2")
+	return keydir, filepath.Join(keydir, "pwd.yaml"), true
+}
+
+func TestNewAESGCMVer_Keyring(t *testing.T) {
+
+	keydir, pwdfile, ok := testKeydir(t)
+	if !ok {
+		return
+	}
+
+	ring, err := aescbc.NewKeyring(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create keyring %s", err.Error())
+		return
+	}
+	enc, dec := NewAESGCMVerEncDecWithKeyring(ring)
+	enc2 := NewAESGCMVerEncrypterWithKeyring(ring)
+
+	if err := enc.SetActiveVersion(0); err != nil {
+		t.Errorf("failed to set version %s", err.Error())
+		return
+	}
+	if enc2.ActiveVersion() != 0 || ring.ActiveVersion() != 0 {
+		t.Error("active version should be shared through the keyring")
+		return
+	}
+	if err := ring.Reload(); err != nil {
+		t.Errorf("failed to reload %s", err.Error())
+		return
+	}
+	c := enc2.Encrypt([]byte("0123456789"))
+	if binary.BigEndian.Uint32(c[:4]) != 0 {
+		t.Error("version mismatch")
+		return
+	}
+	if _, err := dec.Decrypt(c); err != nil {
+		t.Errorf("failed to decrypt %s", err.Error())
+		return
+	}
+}
+
+func TestNewAESGCMVer_Reencrypt(t *testing.T) {
+
+	keydir, pwdfile, ok := testKeydir(t)
+	if !ok {
+		return
+	}
+
+	enc, dec, err := NewAESGCMVerEncDec(keydir, pwdfile)
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+
+	src := []byte("0123456789")
+	enc.SetActiveVersion(0)
+	c0 := enc.Encrypt(src)
+	enc.SetActiveVersion(1)
+
+	if c, ok, err := enc.Reencrypt(c0); err != nil {
+		t.Errorf("failed to reencrypt %s", err.Error())
+		return
+	} else if !ok {
+		t.Error("old ciphertext should be reencrypted")
+		return
+	} else if v, _ := CiphertextVersion(c); v != 1 {
+		t.Errorf("version %d", v)
+		return
+	} else if dst, err := dec.Decrypt(c); err != nil || string(dst) != string(src) {
+		t.Error("failed to decrypt")
+		return
+	} else if c2, ok, err := enc.Reencrypt(c); err != nil || ok || &c2[0] != &c[0] {
+		t.Error("current ciphertext should be left as it is")
+		return
+	}
+
+	c0[len(c0)-1] ^= 0x01
+	if _, _, err := enc.Reencrypt(c0); err != ErrAuthenticationFailed {
+		t.Error("Should fail with ErrAuthenticationFailed")
+		return
+	}
+}
+
+func TestNewAESGCMVer_KeyStore(t *testing.T) {
+
+	ks := aescbc.NewMemKeyStore(map[uint32][]byte{
+		0: make([]byte, 16),
+		1: make([]byte, 32),
+	})
+	enc, dec, err := NewAESGCMVerEncDecWithKeyStore(ks)
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+	c := enc.Encrypt([]byte("0123456789"))
+	if binary.BigEndian.Uint32(c[:4]) != 1 {
+		t.Error("version mismatch")
+		return
+	}
+	if dst, err := dec.Decrypt(c); err != nil || string(dst) != "0123456789" {
+		t.Error("failed to decrypt")
+		return
+	}
+
+	if _, err := NewAESGCMVerEncrypterWithKeyStore(aescbc.NewMemKeyStore(nil)); err == nil {
+		t.Error("Should fail without keys")
+		return
+	}
+	if _, err := NewAESGCMVerDecrypterWithKeyStore(aescbc.NewMemKeyStore(nil)); err == nil {
+		t.Error("Should fail without keys")
+		return
+	}
+}
+
+func TestNewAESGCMVer_Header(t *testing.T) {
+
+	// versions 0 and 1 share the key, so only the header tells them apart
+	key := make([]byte, 32)
+	ring, err := aescbc.NewKeyringWithKeyStore(aescbc.NewMemKeyStore(map[uint32][]byte{0: key, 1: key}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, dec := NewAESGCMVerEncDecWithKeyring(ring)
+	c := enc.Encrypt([]byte("0123456789"))
+	binary.BigEndian.PutUint32(c[:4], 0)
+	if _, err := dec.Decrypt(c); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("Should fail with ErrAuthenticationFailed")
+		return
+	}
+
+	// every byte of the header is authenticated, also without a second key
+	for i := 0; i < 4; i++ {
+		c := enc.Encrypt([]byte("0123456789"))
+		c[i] ^= 0x80
+		if _, err := dec.Decrypt(c); err == nil {
+			t.Errorf("Should fail with byte %d modified", i)
+			return
+		}
+	}
+	framed, err := aescbc.NewFramedEncrypter(ring, SuiteAESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c0 := framed.Encrypt([]byte("0123456789"))
+	for i := 0; i < 13; i++ {
+		c := append([]byte(nil), c0...)
+		c[i] ^= 0x01
+		if _, err := dec.Decrypt(c); err == nil {
+			t.Errorf("Should fail with framed header byte %d modified", i)
+			return
+		}
+	}
+
+	// ciphertexts sealed without the header as the associated data
+	x := &versioned{ring: ring}
+	encdec, err := x.gcmiv(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noaad := make([]byte, 4, 4+encdec.calcDstSizeToEnc([]byte("0123456789")))
+	binary.BigEndian.PutUint32(noaad, 1)
+	noaad, err = encdec.seal(noaad, []byte("0123456789"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, framedDec, err := aescbc.NewFramedEncDec(ring, SuiteAESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []Decrypter{dec, framedDec} {
+		if _, err := d.Decrypt(noaad); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Error("Should fail with ErrAuthenticationFailed")
+			return
+		}
+	}
+}
+
+func TestNewAESGCMVer_AAD(t *testing.T) {
+
+	ring, err := aescbc.NewKeyringWithKeyStore(aescbc.NewMemKeyStore(map[uint32][]byte{0: make([]byte, 16), 1: make([]byte, 32)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	framed, framedDec, err := aescbc.NewFramedEncDec(ring, SuiteAESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ver, dec := NewAESGCMVerEncDecWithKeyring(ring)
+
+	type reencrypter interface {
+		ReencryptWithAAD(src, aad []byte) ([]byte, bool, error)
+	}
+	for _, enc := range []VersionedEncrypter{ver, framed} {
+		if err := enc.SetActiveVersion(0); err != nil {
+			t.Fatal(err)
+		}
+		c, err := enc.(AEADEncrypter).EncryptWithAAD([]byte("0123456789"), []byte("users/1/email"))
+		if err != nil {
+			t.Errorf("failed to encrypt %s", err.Error())
+			return
+		}
+		for _, d := range []Decrypter{dec, framedDec} {
+			if dst, err := d.(AEADDecrypter).DecryptWithAAD(c, []byte("users/1/email")); err != nil || string(dst) != "0123456789" {
+				t.Errorf("failed to decrypt %v", err)
+				return
+			}
+			if _, err := d.(AEADDecrypter).DecryptWithAAD(c, []byte("users/2/email")); !errors.Is(err, ErrAuthenticationFailed) {
+				t.Error("Should fail with ErrAuthenticationFailed")
+				return
+			}
+		}
+		if _, err := dec.Decrypt(c); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Error("Should fail with ErrAuthenticationFailed")
+			return
+		}
+
+		// key rotation keeps the associated data
+		if err := enc.SetActiveVersion(1); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := enc.Reencrypt(c); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Error("Should fail with ErrAuthenticationFailed")
+			return
+		}
+		c, ok, err := enc.(reencrypter).ReencryptWithAAD(c, []byte("users/1/email"))
+		if err != nil || !ok {
+			t.Errorf("failed to reencrypt %v", err)
+			return
+		}
+		if version, _ := CiphertextVersion(c); version != 1 {
+			t.Errorf("version %d", version)
+			return
+		}
+		if dst, err := dec.(AEADDecrypter).DecryptWithAAD(c, []byte("users/1/email")); err != nil || string(dst) != "0123456789" {
+			t.Errorf("failed to decrypt %v", err)
+			return
+		}
+	}
+
+	// the ciphertexts without associated data
+	legacy := NewAESGCMVerEncrypterWithKeyring(ring).Encrypt([]byte("0123456789"))
+	for _, d := range []Decrypter{dec, framedDec} {
+		if _, err := d.(AEADDecrypter).DecryptWithAAD(legacy, []byte("users/1/email")); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Error("Should fail with ErrAuthenticationFailed")
+			return
+		}
+	}
+
+	// the suites which are not authenticated
+	cbc, cbcdec, err := aescbc.NewFramedEncDec(ring, aescbc.SuiteAESCBCPKCS7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cbc.(AEADEncrypter).EncryptWithAAD([]byte("0123456789"), []byte("users/1/email")); err == nil {
+		t.Error("Should fail with the suite not authenticated")
+		return
+	}
+	if _, err := cbcdec.(AEADDecrypter).DecryptWithAAD(cbc.Encrypt([]byte("0123456789")), []byte("users/1/email")); err == nil {
+		t.Error("Should fail with the suite not authenticated")
+		return
+	}
+}
+
+func TestFramed_SuiteDowngrade(t *testing.T) {
+
+	key := make([]byte, 32)
+	ring, err := aescbc.NewKeyringWithKeyStore(aescbc.NewMemKeyStore(map[uint32][]byte{1: key}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cbc, err := aescbc.NewFramedEncrypter(ring, aescbc.SuiteAESCBCPKCS7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cbc.Encrypt([]byte("0123456789"))
+
+	// the decrypters of AES-GCM do not read a suite which is not
+	// authenticated, whatever the header says, and before any key is used
+	_, framedDec, err := aescbc.NewFramedEncDec(ring, SuiteAESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []Decrypter{NewAESGCMVerDecrypterWithKeyring(ring), framedDec} {
+		if _, err := d.Decrypt(c); !errors.Is(err, ErrSuiteNotAllowed) {
+			t.Errorf("Should fail with ErrSuiteNotAllowed %v", err)
+			return
+		}
+		unknown := append([]byte(nil), c...)
+		unknown[12] = 9
+		if _, err := d.Decrypt(unknown); !errors.Is(err, ErrSuiteNotAllowed) {
+			t.Errorf("Should fail with ErrSuiteNotAllowed before the key %v", err)
+			return
+		}
+	}
+	if _, _, err := aescbc.NewFramedEncDec(ring, SuiteAESGCM, aescbc.SuiteAESCBCPKCS7); !errors.Is(err, ErrSuiteNotAllowed) {
+		t.Errorf("Should fail with ErrSuiteNotAllowed %v", err)
+		return
+	}
+	if _, err := aescbc.NewFramedEncrypter(ring, SuiteAESGCM, aescbc.SuiteAESCBCCTS3); !errors.Is(err, ErrSuiteNotAllowed) {
+		t.Errorf("Should fail with ErrSuiteNotAllowed %v", err)
+		return
+	}
+	if _, _, err := aescbc.NewFramedEncDec(ring, SuiteAESGCM, aescbc.SuiteAESCBCPKCS7HMACSHA256); err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+
+	// nor AES-GCM without the authenticated header
+	gcm, err := aescbc.NewFramedEncrypter(ring, SuiteAESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = gcm.Encrypt([]byte("0123456789"))
+	c[7] = 0
+	if _, err := framedDec.Decrypt(c); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Should fail with ErrAuthenticationFailed %v", err)
+		return
+	}
+
+	// the suites never share a key
+	c = gcm.Encrypt([]byte("0123456789"))
+	_, payload, err := aescbc.ParseHeader(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := NewAESGCMDecrypter(key); err != nil {
+		t.Fatal(err)
+	} else if _, err := dec.(AEADDecrypter).DecryptWithAAD(payload, c[:len(c)-len(payload)]); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("Should fail with the key of the version")
+		return
+	}
+}
+
+func TestEnvelope_AESGCM(t *testing.T) {
+
+	ring, err := aescbc.NewKeyringWithKeyStore(aescbc.NewMemKeyStore(map[uint32][]byte{0: make([]byte, 32)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, dec := aescbc.NewEnvelopeEncDec(ring, PayloadAESGCM)
+	c := enc.Encrypt([]byte("0123456789"))
+	if dst, err := dec.Decrypt(c); err != nil || string(dst) != "0123456789" {
+		t.Error("failed to decrypt")
+		return
+	}
+	c[len(c)-1] ^= 0x01
+	if _, err := dec.Decrypt(c); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("Should fail with ErrAuthenticationFailed")
+		return
+	}
+}
+
+func TestFramed_AESGCM(t *testing.T) {
+
+	ring, err := aescbc.NewKeyringWithKeyStore(aescbc.NewMemKeyStore(map[uint32][]byte{0: make([]byte, 16), 1: make([]byte, 32)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, dec, err := aescbc.NewFramedEncDec(ring, SuiteAESGCM)
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+	c := enc.Encrypt([]byte("0123456789"))
+	if h, _, err := aescbc.ParseHeader(c); err != nil || h.Suite != SuiteAESGCM {
+		t.Error("suite mismatch")
+		return
+	}
+	for _, d := range []Decrypter{dec, NewAESGCMVerDecrypterWithKeyring(ring), aescbc.NewAESCBCPKCS7ivVerDecrypterWithKeyring(ring)} {
+		if dst, err := d.Decrypt(c); err != nil || string(dst) != "0123456789" {
+			t.Errorf("failed to decrypt %v", err)
+			return
+		}
+	}
+	if h, _, _ := aescbc.ParseHeader(c); h.Flags != aescbc.FlagAuthenticatedHeader {
+		t.Errorf("flags %d", h.Flags)
+		return
+	}
+	c[len(c)-1] ^= 0x01
+	if _, err := dec.Decrypt(c); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("Should fail with ErrAuthenticationFailed")
+		return
+	}
+	c[len(c)-1] ^= 0x01
+
+	// the header is authenticated: versions 0 and 1 share the key
+	key := make([]byte, 32)
+	ring, err = aescbc.NewKeyringWithKeyStore(aescbc.NewMemKeyStore(map[uint32][]byte{0: key, 1: key}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, dec, err = aescbc.NewFramedEncDec(ring, SuiteAESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = enc.Encrypt([]byte("0123456789"))
+	for _, tc := range []struct {
+		index int
+		value byte
+	}{
+		{7, 0x00},  // flags
+		{12, 0x00}, // key version
+	} {
+		tampered := append([]byte(nil), c...)
+		tampered[tc.index] = tc.value
+		if _, err := dec.Decrypt(tampered); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Should fail with ErrAuthenticationFailed with byte %d: %v", tc.index, err)
+			return
+		}
+	}
+
+	// the versioned encrypters keep the framed format, and so the
+	// authenticated header
+	if err := enc.SetActiveVersion(0); err != nil {
+		t.Fatal(err)
+	}
+	c0 := enc.Encrypt([]byte("0123456789"))
+	if err := enc.SetActiveVersion(1); err != nil {
+		t.Fatal(err)
+	}
+	cbc, _, err := aescbc.NewFramedEncDec(ring, aescbc.SuiteAESCBCPKCS7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []VersionedEncrypter{aescbc.NewAESCBCPKCS7ivVerEncrypterWithKeyring(ring), NewAESGCMVerEncrypterWithKeyring(ring)} {
+		c, ok, err := x.Reencrypt(c0)
+		if err != nil || !ok {
+			t.Errorf("failed to reencrypt %v", err)
+			return
+		}
+		if h, _, err := aescbc.ParseHeader(c); err != nil || h.Suite != SuiteAESGCM || h.Flags != aescbc.FlagAuthenticatedHeader {
+			t.Errorf("Should keep the suite and the flags %v", h)
+			return
+		}
+		if version, _ := CiphertextVersion(c); version != 1 {
+			t.Errorf("version %d", version)
+			return
+		}
+		c[12] = 0
+		if _, err := dec.Decrypt(c); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Error("Should fail with ErrAuthenticationFailed")
+			return
+		}
+
+		// and the suite which is not authenticated, which the decrypters of
+		// this package do not read
+		if err := cbc.SetActiveVersion(0); err != nil {
+			t.Fatal(err)
+		}
+		c = cbc.Encrypt([]byte("0123456789"))
+		if err := cbc.SetActiveVersion(1); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := x.(*versioned); ok {
+			if _, _, err := x.Reencrypt(c); !errors.Is(err, ErrSuiteNotAllowed) {
+				t.Errorf("Should fail with ErrSuiteNotAllowed %v", err)
+				return
+			}
+		} else if c, _, err := x.Reencrypt(c); err != nil {
+			t.Errorf("failed to reencrypt %s", err.Error())
+			return
+		} else if h, _, err := aescbc.ParseHeader(c); err != nil || h.Suite != aescbc.SuiteAESCBCPKCS7 {
+			t.Errorf("Should keep the suite %v", h)
+			return
+		}
+	}
+
+	// the 4-byte version header of NewAESGCMVerEncrypter
+	legacy := NewAESGCMVerEncrypterWithKeyring(ring).Encrypt([]byte("0123456789"))
+	if dst, err := dec.Decrypt(legacy); err != nil || string(dst) != "0123456789" {
+		t.Errorf("failed to decrypt %v", err)
+		return
+	}
+}
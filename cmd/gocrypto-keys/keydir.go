@@ -0,0 +1,228 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/agwlvssainokuni/go-crypto/aescbc"
+	"github.com/go-yaml/yaml"
+)
+
+type keyVersion struct {
+	version uint32
+	keySize int
+}
+
+func initKeydir(topdir, pwdfile string) error {
+	if err := os.MkdirAll(topdir, 0700); err != nil {
+		return err
+	}
+	if _, err := os.Stat(pwdfile); err == nil {
+		return fmt.Errorf("%s already exists", pwdfile)
+	}
+	return writePasswdMap(pwdfile, map[uint32]string{})
+}
+
+// versionOptions are the parameters of a new version.
+type versionOptions struct {
+	keySize int    // AES key size in bytes
+	keyType string // "rsa", "p256", "p384" or "x25519"
+	rsaBits int
+	passwd  string // encrypts privkey.pem
+	wrap    string // key wrapping, by keyType if empty
+
+	plaintextKey bool // allows an empty passwd, leaving privkey.pem unencrypted
+}
+
+// addVersion makes topdir/<highest + 1>/ with a new private key and a new AES
+// key wrapped for it, and then lists the version in pwdfile.
+func addVersion(topdir, pwdfile string, opts versionOptions) (uint32, error) {
+
+	pwdmap, err := readPasswdMap(pwdfile)
+	if err != nil {
+		return 0, err
+	}
+	version := uint32(0)
+	for vr := range pwdmap {
+		if vr+1 > version {
+			version = vr + 1
+		}
+	}
+
+	if opts.keySize != 16 && opts.keySize != 24 && opts.keySize != 32 {
+		return 0, fmt.Errorf("Invalid AES key size %d", opts.keySize)
+	}
+	if opts.passwd == "" && !opts.plaintextKey {
+		return 0, fmt.Errorf("Empty password; the private key would be written unencrypted")
+	}
+	aeskey := make([]byte, opts.keySize)
+	if _, err := rand.Read(aeskey); err != nil {
+		return 0, err
+	}
+
+	var prvkey crypto.PrivateKey
+	var wrapped []byte
+	wrap := opts.wrap
+	switch opts.keyType {
+	case "rsa":
+		if wrap == "" {
+			wrap = aescbc.KeyWrapRSAOAEPSHA256
+		}
+		var rsakey *rsa.PrivateKey
+		if rsakey, err = rsa.GenerateKey(rand.Reader, opts.rsaBits); err != nil {
+			return 0, err
+		}
+		prvkey = rsakey
+		switch wrap {
+		case aescbc.KeyWrapRSAPKCS1v15:
+			wrapped, err = rsa.EncryptPKCS1v15(rand.Reader, &rsakey.PublicKey, aeskey)
+		case aescbc.KeyWrapRSAOAEPSHA1:
+			wrapped, err = rsa.EncryptOAEP(sha1.New(), rand.Reader, &rsakey.PublicKey, aeskey, nil)
+		case aescbc.KeyWrapRSAOAEPSHA256:
+			wrapped, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, &rsakey.PublicKey, aeskey, nil)
+		default:
+			return 0, fmt.Errorf("Unknown key wrapping %s for an RSA key", wrap)
+		}
+	case "p256", "p384", "x25519":
+		if wrap == "" {
+			wrap = aescbc.KeyWrapECIES
+		} else if wrap != aescbc.KeyWrapECIES {
+			return 0, fmt.Errorf("Unknown key wrapping %s for an EC key", wrap)
+		}
+		curve := map[string]ecdh.Curve{"p256": ecdh.P256(), "p384": ecdh.P384(), "x25519": ecdh.X25519()}[opts.keyType]
+		var eckey *ecdh.PrivateKey
+		if eckey, err = curve.GenerateKey(rand.Reader); err != nil {
+			return 0, err
+		}
+		prvkey = eckey
+		wrapped, err = aescbc.WrapKeyECIES(rand.Reader, eckey.PublicKey(), aeskey)
+	default:
+		return 0, fmt.Errorf("Unknown key type %s", opts.keyType)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	pemdata, err := aescbc.MarshalPrivateKeyPEM(rand.Reader, prvkey, opts.passwd)
+	if err != nil {
+		return 0, err
+	}
+	meta, err := yaml.Marshal(&aescbc.KeyMeta{Wrap: wrap})
+	if err != nil {
+		return 0, err
+	}
+
+	basedir := filepath.Join(topdir, strconv.FormatUint(uint64(version), 10))
+	if err := os.Mkdir(basedir, 0700); err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(basedir, aescbc.PrivkeyFilename), pemdata, 0600); err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(basedir, aescbc.AeskeyFilename), wrapped, 0600); err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(basedir, aescbc.MetaFilename), meta, 0600); err != nil {
+		return 0, err
+	}
+
+	pwdmap[version] = opts.passwd
+	if err := writePasswdMap(pwdfile, pwdmap); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// listVersions loads the keys as the versioned encrypters do.
+func listVersions(topdir, pwdfile string) ([]keyVersion, error) {
+	keymap, err := aescbc.LoadAesKeyMap(topdir, pwdfile)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]keyVersion, 0, len(keymap))
+	for vr, key := range keymap {
+		versions = append(versions, keyVersion{vr, len(key)})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].version < versions[j].version })
+	return versions, nil
+}
+
+// verifyKeydir loads the keys into a keyring, as the versioned encrypters do,
+// and encrypts and decrypts a message with every version.
+func verifyKeydir(topdir, pwdfile string) ([]uint32, error) {
+	ring, err := aescbc.NewKeyring(topdir, pwdfile)
+	if err != nil {
+		return nil, err
+	}
+	enc, dec := aescbc.NewAESCBCPKCS7ivVerEncDecWithKeyring(ring)
+	src := []byte("gocrypto-keys verify")
+	for _, vr := range ring.Versions() {
+		if err := enc.SetActiveVersion(vr); err != nil {
+			return nil, err
+		}
+		if c, err := aescbc.TryEncrypt(enc, src); err != nil {
+			return nil, fmt.Errorf("version %d: %w", vr, err)
+		} else if dst, err := dec.Decrypt(c); err != nil {
+			return nil, fmt.Errorf("version %d: %w", vr, err)
+		} else if !bytes.Equal(src, dst) {
+			return nil, fmt.Errorf("version %d: decrypted data mismatch", vr)
+		}
+	}
+	return ring.Versions(), nil
+}
+
+func readPasswdMap(pwdfile string) (map[uint32]string, error) {
+	if data, err := ioutil.ReadFile(pwdfile); err != nil {
+		return nil, err
+	} else {
+		return aescbc.ParsePasswdMap(pwdfile, data)
+	}
+}
+
+func writePasswdMap(pwdfile string, pwdmap map[uint32]string) error {
+	var data []byte
+	var err error
+	if strings.HasSuffix(pwdfile, ".json") {
+		data, err = json.MarshalIndent(pwdmap, "", "  ")
+		data = append(data, '\n')
+	} else {
+		data, err = yaml.Marshal(pwdmap)
+	}
+	if err != nil {
+		return err
+	}
+	tmpfile := pwdfile + ".tmp"
+	if err := ioutil.WriteFile(tmpfile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, pwdfile)
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/agwlvssainokuni/go-crypto/aescbc"
+)
+
+func TestKeydir_1(t *testing.T) {
+	for _, name := range []string{"pwd.yaml", "pwd.json"} {
+
+		topdir := t.TempDir()
+		pwdfile := filepath.Join(topdir, name)
+
+		if err := initKeydir(topdir, pwdfile); err != nil {
+			t.Errorf("%s: failed to init %s", name, err.Error())
+			return
+		}
+		if versions, err := listVersions(topdir, pwdfile); err != nil || len(versions) != 0 {
+			t.Errorf("%s: Versions %v %v", name, versions, err)
+			return
+		}
+
+		opts := []versionOptions{
+			{keySize: 16, keyType: "rsa", rsaBits: 1024, passwd: "password", wrap: aescbc.KeyWrapRSAOAEPSHA256},
+			{keySize: 24, keyType: "rsa", rsaBits: 1024, plaintextKey: true, wrap: aescbc.KeyWrapRSAOAEPSHA1},
+			{keySize: 32, keyType: "rsa", rsaBits: 1024, passwd: "password", wrap: aescbc.KeyWrapRSAPKCS1v15},
+			{keySize: 16, keyType: "p256", passwd: "password"},
+			{keySize: 24, keyType: "p384", plaintextKey: true},
+			{keySize: 32, keyType: "x25519", passwd: "password", wrap: aescbc.KeyWrapECIES},
+		}
+		for i, opt := range opts {
+			if version, err := addVersion(topdir, pwdfile, opt); err != nil {
+				t.Errorf("%s: failed to add version %s", name, err.Error())
+				return
+			} else if version != uint32(i) {
+				t.Errorf("%s: version %d", name, version)
+				return
+			}
+		}
+
+		expected := []keyVersion{{0, 16}, {1, 24}, {2, 32}, {3, 16}, {4, 24}, {5, 32}}
+		if versions, err := listVersions(topdir, pwdfile); err != nil {
+			t.Errorf("%s: failed to list %s", name, err.Error())
+			return
+		} else if !reflect.DeepEqual(versions, expected) {
+			t.Errorf("%s: Versions %v", name, versions)
+			return
+		}
+		if versions, err := verifyKeydir(topdir, pwdfile); err != nil {
+			t.Errorf("%s: failed to verify %s", name, err.Error())
+			return
+		} else if !reflect.DeepEqual(versions, []uint32{0, 1, 2, 3, 4, 5}) {
+			t.Errorf("%s: Versions %v", name, versions)
+			return
+		}
+
+		enc, dec, err := aescbc.NewAESCBCPKCS7ivVerEncDec(topdir, pwdfile)
+		if err != nil {
+			t.Errorf("%s: failed to create encrypter/decrypter %s", name, err.Error())
+			return
+		}
+		if enc.ActiveVersion() != 5 {
+			t.Errorf("%s: active version %d", name, enc.ActiveVersion())
+			return
+		}
+		if _, err := dec.Decrypt(enc.Encrypt([]byte("0123456789"))); err != nil {
+			t.Errorf("%s: failed to decrypt %s", name, err.Error())
+			return
+		}
+	}
+}
+
+func TestKeydir_ErrorCase(t *testing.T) {
+
+	topdir := t.TempDir()
+	pwdfile := filepath.Join(topdir, "pwd.yaml")
+
+	if _, err := addVersion(topdir, pwdfile, versionOptions{keySize: 16, keyType: "rsa", rsaBits: 1024}); err == nil {
+		t.Error("Should fail without init")
+		return
+	}
+	if err := initKeydir(topdir, pwdfile); err != nil {
+		t.Errorf("failed to init %s", err.Error())
+		return
+	}
+	if err := initKeydir(topdir, pwdfile); err == nil {
+		t.Error("Should fail to init twice")
+		return
+	}
+	invalid := []versionOptions{
+		{keySize: 20, keyType: "rsa", rsaBits: 1024, passwd: "password"},
+		{keySize: 16, keyType: "rsa", rsaBits: 1024, passwd: "password", wrap: "RSA-OAEP-MD5"},
+		{keySize: 16, keyType: "rsa", rsaBits: 1024, passwd: "password", wrap: aescbc.KeyWrapECIES},
+		{keySize: 16, keyType: "p256", passwd: "password", wrap: aescbc.KeyWrapRSAOAEPSHA256},
+		{keySize: 16, keyType: "p521", passwd: "password"},
+		{keySize: 16, keyType: "p256"},
+	}
+	for i, opt := range invalid {
+		if _, err := addVersion(topdir, pwdfile, opt); err == nil {
+			t.Errorf("Should fail %d", i)
+			return
+		}
+	}
+	if _, err := verifyKeydir(topdir, pwdfile); err == nil {
+		t.Error("Should fail without versions")
+		return
+	}
+
+	if _, err := addVersion(topdir, pwdfile, versionOptions{keySize: 16, keyType: "p256", passwd: "password"}); err != nil {
+		t.Errorf("failed to add version %s", err.Error())
+		return
+	}
+	if err := writePasswdMap(pwdfile, map[uint32]string{0: "wrong"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyKeydir(topdir, pwdfile); err == nil {
+		t.Error("Should fail with wrong password")
+		return
+	}
+}
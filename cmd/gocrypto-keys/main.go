@@ -0,0 +1,182 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command gocrypto-keys manages the versioned key directories read by
+// aescbc.NewAESCBCPKCS7ivVerEncDec and the like.
+//
+//	gocrypto-keys init [-pwdfile FILE] DIR
+//	gocrypto-keys add-version [-pwdfile FILE] [-aes BITS] [-key TYPE] [-rsa BITS] [-passfile FILE] [-insecure-plaintext-key] [-wrap ALGORITHM] DIR
+//	gocrypto-keys list [-pwdfile FILE] DIR
+//	gocrypto-keys verify [-pwdfile FILE] DIR
+//
+// The password file defaults to DIR/pwd.yaml; a name ending with .json is
+// written as JSON.
+//
+// add-version reads the password of the new private key from the file of
+// -passfile, or else asks for it on the terminal, or reads the first line of
+// the standard input if it is not a terminal. An empty password is refused
+// unless -insecure-plaintext-key is given, which leaves privkey.pem
+// unencrypted.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/agwlvssainokuni/go-crypto/aescbc"
+	"golang.org/x/term"
+)
+
+const usage = `usage:
+  gocrypto-keys init [-pwdfile FILE] DIR
+  gocrypto-keys add-version [-pwdfile FILE] [-aes BITS] [-key TYPE] [-rsa BITS] [-passfile FILE] [-insecure-plaintext-key] [-wrap ALGORITHM] DIR
+  gocrypto-keys list [-pwdfile FILE] DIR
+  gocrypto-keys verify [-pwdfile FILE] DIR
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := run(os.Args[1], os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(cmd string, args []string) error {
+
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	pwdfile := fs.String("pwdfile", "", "password file (default DIR/pwd.yaml)")
+	var aesBits, rsaBits *int
+	var keyType, passfile, wrap *string
+	var plaintextKey *bool
+	if cmd == "add-version" {
+		aesBits = fs.Int("aes", 256, "AES key size in bits (128, 192 or 256)")
+		keyType = fs.String("key", "rsa", "private key type (rsa, p256, p384 or x25519)")
+		rsaBits = fs.Int("rsa", 2048, "RSA key size in bits")
+		passfile = fs.String("passfile", "", "file of the password to encrypt the private key with (default: ask)")
+		plaintextKey = fs.Bool("insecure-plaintext-key", false, "allow an empty password, leaving the private key unencrypted")
+		wrap = fs.String("wrap", "", "key wrapping of key.bin ("+
+			aescbc.KeyWrapRSAOAEPSHA256+" (default for rsa), "+aescbc.KeyWrapRSAOAEPSHA1+", "+
+			aescbc.KeyWrapRSAPKCS1v15+" or "+aescbc.KeyWrapECIES+" (default for EC keys))")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	topdir := fs.Arg(0)
+	if *pwdfile == "" {
+		*pwdfile = filepath.Join(topdir, "pwd.yaml")
+	}
+
+	switch cmd {
+	case "init":
+		return initKeydir(topdir, *pwdfile)
+	case "add-version":
+		if *aesBits%8 != 0 {
+			return fmt.Errorf("Invalid AES key size %d", *aesBits)
+		}
+		passwd, err := readPassword(*passfile, os.Stdin, os.Stderr)
+		if err != nil {
+			return err
+		}
+		if version, err := addVersion(topdir, *pwdfile, versionOptions{
+			keySize:      *aesBits / 8,
+			keyType:      *keyType,
+			rsaBits:      *rsaBits,
+			passwd:       passwd,
+			plaintextKey: *plaintextKey,
+			wrap:         *wrap,
+		}); err != nil {
+			return err
+		} else {
+			fmt.Printf("added version %d\n", version)
+			return nil
+		}
+	case "list":
+		if versions, err := listVersions(topdir, *pwdfile); err != nil {
+			return err
+		} else {
+			for _, v := range versions {
+				fmt.Printf("%d\tAES-%d\n", v.version, v.keySize*8)
+			}
+			return nil
+		}
+	case "verify":
+		if versions, err := verifyKeydir(topdir, *pwdfile); err != nil {
+			return err
+		} else {
+			for _, vr := range versions {
+				fmt.Printf("%d\tOK\n", vr)
+			}
+			return nil
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+		return nil
+	}
+}
+
+// readPassword reads the first line of passfile if given. Otherwise it asks
+// for the password twice on out without echo if in is a terminal, or reads
+// the first line of in.
+func readPassword(passfile string, in *os.File, out io.Writer) (string, error) {
+	if passfile != "" {
+		if data, err := ioutil.ReadFile(passfile); err != nil {
+			return "", err
+		} else {
+			return trimNewline(strings.SplitAfterN(string(data), "\n", 2)[0]), nil
+		}
+	}
+
+	fd := int(in.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return trimNewline(line), nil
+	}
+	var passwds [2]string
+	for i, prompt := range []string{"Password: ", "Confirm password: "} {
+		fmt.Fprint(out, prompt)
+		data, err := term.ReadPassword(fd)
+		fmt.Fprintln(out)
+		if err != nil {
+			return "", err
+		}
+		passwds[i] = string(data)
+	}
+	if passwds[0] != passwds[1] {
+		return "", fmt.Errorf("Passwords do not match")
+	}
+	return passwds[0], nil
+}
+
+func trimNewline(s string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(s, "\n"), "\r")
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadPassword_1(t *testing.T) {
+
+	dir := t.TempDir()
+	passfile := filepath.Join(dir, "passfile")
+	if err := ioutil.WriteFile(passfile, []byte("password\r\nsecond line\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if pw, err := readPassword(passfile, nil, ioutil.Discard); err != nil || pw != "password" {
+		t.Errorf("failed to read %q %v", pw, err)
+		return
+	}
+
+	// the first line of the standard input, if not a terminal
+	stdin := filepath.Join(dir, "stdin")
+	if err := ioutil.WriteFile(stdin, []byte("stdin password\nsecond line\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	in, err := os.Open(stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	if pw, err := readPassword("", in, ioutil.Discard); err != nil || pw != "stdin password" {
+		t.Errorf("failed to read %q %v", pw, err)
+		return
+	}
+}
+
+func TestReadPassword_ErrorCase(t *testing.T) {
+
+	if _, err := readPassword(filepath.Join(t.TempDir(), "none"), nil, ioutil.Discard); err == nil {
+		t.Error("Should fail without passfile")
+		return
+	}
+}
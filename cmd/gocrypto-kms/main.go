@@ -0,0 +1,77 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command gocrypto-kms is a local stand-in of a key management service. It
+// serves the protocol of package kms with the keys of a versioned key
+// directory, where the key ID of a key is its version.
+//
+//	gocrypto-kms [-addr ADDR] [-pwdfile FILE] [-poll DURATION] DIR
+//
+// The password file defaults to DIR/pwd.yaml. With -poll the key directory
+// is reloaded periodically, so that versions added by gocrypto-keys become
+// available.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/agwlvssainokuni/go-crypto/aescbc"
+	"github.com/agwlvssainokuni/go-crypto/kms"
+)
+
+const usage = `usage:
+  gocrypto-kms [-addr ADDR] [-pwdfile FILE] [-poll DURATION] DIR
+`
+
+func main() {
+
+	fs := flag.NewFlagSet("gocrypto-kms", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	addr := fs.String("addr", "127.0.0.1:8200", "address to listen on")
+	pwdfile := fs.String("pwdfile", "", "password file (default DIR/pwd.yaml)")
+	poll := fs.Duration("poll", 0, "interval to reload the key directory (0 for never)")
+	fs.Parse(os.Args[1:])
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	topdir := fs.Arg(0)
+	if *pwdfile == "" {
+		*pwdfile = filepath.Join(topdir, "pwd.yaml")
+	}
+
+	ring, err := aescbc.NewKeyring(topdir, *pwdfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *poll > 0 {
+		ring.OnReload(func(versions []uint32, err error) {
+			if err != nil {
+				log.Printf("failed to reload %s: %s", topdir, err.Error())
+			}
+		})
+		go ring.Poll(context.Background(), *poll)
+	}
+
+	log.Printf("serving versions %v of %s on %s", ring.Versions(), topdir, *addr)
+	log.Fatal(http.ListenAndServe(*addr, kms.NewHandler(kms.NewLocal(ring))))
+}
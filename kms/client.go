@@ -0,0 +1,95 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is the timeout of the HTTP client of NewClient unless given.
+const DefaultTimeout = 30 * time.Second
+
+// Client is an aescbc.KMS which calls a server of the protocol of this
+// package, e.g. gocrypto-kms.
+type Client struct {
+	url string
+	hc  *http.Client
+}
+
+// NewClient calls the server at url, e.g. "http://127.0.0.1:8200", with hc,
+// or a client of DefaultTimeout if hc is nil, so that a server which does
+// not answer never blocks the key loading.
+func NewClient(url string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = &http.Client{Timeout: DefaultTimeout}
+	}
+	return &Client{strings.TrimSuffix(url, "/"), hc}
+}
+
+func (c *Client) Encrypt(keyID string, plaintext []byte) ([]byte, error) {
+	var resp encryptResponse
+	if err := c.call("/v1/encrypt", &encryptRequest{keyID, plaintext}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Ciphertext, nil
+}
+
+func (c *Client) Decrypt(keyID string, ciphertext []byte) ([]byte, error) {
+	var resp decryptResponse
+	if err := c.call("/v1/decrypt", &decryptRequest{keyID, ciphertext}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+func (c *Client) GenerateDataKey(keyID string, size int) ([]byte, []byte, error) {
+	var resp generateDataKeyResponse
+	if err := c.call("/v1/generate-data-key", &generateDataKeyRequest{keyID, size}, &resp); err != nil {
+		return nil, nil, err
+	}
+	return resp.Plaintext, resp.Ciphertext, nil
+}
+
+func (c *Client) call(op string, req, resp interface{}) error {
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := c.hc.Post(c.url+op, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		var e errorResponse
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil || e.Code == "" {
+			return &Error{r.StatusCode, CodeInternal, r.Status}
+		}
+		return &Error{r.StatusCode, e.Code, e.Error}
+	}
+	if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+		return fmt.Errorf("kms: invalid response of %s: %w", op, err)
+	}
+	return nil
+}
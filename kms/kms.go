@@ -0,0 +1,111 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package kms implements aescbc.KMS over HTTP, and a stand-in server with
+// the keys of a versioned key directory.
+//
+// The protocol is JSON over HTTP. Every operation is a POST with a JSON
+// object, and binary values are base64 (standard encoding with padding):
+//
+//	POST /v1/encrypt            {"key_id": ID, "plaintext": B64}
+//	                         -> {"ciphertext": B64}
+//	POST /v1/decrypt            {"key_id": ID, "ciphertext": B64}
+//	                         -> {"plaintext": B64}
+//	POST /v1/generate-data-key  {"key_id": ID, "key_size": N}
+//	                         -> {"plaintext": B64, "ciphertext": B64}
+//
+// A failure is answered with a status other than 200 and
+// {"code": CODE, "error": MESSAGE}, where CODE is one of UnknownKey (404),
+// InvalidCiphertext (400), BadRequest (400) and Internal (500).
+package kms
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/agwlvssainokuni/go-crypto/aescbc"
+)
+
+// ErrBadRequest is returned for a request which no key can fulfill, e.g.
+// an unsupported key size.
+var ErrBadRequest = errors.New("Bad request")
+
+// Error codes of the protocol.
+const (
+	CodeUnknownKey        = "UnknownKey"
+	CodeInvalidCiphertext = "InvalidCiphertext"
+	CodeBadRequest        = "BadRequest"
+	CodeInternal          = "Internal"
+)
+
+type encryptRequest struct {
+	KeyID     string `json:"key_id"`
+	Plaintext []byte `json:"plaintext"`
+}
+
+type encryptResponse struct {
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type decryptRequest struct {
+	KeyID      string `json:"key_id"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type decryptResponse struct {
+	Plaintext []byte `json:"plaintext"`
+}
+
+type generateDataKeyRequest struct {
+	KeyID   string `json:"key_id"`
+	KeySize int    `json:"key_size"`
+}
+
+type generateDataKeyResponse struct {
+	Plaintext  []byte `json:"plaintext"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type errorResponse struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// Error is a failure answered by the server. It unwraps to
+// aescbc.ErrUnknownKeyVersion, aescbc.ErrAuthenticationFailed or
+// ErrBadRequest by its code, so compare it with errors.Is.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("kms: %s (%d %s)", e.Message, e.StatusCode, e.Code)
+}
+
+func (e *Error) Unwrap() error {
+	switch e.Code {
+	case CodeUnknownKey:
+		return aescbc.ErrUnknownKeyVersion
+	case CodeInvalidCiphertext:
+		return aescbc.ErrAuthenticationFailed
+	case CodeBadRequest:
+		return ErrBadRequest
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/agwlvssainokuni/go-crypto/aescbc"
+	"github.com/agwlvssainokuni/go-crypto/aesgcm"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, *aescbc.Keyring) {
+	keys := map[uint32][]byte{0: make([]byte, 16), 1: make([]byte, 32)}
+	rand.Read(keys[0])
+	rand.Read(keys[1])
+	ring, err := aescbc.NewKeyringWithKeyStore(aescbc.NewMemKeyStore(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(NewLocal(ring)))
+	t.Cleanup(srv.Close)
+	return srv, ring
+}
+
+func TestClient_1(t *testing.T) {
+
+	srv, _ := newTestServer(t)
+	client := NewClient(srv.URL+"/", srv.Client())
+
+	for _, keyID := range []string{"", "0", "1"} {
+		src := []byte("0123456789")
+		c, err := client.Encrypt(keyID, src)
+		if err != nil {
+			t.Errorf("%q: failed to encrypt %s", keyID, err.Error())
+			return
+		}
+		if version, _ := aescbc.CiphertextVersion(c); keyID == "" && version != 1 || keyID != "" && strconv.Itoa(int(version)) != keyID {
+			t.Errorf("%q: version %d", keyID, version)
+			return
+		}
+		for _, id := range []string{"", keyID} {
+			if dst, err := client.Decrypt(id, c); err != nil || !bytes.Equal(dst, src) {
+				t.Errorf("%q: failed to decrypt %v", id, err)
+				return
+			}
+		}
+	}
+
+	for _, size := range []int{16, 24, 32} {
+		key, wrapped, err := client.GenerateDataKey("0", size)
+		if err != nil {
+			t.Errorf("failed to generate %s", err.Error())
+			return
+		}
+		if len(key) != size {
+			t.Errorf("key size %d", len(key))
+			return
+		}
+		if dst, err := client.Decrypt("0", wrapped); err != nil || !bytes.Equal(dst, key) {
+			t.Error("failed to decrypt data key")
+			return
+		}
+	}
+}
+
+func TestLocal_DomainSeparation(t *testing.T) {
+
+	_, ring := newTestServer(t)
+	local := NewLocal(ring)
+	enc, dec := aesgcm.NewAESGCMVerEncDecWithKeyring(ring)
+
+	// the same layout on the same key, but not the same associated data
+	src := []byte("0123456789")
+	if _, err := local.Decrypt("", enc.Encrypt(src)); !errors.Is(err, aescbc.ErrAuthenticationFailed) {
+		t.Errorf("Should fail with ErrAuthenticationFailed %v", err)
+		return
+	}
+	if c, err := local.Encrypt("", src); err != nil {
+		t.Fatal(err)
+	} else if _, err := dec.Decrypt(c); !errors.Is(err, aescbc.ErrAuthenticationFailed) {
+		t.Errorf("Should fail with ErrAuthenticationFailed %v", err)
+		return
+	}
+	if _, c, err := local.GenerateDataKey("", 32); err != nil {
+		t.Fatal(err)
+	} else if _, err := dec.Decrypt(c); !errors.Is(err, aescbc.ErrAuthenticationFailed) {
+		t.Errorf("Should fail with ErrAuthenticationFailed %v", err)
+		return
+	}
+}
+
+func TestClient_KeyStore(t *testing.T) {
+
+	srv, _ := newTestServer(t)
+	client := NewClient(srv.URL, nil)
+
+	// a key directory of key.bin wrapped by the KMS
+	keydir := t.TempDir()
+	keys := make(map[uint32][]byte)
+	for vr, keyID := range []string{"0", "1", ""} {
+		key, wrapped, err := client.GenerateDataKey(keyID, 32)
+		if err != nil {
+			t.Errorf("failed to generate %s", err.Error())
+			return
+		}
+		keys[uint32(vr)] = key
+		basedir := filepath.Join(keydir, strconv.Itoa(vr))
+		if err := os.Mkdir(basedir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(basedir, aescbc.AeskeyFilename), wrapped, 0600); err != nil {
+			t.Fatal(err)
+		}
+		meta := "wrap: " + aescbc.KeyWrapKMS + "\nkey_id: \"" + keyID + "\"\n"
+		if err := ioutil.WriteFile(filepath.Join(basedir, aescbc.MetaFilename), []byte(meta), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ks := aescbc.NewDirKeyStoreWithKMS(keydir, client, nil)
+	for vr, expected := range keys {
+		if key, err := ks.Key(vr); err != nil || !bytes.Equal(key, expected) {
+			t.Errorf("version %d: failed to load %v", vr, err)
+			return
+		}
+	}
+	enc, dec, err := aescbc.NewAESCBCPKCS7ivVerEncDecWithKeyStore(ks)
+	if err != nil {
+		t.Errorf("failed to create encrypter/decrypter %s", err.Error())
+		return
+	}
+	if enc.ActiveVersion() != 2 {
+		t.Errorf("active version %d", enc.ActiveVersion())
+		return
+	}
+	c := enc.Encrypt([]byte("0123456789"))
+	if dst, err := dec.Decrypt(c); err != nil || string(dst) != "0123456789" {
+		t.Error("failed to decrypt")
+		return
+	}
+
+	// without the KMS
+	if _, _, err := aescbc.NewAESCBCPKCS7ivVerEncDecWithKeyStore(aescbc.NewDirKeyStoreWithPasswordSource(keydir, aescbc.NewPasswordMapSource(map[uint32]string{0: ""}))); err == nil {
+		t.Error("Should fail without KMS")
+		return
+	}
+}
+
+func TestClient_ErrorCase(t *testing.T) {
+
+	srv, _ := newTestServer(t)
+	client := NewClient(srv.URL, nil)
+	if client.hc.Timeout != DefaultTimeout {
+		t.Errorf("timeout %v", client.hc.Timeout)
+		return
+	}
+
+	for _, keyID := range []string{"2", "abc", "-1"} {
+		if _, err := client.Encrypt(keyID, []byte("0123456789")); !errors.Is(err, aescbc.ErrUnknownKeyVersion) {
+			t.Errorf("%q: Should fail with ErrUnknownKeyVersion %v", keyID, err)
+			return
+		}
+	}
+	if _, _, err := client.GenerateDataKey("", 20); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Should fail with ErrBadRequest %v", err)
+		return
+	}
+
+	c, err := client.Encrypt("0", []byte("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Decrypt("1", c); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Should fail with ErrBadRequest %v", err)
+		return
+	}
+	for i := range c {
+		c[i] ^= 0x01
+		if _, err := client.Decrypt("", c); err == nil {
+			t.Errorf("Should fail with a tampered byte %d", i)
+			return
+		} else if i >= 4 && !errors.Is(err, aescbc.ErrAuthenticationFailed) {
+			t.Errorf("Should fail with ErrAuthenticationFailed %d", i)
+			return
+		}
+		c[i] ^= 0x01
+	}
+	for _, n := range []int{0, 3, 4, 31} {
+		if _, err := client.Decrypt("", c[:n]); !errors.Is(err, aescbc.ErrAuthenticationFailed) {
+			t.Errorf("Should fail with ErrAuthenticationFailed %d", n)
+			return
+		}
+	}
+
+	var e *Error
+	if _, err := client.Decrypt("", nil); !errors.As(err, &e) || e.StatusCode != http.StatusBadRequest || e.Code != CodeInvalidCiphertext {
+		t.Errorf("Should fail with Error %v", err)
+		return
+	}
+	if r, err := http.Post(srv.URL+"/v1/encrypt", "application/json", strings.NewReader("{")); err != nil {
+		t.Fatal(err)
+	} else if r.Body.Close(); r.StatusCode != http.StatusBadRequest {
+		t.Errorf("status %d", r.StatusCode)
+		return
+	}
+	if r, err := http.Get(srv.URL + "/v1/encrypt"); err != nil {
+		t.Fatal(err)
+	} else if r.Body.Close(); r.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("status %d", r.StatusCode)
+		return
+	}
+	if _, err := NewClient(srv.URL+"/none", nil).Encrypt("", nil); !errors.As(err, &e) || e.StatusCode != http.StatusNotFound {
+		t.Errorf("Should fail with Error %v", err)
+		return
+	}
+
+	srv.Close()
+	if _, err := client.Encrypt("", []byte("0123456789")); err == nil {
+		t.Error("Should fail without server")
+		return
+	}
+}
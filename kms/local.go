@@ -0,0 +1,126 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/agwlvssainokuni/go-crypto/aescbc"
+)
+
+// Local is a KMS in process with the keys of a Keyring, which the stand-in
+// server serves. The key ID of a key is its version in decimal, and the
+// empty key ID is the active version for Encrypt and GenerateDataKey.
+// A ciphertext is "key version (4B) + nonce(12B) + AES-GCM(plaintext) +
+// tag(16B)", and its associated data is "gocrypto-kms" + 0x00 + the key ID of
+// the version. It binds the key version, and keeps the ciphertexts of Local
+// apart from those of the other formats on the same keys, e.g. of
+// aesgcm.NewAESGCMVerEncrypterWithKeyring.
+type Local struct {
+	ring *aescbc.Keyring
+}
+
+func NewLocal(ring *aescbc.Keyring) *Local {
+	return &Local{ring}
+}
+
+func (x *Local) Encrypt(keyID string, plaintext []byte) ([]byte, error) {
+	version, err := x.version(keyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := x.aead(version)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, 4+aead.NonceSize(), 4+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint32(dst[:4], version)
+	nonce := dst[4:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(dst, nonce, plaintext, associatedData(version)), nil
+}
+
+// Decrypt takes the key version from ciphertext. A non-empty keyID must be
+// that version.
+func (x *Local) Decrypt(keyID string, ciphertext []byte) ([]byte, error) {
+	version, err := aescbc.CiphertextVersion(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if keyID != "" && keyID != strconv.FormatUint(uint64(version), 10) {
+		return nil, fmt.Errorf("%w: key ID %s for a ciphertext of key version %d", ErrBadRequest, keyID, version)
+	}
+	aead, err := x.aead(version)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < 4+aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%w: %d bytes", aescbc.ErrCiphertextTooShort, len(ciphertext))
+	}
+	nonce := ciphertext[4 : 4+aead.NonceSize()]
+	if plaintext, err := aead.Open(nil, nonce, ciphertext[4+aead.NonceSize():], associatedData(version)); err != nil {
+		return nil, aescbc.ErrAuthenticationFailed
+	} else {
+		return plaintext, nil
+	}
+}
+
+// GenerateDataKey generates AES keys, so size is 16, 24 or 32.
+func (x *Local) GenerateDataKey(keyID string, size int) ([]byte, []byte, error) {
+	if size != 16 && size != 24 && size != 32 {
+		return nil, nil, fmt.Errorf("%w: data key size %d", ErrBadRequest, size)
+	}
+	plaintext := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, plaintext); err != nil {
+		return nil, nil, err
+	}
+	if ciphertext, err := x.Encrypt(keyID, plaintext); err != nil {
+		return nil, nil, err
+	} else {
+		return plaintext, ciphertext, nil
+	}
+}
+
+func (x *Local) version(keyID string) (uint32, error) {
+	if keyID == "" {
+		return x.ring.ActiveVersion(), nil
+	}
+	if version, err := strconv.ParseUint(keyID, 10, 32); err != nil {
+		return 0, fmt.Errorf("%w: key ID %s", aescbc.ErrUnknownKeyVersion, keyID)
+	} else {
+		return uint32(version), nil
+	}
+}
+
+func (x *Local) aead(version uint32) (cipher.AEAD, error) {
+	if b, err := x.ring.Block(version); err != nil {
+		return nil, err
+	} else {
+		return cipher.NewGCM(b)
+	}
+}
+
+func associatedData(version uint32) []byte {
+	return []byte("gocrypto-kms\x00" + strconv.FormatUint(uint64(version), 10))
+}
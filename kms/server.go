@@ -0,0 +1,89 @@
+/*
+ * Copyright 2017 agwlvssainokuni
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/agwlvssainokuni/go-crypto/aescbc"
+)
+
+// maxRequestSize limits the JSON body of a request.
+const maxRequestSize = 1 << 20
+
+// NewHandler serves the protocol of this package with kms, e.g. a Local.
+func NewHandler(kms aescbc.KMS) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/encrypt", func(w http.ResponseWriter, r *http.Request) {
+		var req encryptRequest
+		if decodeRequest(w, r, &req) {
+			ciphertext, err := kms.Encrypt(req.KeyID, req.Plaintext)
+			writeResponse(w, &encryptResponse{ciphertext}, err)
+		}
+	})
+	mux.HandleFunc("POST /v1/decrypt", func(w http.ResponseWriter, r *http.Request) {
+		var req decryptRequest
+		if decodeRequest(w, r, &req) {
+			plaintext, err := kms.Decrypt(req.KeyID, req.Ciphertext)
+			writeResponse(w, &decryptResponse{plaintext}, err)
+		}
+	})
+	mux.HandleFunc("POST /v1/generate-data-key", func(w http.ResponseWriter, r *http.Request) {
+		var req generateDataKeyRequest
+		if decodeRequest(w, r, &req) {
+			plaintext, ciphertext, err := kms.GenerateDataKey(req.KeyID, req.KeySize)
+			writeResponse(w, &generateDataKeyResponse{plaintext, ciphertext}, err)
+		}
+	})
+	return mux
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(req); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Invalid request: %s", err.Error()))
+		return false
+	}
+	return true
+}
+
+func writeResponse(w http.ResponseWriter, resp interface{}, err error) {
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, resp)
+	case errors.Is(err, aescbc.ErrUnknownKeyVersion):
+		writeError(w, http.StatusNotFound, CodeUnknownKey, err.Error())
+	case errors.Is(err, aescbc.ErrAuthenticationFailed), errors.Is(err, aescbc.ErrCiphertextTooShort):
+		writeError(w, http.StatusBadRequest, CodeInvalidCiphertext, err.Error())
+	case errors.Is(err, ErrBadRequest):
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, &errorResponse{code, message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
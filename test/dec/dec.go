@@ -17,6 +17,7 @@
 package main
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 
@@ -28,16 +29,11 @@ func main() {
 	if key, err := ioutil.ReadFile(keyfile); err != nil {
 		println(err.Error())
 		return
-	} else if dec, err := aescbc.NewAESCBCPKCS7ivDecrypter(key); err != nil {
+	} else if r, err := aescbc.NewAESCBCPKCS7ivReader(key, os.Stdin); err != nil {
 		println(err.Error())
 		return
-	} else if src, err := ioutil.ReadAll(os.Stdin); err != nil {
+	} else if _, err := io.Copy(os.Stdout, r); err != nil {
 		println(err.Error())
 		return
-	} else if dst, err := dec.Decrypt(src); err != nil {
-		println(err.Error())
-		return
-	} else {
-		os.Stdout.Write(dst)
 	}
 }
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 
@@ -28,14 +29,14 @@ func main() {
 	if key, err := ioutil.ReadFile(keyfile); err != nil {
 		println(err.Error())
 		return
-	} else if enc, err := aescbc.NewAESCBCPKCS7ivEncrypter(key); err != nil {
+	} else if w, err := aescbc.NewAESCBCPKCS7ivWriter(key, os.Stdout); err != nil {
 		println(err.Error())
 		return
-	} else if src, err := ioutil.ReadAll(os.Stdin); err != nil {
+	} else if _, err := io.Copy(w, os.Stdin); err != nil {
+		println(err.Error())
+		return
+	} else if err := w.Close(); err != nil {
 		println(err.Error())
 		return
-	} else {
-		dst := enc.Encrypt(src)
-		os.Stdout.Write(dst)
 	}
 }